@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"crypto/tls"
 	"encoding/hex"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
@@ -14,10 +13,15 @@ import (
 
 var ErrTimeout = errors.New("timeout")
 
+// Notification to a device. Topic, Priority and CollapseId are only sent by
+// HTTP2.
 type Notification struct {
 	DeviceToken        string
 	Identifier         uint32
 	ExpireAfterSeconds int
+	Topic              string
+	Priority           int
+	CollapseId         string
 
 	Payload *Payload
 }
@@ -164,7 +168,7 @@ func (a *Apn) send(notification *Notification) error {
 		return err
 	}
 
-	payloadbyte, err := json.Marshal(notification.Payload)
+	payloadbyte, err := notification.Payload.MarshalSize(PayloadSizeBinary)
 	if err != nil {
 		return err
 	}
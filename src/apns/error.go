@@ -77,6 +77,19 @@ func (e NotificationError) Error() string {
 	return fmt.Sprintf("%s(%d): id(%x)", e.Status.String(), e.Status, e.Identifier)
 }
 
+// RecipientError returns true if the error is of the device token or the
+// notification, not of the provider.
+func (e NotificationError) RecipientError() bool {
+	if e.OtherError != nil {
+		return false
+	}
+	switch e.Status {
+	case ErrorMissingDevice, ErrorMissingPayload, ErrorInvalidTokenSize, ErrorInvalidPayloadSize, ErrorInvalidToken:
+		return true
+	}
+	return false
+}
+
 func (e NotificationError) String() string {
 	return e.Error()
 }
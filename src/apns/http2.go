@@ -0,0 +1,232 @@
+package apns
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenRefresh is how long a provider token is reused. Apple rejects tokens
+// older than an hour, and too frequent refreshing.
+const tokenRefresh = 50 * time.Minute
+
+// HTTP2Error is the per-notification error of HTTP/2 provider API, like
+// status 410 with reason "Unregistered".
+type HTTP2Error struct {
+	Status    int
+	Reason    string
+	Timestamp int64
+}
+
+func (e HTTP2Error) Error() string {
+	return fmt.Sprintf("%s(%d)", e.Reason, e.Status)
+}
+
+// InvalidToken returns true if the device token can't be used any more.
+func (e HTTP2Error) InvalidToken() bool {
+	switch e.Reason {
+	case "BadDeviceToken", "Unregistered":
+		return true
+	}
+	return e.Status == http.StatusGone
+}
+
+// RecipientError returns true if the error is of the device token or the
+// notification, not of the provider.
+func (e HTTP2Error) RecipientError() bool {
+	switch e.Reason {
+	case "PayloadTooLarge", "TooManyRequests":
+		return true
+	}
+	return e.InvalidToken()
+}
+
+// WrongTopic returns true if the device token is of another app than the
+// topic, which means the topic is misconfigured rather than the token is bad.
+func (e HTTP2Error) WrongTopic() bool {
+	return e.Reason == "DeviceTokenNotForTopic"
+}
+
+// An HTTP2 sends notifications with the HTTP/2 provider API, authenticated
+// by the JWT signed with .p8 key. Every notification gets its result
+// synchronously.
+type HTTP2 struct {
+	server string
+	keyId  string
+	teamId string
+	key    *ecdsa.PrivateKey
+	client *http.Client
+	token  string
+	issued time.Time
+	locker sync.Mutex
+}
+
+// NewHTTP2 with server like "https://api.push.apple.com", the .p8 key file
+// with its key id and team id. rootCA is the pem of trusted CAs, "" to use
+// system CAs.
+func NewHTTP2(server, rootCA, keyFile, keyId, teamId string, timeout time.Duration) (*HTTP2, error) {
+	b, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parseAuthKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key %s: %s", keyFile, err)
+	}
+	conf := &tls.Config{}
+	if rootCA != "" {
+		pem, err := ioutil.ReadFile(rootCA)
+		if err != nil {
+			return nil, err
+		}
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no cert in %s", rootCA)
+		}
+	}
+	transport := &http.Transport{
+		TLSClientConfig:   conf,
+		ForceAttemptHTTP2: true,
+	}
+	return &HTTP2{
+		server: strings.TrimRight(server, "/"),
+		keyId:  keyId,
+		teamId: teamId,
+		key:    key,
+		client: &http.Client{Transport: transport, Timeout: timeout},
+	}, nil
+}
+
+func parseAuthKey(b []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no pem block")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ret, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("not an ecdsa key")
+	}
+	return ret, nil
+}
+
+// Send posts notification to its device token, with headers of topic,
+// priority and collapse id. It returns HTTP2Error if apple rejects it.
+func (a *HTTP2) Send(notification *Notification) error {
+	payload, err := notification.Payload.MarshalSize(PayloadSizeHTTP2)
+	if err != nil {
+		return err
+	}
+	token, err := a.providerToken()
+	if err != nil {
+		return err
+	}
+	url := fmt.Sprintf("%s/3/device/%s", a.server, notification.DeviceToken)
+	req, err := http.NewRequest("POST", url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("authorization", "bearer "+token)
+	if notification.Topic != "" {
+		req.Header.Set("apns-topic", notification.Topic)
+	}
+	if notification.Priority != 0 {
+		req.Header.Set("apns-priority", fmt.Sprintf("%d", notification.Priority))
+	}
+	if notification.CollapseId != "" {
+		req.Header.Set("apns-collapse-id", notification.CollapseId)
+	}
+	if notification.ExpireAfterSeconds > 0 {
+		expiration := time.Now().Add(time.Duration(notification.ExpireAfterSeconds) * time.Second)
+		req.Header.Set("apns-expiration", fmt.Sprintf("%d", expiration.Unix()))
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	var body struct {
+		Reason    string `json:"reason"`
+		Timestamp int64  `json:"timestamp"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		body.Reason = http.StatusText(resp.StatusCode)
+	}
+	if body.Reason == "ExpiredProviderToken" {
+		a.locker.Lock()
+		a.token = ""
+		a.locker.Unlock()
+	}
+	return HTTP2Error{
+		Status:    resp.StatusCode,
+		Reason:    body.Reason,
+		Timestamp: body.Timestamp,
+	}
+}
+
+// providerToken returns the JWT in use, and signs a new one if it's too old.
+func (a *HTTP2) providerToken() (string, error) {
+	a.locker.Lock()
+	defer a.locker.Unlock()
+
+	now := time.Now()
+	if a.token != "" && now.Sub(a.issued) < tokenRefresh {
+		return a.token, nil
+	}
+	token, err := signToken(a.key, a.keyId, a.teamId, now)
+	if err != nil {
+		return "", err
+	}
+	a.token, a.issued = token, now
+	return token, nil
+}
+
+func signToken(key *ecdsa.PrivateKey, keyId, teamId string, now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{
+		"alg": "ES256",
+		"kid": keyId,
+	})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss": teamId,
+		"iat": now.Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	encoding := base64.RawURLEncoding
+	unsigned := encoding.EncodeToString(header) + "." + encoding.EncodeToString(claims)
+	hash := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, key, hash[:])
+	if err != nil {
+		return "", err
+	}
+	// ES256 signature is r and s in 32 bytes each.
+	size := (key.Curve.Params().BitSize + 7) / 8
+	sig := make([]byte, 2*size)
+	rb, sb := r.Bytes(), s.Bytes()
+	copy(sig[size-len(rb):size], rb)
+	copy(sig[2*size-len(sb):], sb)
+	return unsigned + "." + encoding.EncodeToString(sig), nil
+}
@@ -0,0 +1,182 @@
+package apns
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeTemp(t *testing.T, name string, block *pem.Block) string {
+	f, err := ioutil.TempFile("", name)
+	if err != nil {
+		t.Fatalf("can't create temp file: %s", err)
+	}
+	defer f.Close()
+	if err := pem.Encode(f, block); err != nil {
+		t.Fatalf("can't write pem: %s", err)
+	}
+	return f.Name()
+}
+
+func verifyToken(key *ecdsa.PublicKey, token string) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("invalid jwt: %s", token)
+	}
+	var header map[string]string
+	b, _ := base64.RawURLEncoding.DecodeString(parts[0])
+	if err := json.Unmarshal(b, &header); err != nil || header["alg"] != "ES256" || header["kid"] != "KEYID" {
+		return fmt.Errorf("invalid header: %s", b)
+	}
+	var claims map[string]interface{}
+	b, _ = base64.RawURLEncoding.DecodeString(parts[1])
+	if err := json.Unmarshal(b, &claims); err != nil || claims["iss"] != "TEAMID" {
+		return fmt.Errorf("invalid claims: %s", b)
+	}
+	sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	if len(sig) != 64 {
+		return fmt.Errorf("invalid signature length: %d", len(sig))
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+	if !ecdsa.Verify(key, hash[:], r, s) {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
+
+func TestHTTP2Send(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("can't generate key: %s", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("can't marshal key: %s", err)
+	}
+	keyFile := writeTemp(t, "apns.p8", &pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	defer os.Remove(keyFile)
+
+	type request struct {
+		proto   int
+		path    string
+		headers http.Header
+		payload map[string]interface{}
+	}
+	requests := make(chan request, 10)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := request{
+			proto:   r.ProtoMajor,
+			path:    r.URL.Path,
+			headers: r.Header,
+		}
+		json.NewDecoder(r.Body).Decode(&req.payload)
+		requests <- req
+		if err := verifyToken(&key.PublicKey, strings.TrimPrefix(r.Header.Get("authorization"), "bearer ")); err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, `{"reason":"InvalidProviderToken"}`)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/gone") {
+			w.WriteHeader(http.StatusGone)
+			fmt.Fprintf(w, `{"reason":"Unregistered","timestamp":1368000000000}`)
+			return
+		}
+		w.Header().Set("apns-id", "abc")
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+	rootCA := writeTemp(t, "rootca.pem", &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	defer os.Remove(rootCA)
+
+	apn, err := NewHTTP2(server.URL, rootCA, keyFile, "KEYID", "TEAMID", time.Second*5)
+	if err != nil {
+		t.Fatalf("can't create: %s", err)
+	}
+
+	payload := Payload{}
+	payload.Aps.Alert.Body = "hello"
+	payload.SetCustom("url", "exfe://!123")
+	err = apn.Send(&Notification{
+		DeviceToken:        "token",
+		ExpireAfterSeconds: 60,
+		Topic:              "com.exfe.app",
+		Priority:           10,
+		CollapseId:         "cross-123",
+		Payload:            &payload,
+	})
+	if err != nil {
+		t.Fatalf("send failed: %s", err)
+	}
+	req := <-requests
+	if req.proto != 2 {
+		t.Errorf("expect http/2, got: %d", req.proto)
+	}
+	if req.path != "/3/device/token" {
+		t.Errorf("invalid path: %s", req.path)
+	}
+	for k, v := range map[string]string{"apns-topic": "com.exfe.app", "apns-priority": "10", "apns-collapse-id": "cross-123"} {
+		if got := req.headers.Get(k); got != v {
+			t.Errorf("header %s got: %s, expect: %s", k, got, v)
+		}
+	}
+	if req.headers.Get("apns-expiration") == "" {
+		t.Errorf("no apns-expiration")
+	}
+	if got := req.payload["url"]; got != "exfe://!123" {
+		t.Errorf("invalid payload: %v", req.payload)
+	}
+
+	err = apn.Send(&Notification{
+		DeviceToken: "gone",
+		Payload:     &payload,
+	})
+	e, ok := err.(HTTP2Error)
+	if !ok {
+		t.Fatalf("expect HTTP2Error, got: %#v", err)
+	}
+	if e.Status != http.StatusGone || e.Reason != "Unregistered" || e.Timestamp != 1368000000000 || !e.InvalidToken() {
+		t.Errorf("invalid error: %#v", e)
+	}
+	req = <-requests
+	if req.headers.Get("apns-topic") != "" || req.headers.Get("apns-collapse-id") != "" {
+		t.Errorf("unexpected headers: %v", req.headers)
+	}
+}
+
+func TestHTTP2ErrorInvalidToken(t *testing.T) {
+	tests := []struct {
+		err     HTTP2Error
+		invalid bool
+		topic   bool
+	}{
+		{HTTP2Error{Status: http.StatusGone, Reason: "Unregistered"}, true, false},
+		{HTTP2Error{Status: http.StatusBadRequest, Reason: "BadDeviceToken"}, true, false},
+		{HTTP2Error{Status: http.StatusBadRequest, Reason: "DeviceTokenNotForTopic"}, false, true},
+		{HTTP2Error{Status: http.StatusBadRequest, Reason: "BadTopic"}, false, false},
+		{HTTP2Error{Status: http.StatusInternalServerError, Reason: "InternalServerError"}, false, false},
+	}
+	for i, test := range tests {
+		if got := test.err.InvalidToken(); got != test.invalid {
+			t.Errorf("test %d: InvalidToken() = %v, expect %v", i, got, test.invalid)
+		}
+		if got := test.err.WrongTopic(); got != test.topic {
+			t.Errorf("test %d: WrongTopic() = %v, expect %v", i, got, test.topic)
+		}
+	}
+}
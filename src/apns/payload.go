@@ -2,10 +2,25 @@ package apns
 
 import (
 	"encoding/json"
+	"errors"
 )
 
+// Max payload sizes in bytes: legacy binary protocol before iOS 8, binary
+// protocol since iOS 8, and HTTP/2 provider API.
+const (
+	PayloadSizeLegacy = 256
+	PayloadSizeBinary = 2048
+	PayloadSizeHTTP2  = 4096
+)
+
+var ErrPayloadTooLarge = errors.New("payload too large")
+
 type Alert struct {
+	Title         string   `json:"title,omitempty"`
+	Subtitle      string   `json:"subtitle,omitempty"`
 	Body          string   `json:"body,omitempty"`
+	TitleLockKey  string   `json:"title-loc-key,omitempty"`
+	TitleLockArgs []string `json:"title-loc-args,omitempty"`
 	LockKey       string   `json:"loc-key,omitempty"`
 	LockArgs      []string `json:"loc-args,omitempty"`
 	ActionLockKey string   `json:"action-loc-key,omitempty"`
@@ -14,10 +29,17 @@ type Alert struct {
 
 // If AlertStruct set to any instance, it will ignore any content in Alert when send to iOS.
 // To use simple string Alert, make sure AlertStruct's value is nil.
+//
+// MutableContent 1 lets the notification service extension modify the
+// notification, Category picks its actions, and notifications with the same
+// ThreadId are grouped.
 type Aps struct {
-	Alert Alert  `json:"alert,omitempty"`
-	Badge int    `json:"badge,omitempty"`
-	Sound string `json:"sound,omitempty"`
+	Alert          Alert  `json:"alert,omitempty"`
+	Badge          int    `json:"badge,omitempty"`
+	Sound          string `json:"sound,omitempty"`
+	MutableContent int    `json:"mutable-content,omitempty"`
+	Category       string `json:"category,omitempty"`
+	ThreadId       string `json:"thread-id,omitempty"`
 }
 
 type Payload struct {
@@ -52,3 +74,33 @@ func (l Payload) MarshalJSON() ([]byte, error) {
 	l.customProperty["aps"] = l.Aps
 	return json.Marshal(l.customProperty)
 }
+
+// MarshalSize returns the json of payload no larger than size, truncating the
+// alert body with "..." if it's too large. It returns ErrPayloadTooLarge if
+// payload is still too large without body.
+func (l Payload) MarshalSize(size int) ([]byte, error) {
+	ret, err := json.Marshal(l)
+	if err != nil || len(ret) <= size {
+		return ret, err
+	}
+	body := []rune(l.Aps.Alert.Body)
+	// binary search the most runes of body fitting in size.
+	fit, min, max := []byte(nil), 0, len(body)-1
+	for min <= max {
+		n := (min + max) / 2
+		l.Aps.Alert.Body = string(body[:n]) + "..."
+		b, err := json.Marshal(l)
+		if err != nil {
+			return nil, err
+		}
+		if len(b) <= size {
+			fit, min = b, n+1
+		} else {
+			max = n - 1
+		}
+	}
+	if fit == nil {
+		return nil, ErrPayloadTooLarge
+	}
+	return fit, nil
+}
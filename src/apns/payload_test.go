@@ -2,6 +2,7 @@ package apns
 
 import (
 	"encoding/json"
+	"strings"
 	"testing"
 )
 
@@ -162,3 +163,70 @@ func TestPayloadMarshal(t *testing.T) {
 		}
 	}
 }
+
+func TestApsRichMarshal(t *testing.T) {
+	aps := Aps{}
+	aps.Alert = Alert{
+		Title:    "Dinner",
+		Subtitle: "Updated",
+		LockKey:  "CROSS_UPDATE_FORMAT",
+		LockArgs: []string{"Bob", "Dinner"},
+	}
+	aps.MutableContent = 1
+	aps.Category = "cross"
+	aps.ThreadId = "123"
+	j, err := json.Marshal(aps)
+	if err != nil {
+		t.Fatalf("can't marshal to json: %s", err)
+	}
+	if got, expect := string(j), `{"alert":{"title":"Dinner","subtitle":"Updated","loc-key":"CROSS_UPDATE_FORMAT","loc-args":["Bob","Dinner"]},"mutable-content":1,"category":"cross","thread-id":"123"}`; got != expect {
+		t.Errorf("got: %s, expect: %s", got, expect)
+	}
+}
+
+func TestPayloadMarshalSize(t *testing.T) {
+	for _, size := range []int{PayloadSizeLegacy, PayloadSizeBinary, PayloadSizeHTTP2} {
+		payload := Payload{}
+		payload.Aps.Alert.Body = "short"
+		payload.Aps.ThreadId = "123"
+		payload.SetCustom("path", "/!123/cross")
+		expect, _ := json.Marshal(payload)
+		j, err := payload.MarshalSize(size)
+		if err != nil {
+			t.Fatalf("size %d marshal short failed: %s", size, err)
+		}
+		if string(j) != string(expect) {
+			t.Errorf("size %d got: %s, expect: %s", size, j, expect)
+		}
+
+		body := strings.Repeat("你好 \"exfe\" ", size)
+		payload.Aps.Alert.Body = body
+		j, err = payload.MarshalSize(size)
+		if err != nil {
+			t.Fatalf("size %d marshal long failed: %s", size, err)
+		}
+		if len(j) > size || len(j) < size-20 {
+			t.Errorf("size %d got length %d", size, len(j))
+		}
+		var raw struct {
+			Aps Aps `json:"aps"`
+		}
+		if err := json.Unmarshal(j, &raw); err != nil {
+			t.Fatalf("size %d unmarshal failed: %s", size, err)
+		}
+		truncated := raw.Aps.Alert.Body
+		if !strings.HasSuffix(truncated, "...") || !strings.HasPrefix(body, strings.TrimSuffix(truncated, "...")) {
+			t.Errorf("size %d invalid truncated body: %s", size, truncated)
+		}
+		if raw.Aps.ThreadId != "123" {
+			t.Errorf("size %d lost thread-id: %+v", size, raw.Aps)
+		}
+	}
+
+	payload := Payload{}
+	payload.Aps.Alert.Body = "body"
+	payload.SetCustom("data", strings.Repeat("x", PayloadSizeLegacy))
+	if _, err := payload.MarshalSize(PayloadSizeLegacy); err != ErrPayloadTooLarge {
+		t.Errorf("expect too large, got: %v", err)
+	}
+}
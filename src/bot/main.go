@@ -15,7 +15,7 @@ import (
 
 func main() {
 	var config model.Config
-	quit := daemon.Init("exfe.json", &config)
+	shutdown := daemon.Init("exfe.json", &config)
 	logger.SetDebug(config.Debug)
 
 	logger.NOTICE("bot start")
@@ -47,7 +47,7 @@ func main() {
 	tombs = append(tombs, &mail.Tomb)
 	go mail.Daemon()
 
-	<-quit
+	<-shutdown.Done()
 	logger.NOTICE("bot quiting...")
 
 	for _, tomb := range tombs {
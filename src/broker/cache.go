@@ -0,0 +1,145 @@
+package broker
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"sync"
+	"time"
+)
+
+// Cache saves values with ttl. Values are in groups, like all days of a
+// place.
+type Cache interface {
+	Get(group, key string) ([]byte, bool, error)
+	Set(group, key string, value []byte, ttl time.Duration) error
+}
+
+type memoryCacheItem struct {
+	value  []byte
+	expire time.Time
+}
+
+// MemoryCache is a Cache in process.
+type MemoryCache struct {
+	groups map[string]map[string]memoryCacheItem
+	locker sync.Mutex
+}
+
+func NewMemoryCache() *MemoryCache {
+	return &MemoryCache{
+		groups: make(map[string]map[string]memoryCacheItem),
+	}
+}
+
+func (c *MemoryCache) Get(group, key string) ([]byte, bool, error) {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	item, ok := c.groups[group][key]
+	if !ok {
+		return nil, false, nil
+	}
+	if time.Now().After(item.expire) {
+		c.remove(group, key)
+		return nil, false, nil
+	}
+	return item.value, true, nil
+}
+
+func (c *MemoryCache) Set(group, key string, value []byte, ttl time.Duration) error {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	c.sweep()
+	g, ok := c.groups[group]
+	if !ok {
+		g = make(map[string]memoryCacheItem)
+		c.groups[group] = g
+	}
+	g[key] = memoryCacheItem{
+		value:  value,
+		expire: time.Now().Add(ttl),
+	}
+	return nil
+}
+
+func (c *MemoryCache) remove(group, key string) {
+	delete(c.groups[group], key)
+	if len(c.groups[group]) == 0 {
+		delete(c.groups, group)
+	}
+}
+
+func (c *MemoryCache) sweep() {
+	now := time.Now()
+	for group, items := range c.groups {
+		for key, item := range items {
+			if now.After(item.expire) {
+				c.remove(group, key)
+			}
+		}
+	}
+}
+
+// RedisCache is a Cache in redis, each group is a hash. Ttl of each value is
+// saved with it, and the hash expires with the latest value.
+type RedisCache struct {
+	redis  *redis.Pool
+	prefix string
+}
+
+func NewRedisCache(prefix string, redis *redis.Pool) *RedisCache {
+	return &RedisCache{
+		redis:  redis,
+		prefix: prefix,
+	}
+}
+
+func (c *RedisCache) Get(group, key string) ([]byte, bool, error) {
+	conn := c.redis.Get()
+	defer conn.Close()
+
+	reply, err := redis.Values(conn.Do("HMGET", c.key(group), key, c.expireField(key)))
+	if err != nil {
+		return nil, false, err
+	}
+	value, err := redis.Bytes(reply[0], nil)
+	if err == redis.ErrNil {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	expire, err := redis.Int64(reply[1], nil)
+	if err != nil || time.Now().Unix() >= expire {
+		conn.Do("HDEL", c.key(group), key, c.expireField(key))
+		return nil, false, nil
+	}
+	return value, true, nil
+}
+
+func (c *RedisCache) Set(group, key string, value []byte, ttl time.Duration) error {
+	conn := c.redis.Get()
+	defer conn.Close()
+
+	expire := time.Now().Add(ttl).Unix()
+	if err := conn.Send("MULTI"); err != nil {
+		return err
+	}
+	if err := conn.Send("HMSET", c.key(group), key, value, c.expireField(key), expire); err != nil {
+		return err
+	}
+	if err := conn.Send("EXPIRE", c.key(group), int(ttl/time.Second)+1); err != nil {
+		return err
+	}
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+func (c *RedisCache) key(group string) string {
+	return fmt.Sprintf("%s:%s", c.prefix, group)
+}
+
+func (c *RedisCache) expireField(key string) string {
+	return fmt.Sprintf("%s:expire", key)
+}
@@ -0,0 +1,46 @@
+package broker
+
+import (
+	"github.com/stretchrcom/testify/assert"
+	"testing"
+	"time"
+)
+
+func testCache(t *testing.T, c Cache) {
+	_, ok, err := c.Get("weather:1", "a")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ok, false)
+
+	assert.Equal(t, c.Set("weather:1", "a", []byte("1a"), time.Minute), nil)
+	assert.Equal(t, c.Set("weather:1", "b", []byte("1b"), time.Minute), nil)
+	assert.Equal(t, c.Set("weather:2", "a", []byte("2a"), time.Minute), nil)
+	assert.Equal(t, c.Set("weather:2", "short", []byte("2s"), time.Second), nil)
+
+	v, ok, err := c.Get("weather:1", "b")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, string(v), "1b")
+
+	v, ok, err = c.Get("weather:2", "a")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, string(v), "2a")
+
+	time.Sleep(time.Second + time.Second/10)
+	_, ok, err = c.Get("weather:2", "short")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ok, false)
+	_, ok, err = c.Get("weather:2", "a")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ok, true)
+}
+
+func TestMemoryCache(t *testing.T) {
+	testCache(t, NewMemoryCache())
+}
+
+func TestRedisCache(t *testing.T) {
+	prefix := testPrefix()
+	defer clearPrefix(prefix)
+	testCache(t, NewRedisCache(prefix, redisPool))
+}
@@ -0,0 +1,226 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"time"
+)
+
+type DeliveryStatus string
+
+const (
+	// DeliveryFailed means it failed before posting, like template error or
+	// poster rejected.
+	DeliveryFailed DeliveryStatus = "failed"
+	// DeliverySent means posted and waiting the response of poster.
+	DeliverySent DeliveryStatus = "sent"
+	DeliveryOk   DeliveryStatus = "ok"
+	DeliveryFail DeliveryStatus = "fail"
+)
+
+// Delivery is one attempt of sending a notification. Step is the index of
+// fallbacks, 0 is the first recipient. Variant is the variant of template in
+// experiment, to attribute responses to it.
+type Delivery struct {
+	Id               int64          `json:"id"`
+	IdentityId       int64          `json:"identity_id"`
+	UserId           int64          `json:"user_id"`
+	CrossId          uint64         `json:"cross_id,omitempty"`
+	Provider         string         `json:"provider"`
+	ExternalUsername string         `json:"external_username"`
+	Template         string         `json:"template"`
+	Variant          string         `json:"variant,omitempty"`
+	MessageId        string         `json:"message_id,omitempty"`
+	Step             int            `json:"step"`
+	Status           DeliveryStatus `json:"status"`
+	Error            string         `json:"error,omitempty"`
+	CreatedAt        int64          `json:"created_at"`
+	UpdatedAt        int64          `json:"updated_at"`
+}
+
+const (
+	deliveryExpire   = 30 * 24 * 60 * 60
+	deliveryIndexMax = 1000
+)
+
+// DeliveryLog saves deliveries in redis for 30 days, indexed by identity,
+// cross and poster message id. Each index keeps the latest 1000 deliveries.
+type DeliveryLog struct {
+	redis  *redis.Pool
+	prefix string
+}
+
+func NewDeliveryLog(prefix string, redis *redis.Pool) *DeliveryLog {
+	return &DeliveryLog{
+		redis:  redis,
+		prefix: prefix,
+	}
+}
+
+// Add saves d with a new id, and returns the saved one.
+func (l *DeliveryLog) Add(d Delivery) (Delivery, error) {
+	conn := l.redis.Get()
+	defer conn.Close()
+
+	id, err := redis.Int64(conn.Do("INCR", l.key("id")))
+	if err != nil {
+		return d, err
+	}
+	d.Id = id
+	d.CreatedAt = time.Now().Unix()
+	d.UpdatedAt = d.CreatedAt
+	b, err := json.Marshal(d)
+	if err != nil {
+		return d, err
+	}
+
+	if err := conn.Send("MULTI"); err != nil {
+		return d, err
+	}
+	if err := conn.Send("SETEX", l.entryKey(id), deliveryExpire, b); err != nil {
+		return d, err
+	}
+	indexes := []string{l.identityKey(d.IdentityId)}
+	if d.CrossId != 0 {
+		indexes = append(indexes, l.crossKey(d.CrossId))
+	}
+	for _, index := range indexes {
+		if err := conn.Send("ZADD", index, id, id); err != nil {
+			return d, err
+		}
+		if err := conn.Send("ZREMRANGEBYRANK", index, 0, -deliveryIndexMax-1); err != nil {
+			return d, err
+		}
+		if err := conn.Send("EXPIRE", index, deliveryExpire); err != nil {
+			return d, err
+		}
+	}
+	if d.MessageId != "" {
+		if err := conn.Send("SETEX", l.messageKey(d.MessageId), deliveryExpire, id); err != nil {
+			return d, err
+		}
+	}
+	if _, err := conn.Do("EXEC"); err != nil {
+		return d, err
+	}
+	return d, nil
+}
+
+// Result sets the final status of the delivery with poster message id. It
+// returns false if no delivery has the message id.
+func (l *DeliveryLog) Result(messageId string, ok bool, reason string) (bool, error) {
+	conn := l.redis.Get()
+	defer conn.Close()
+
+	id, err := redis.Int64(conn.Do("GET", l.messageKey(messageId)))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	b, err := redis.Bytes(conn.Do("GET", l.entryKey(id)))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	var d Delivery
+	if err := json.Unmarshal(b, &d); err != nil {
+		return false, err
+	}
+	d.Status, d.Error = DeliveryOk, ""
+	if !ok {
+		d.Status, d.Error = DeliveryFail, reason
+	}
+	d.UpdatedAt = time.Now().Unix()
+	if b, err = json.Marshal(d); err != nil {
+		return false, err
+	}
+	ttl, err := redis.Int(conn.Do("TTL", l.entryKey(id)))
+	if err != nil {
+		return false, err
+	}
+	if ttl <= 0 {
+		ttl = deliveryExpire
+	}
+	if _, err := conn.Do("SETEX", l.entryKey(id), ttl, b); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Find returns at most count deliveries from newest to oldest, to the
+// identity and of the cross. Zero means any, but at least one of them should
+// be set.
+func (l *DeliveryLog) Find(identityId int64, crossId uint64, count int) ([]Delivery, error) {
+	if identityId == 0 && crossId == 0 {
+		return nil, fmt.Errorf("need identity id or cross id")
+	}
+	conn := l.redis.Get()
+	defer conn.Close()
+
+	index := l.crossKey(crossId)
+	if identityId != 0 {
+		index = l.identityKey(identityId)
+	}
+	ids, err := redis.Values(conn.Do("ZREVRANGE", index, 0, -1))
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	keys := make([]interface{}, len(ids))
+	for i, id := range ids {
+		keys[i] = fmt.Sprintf("%s:entry:%s", l.prefix, id)
+	}
+	reply, err := redis.Values(conn.Do("MGET", keys...))
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]Delivery, 0)
+	for _, r := range reply {
+		if len(ret) >= count {
+			break
+		}
+		b, err := redis.Bytes(r, nil)
+		if err == redis.ErrNil {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var d Delivery
+		if err := json.Unmarshal(b, &d); err != nil {
+			return nil, err
+		}
+		if crossId != 0 && d.CrossId != crossId {
+			continue
+		}
+		ret = append(ret, d)
+	}
+	return ret, nil
+}
+
+func (l *DeliveryLog) key(name string) string {
+	return fmt.Sprintf("%s:%s", l.prefix, name)
+}
+
+func (l *DeliveryLog) entryKey(id int64) string {
+	return fmt.Sprintf("%s:entry:%d", l.prefix, id)
+}
+
+func (l *DeliveryLog) identityKey(id int64) string {
+	return fmt.Sprintf("%s:identity:%d", l.prefix, id)
+}
+
+func (l *DeliveryLog) crossKey(id uint64) string {
+	return fmt.Sprintf("%s:cross:%d", l.prefix, id)
+}
+
+func (l *DeliveryLog) messageKey(id string) string {
+	return fmt.Sprintf("%s:message:%s", l.prefix, id)
+}
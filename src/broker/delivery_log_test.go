@@ -0,0 +1,88 @@
+package broker
+
+import (
+	"github.com/stretchrcom/testify/assert"
+	"testing"
+)
+
+func TestDeliveryLog(t *testing.T) {
+	prefix := testPrefix()
+	defer clearPrefix(prefix)
+	l := NewDeliveryLog(prefix, redisPool)
+
+	first, err := l.Add(Delivery{
+		IdentityId: 1,
+		CrossId:    100,
+		Provider:   "iOS",
+		Template:   "cross_invitation",
+		MessageId:  "m1",
+		Status:     DeliverySent,
+	})
+	assert.Equal(t, err, nil)
+	_, err = l.Add(Delivery{
+		IdentityId: 1,
+		CrossId:    100,
+		Provider:   "email",
+		Template:   "cross_invitation",
+		Step:       1,
+		Status:     DeliveryFailed,
+		Error:      "template error",
+	})
+	assert.Equal(t, err, nil)
+	_, err = l.Add(Delivery{
+		IdentityId: 1,
+		CrossId:    200,
+		Provider:   "email",
+		Template:   "cross_update",
+		MessageId:  "m3",
+		Status:     DeliverySent,
+	})
+	assert.Equal(t, err, nil)
+	_, err = l.Add(Delivery{
+		IdentityId: 2,
+		CrossId:    100,
+		Provider:   "twitter",
+		Template:   "cross_invitation",
+		MessageId:  "m4",
+		Status:     DeliverySent,
+	})
+	assert.Equal(t, err, nil)
+
+	ok, err := l.Result("m1", false, "device token invalid")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ok, true)
+	ok, err = l.Result("m3", true, "")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ok, true)
+	ok, err = l.Result("nonexist", true, "")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ok, false)
+
+	ds, err := l.Find(1, 0, 10)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(ds), 3)
+	assert.Equal(t, ds[0].Status, DeliveryOk)
+	assert.Equal(t, ds[1].Status, DeliveryFailed)
+	assert.Equal(t, ds[1].Step, 1)
+	assert.Equal(t, ds[2].Id, first.Id)
+	assert.Equal(t, ds[2].Status, DeliveryFail)
+	assert.Equal(t, ds[2].Error, "device token invalid")
+
+	ds, err = l.Find(1, 100, 10)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(ds), 2)
+	assert.Equal(t, ds[0].Provider, "email")
+	assert.Equal(t, ds[1].Provider, "iOS")
+
+	ds, err = l.Find(0, 100, 2)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(ds), 2)
+	assert.Equal(t, ds[0].Provider, "twitter")
+
+	ds, err = l.Find(3, 0, 10)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(ds), 0)
+
+	_, err = l.Find(0, 0, 10)
+	assert.NotEqual(t, err, nil)
+}
@@ -0,0 +1,57 @@
+package broker
+
+import (
+	"fmt"
+	"github.com/stretchrcom/testify/assert"
+	"model"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func healthPlatform(t *testing.T, handler http.HandlerFunc) (*Platform, *httptest.Server) {
+	server := httptest.NewServer(handler)
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostport := strings.Split(u.Host, ":")
+	port, _ := strconv.Atoi(hostport[1])
+
+	var config model.Config
+	config.ExfeService.Addr = hostport[0]
+	config.ExfeService.Port = uint(port)
+	p, err := NewPlatform(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, server
+}
+
+func TestPlatformTripped(t *testing.T) {
+	p, server := healthPlatform(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"provider":"apn","state":"open"},{"provider":"gcm","state":"closed"}]`)
+	})
+	defer server.Close()
+
+	assert.Equal(t, p.IsTripped("apn"), true)
+	assert.Equal(t, p.IsTripped("gcm"), false)
+	assert.Equal(t, p.IsTripped("email"), false)
+}
+
+func TestPlatformTrippedTimeout(t *testing.T) {
+	quit := make(chan int)
+	p, server := healthPlatform(t, func(w http.ResponseWriter, r *http.Request) {
+		<-quit
+	})
+	defer server.Close()
+	defer close(quit)
+
+	start := time.Now()
+	assert.Equal(t, p.IsTripped("apn"), false)
+	assert.Equal(t, time.Since(start) < healthTimeout+time.Second, true)
+}
@@ -13,6 +13,7 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -81,6 +82,13 @@ func dial(net_, addr string) (net.Conn, error) {
 type Platform struct {
 	config   *model.Config
 	replacer *strings.Replacer
+
+	tripped       map[string]bool
+	trippedAt     time.Time
+	trippedLocker sync.Mutex
+
+	cache      Cache
+	weatherTTL time.Duration
 }
 
 func NewPlatform(config *model.Config) (*Platform, error) {
@@ -120,6 +128,85 @@ func (p *Platform) Send(to model.Recipient, text string) (string, int64, bool, e
 	return "", 0, false, fmt.Errorf("(%s)%s", resp.Status, string(body))
 }
 
+// SetCache makes GetWeatherIcon cache forecasts in cache, with ttl in
+// config.PlatformCache.
+func (p *Platform) SetCache(cache Cache) {
+	p.cache = cache
+	p.weatherTTL = time.Duration(p.config.PlatformCache.WeatherTTLInSecond) * time.Second
+	if p.weatherTTL <= 0 {
+		p.weatherTTL = time.Hour
+	}
+}
+
+const (
+	trippedCacheTime = 5 * time.Second
+	healthTimeout    = 2 * time.Second
+)
+
+// healthClient gives up quickly, poster health is checked before each push.
+var healthClient = &http.Client{
+	Transport: &http.Transport{
+		Dial: func(net_, addr string) (net.Conn, error) {
+			conn, err := net.DialTimeout(net_, addr, healthTimeout)
+			if err != nil {
+				return nil, err
+			}
+			conn.SetDeadline(time.Now().Add(healthTimeout))
+			return conn, nil
+		},
+		DisableKeepAlives: true,
+	},
+}
+
+// IsTripped returns true if the circuit of provider is open in poster, which
+// means it has been failing recently. The states are cached for 5 seconds,
+// and are treated as closed if poster can't tell.
+func (p *Platform) IsTripped(provider string) bool {
+	p.trippedLocker.Lock()
+	if time.Since(p.trippedAt) <= trippedCacheTime {
+		defer p.trippedLocker.Unlock()
+		return p.tripped[provider]
+	}
+	// others use the old states while loading.
+	p.trippedAt = time.Now()
+	p.trippedLocker.Unlock()
+
+	tripped, err := p.loadTripped()
+	if err != nil {
+		logger.ERROR("load poster health failed: %s", err)
+		tripped = nil
+	}
+
+	p.trippedLocker.Lock()
+	defer p.trippedLocker.Unlock()
+	p.tripped = tripped
+	return p.tripped[provider]
+}
+
+func (p *Platform) loadTripped() (map[string]bool, error) {
+	url := fmt.Sprintf("http://%s:%d/v3/poster/_health", p.config.ExfeService.Addr, p.config.ExfeService.Port)
+	reader, err := HttpResponse(healthClient.Get(url))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	var health []struct {
+		Provider string `json:"provider"`
+		State    string `json:"state"`
+	}
+	if err := json.NewDecoder(reader).Decode(&health); err != nil {
+		return nil, err
+	}
+	ret := make(map[string]bool)
+	for _, h := range health {
+		if h.State == "open" {
+			ret[h.Provider] = true
+		}
+	}
+	return ret, nil
+}
+
 func (p *Platform) FindIdentity(identity model.Identity) (model.Identity, error) {
 	b, err := json.Marshal(identity)
 	if err != nil {
@@ -230,6 +317,35 @@ func (p *Platform) UploadPhoto(photoxID string, photos []model.Photo) error {
 	return nil
 }
 
+// UpdateDeviceToken revokes the identity of device token of provider(iOS or
+// Android), or rewrites it to newToken if it's not "".
+func (p *Platform) UpdateDeviceToken(provider, token, newToken string) error {
+	arg := map[string]string{
+		"provider":          provider,
+		"external_username": token,
+	}
+	if newToken != "" {
+		arg["new_external_username"] = newToken
+	}
+	b, err := json.Marshal(arg)
+	if err != nil {
+		logger.ERROR("encoding error: %s with %+v", err, arg)
+		return internalError
+	}
+	u := fmt.Sprintf("%s/v3/bus/devicetoken", p.config.SiteApi)
+	resp, err := Http("POST", u, "application/json", b)
+	reader, err := HttpResponse(resp, err)
+	if err != nil {
+		if resp != nil && resp.StatusCode == 404 {
+			return Error{IDENTITY_NOT_FOUND, err.Error()}
+		}
+		logger.ERROR("post %s error: %s with %s", u, err, string(b))
+		return internalError
+	}
+	reader.Close()
+	return nil
+}
+
 func (p *Platform) BotCrossGather(cross model.Cross) (model.Cross, error) {
 	b, err := json.Marshal(cross)
 	if err != nil {
@@ -574,19 +690,8 @@ func (p *Platform) GetWeatherIcon(lat, lng float64, date string) string {
 		"13n": "snow_moon@2x.png",
 		"50n": "haze_moon@2x.png",
 	}
-	type Resp struct {
-		List []struct {
-			DtTxt   string `json:"dt_txt"`
-			Weather []struct {
-				Icon string `json:"icon"`
-			} `json:"weather"`
-		} `json:"list"`
-	}
-	u := fmt.Sprintf("http://api.openweathermap.org/data/2.5/forecast?lat=%.7f&lon=%.7f", lat, lng)
-	var resp Resp
-	_, err := RestHttp("GET", u, "application/json", nil, &resp)
+	resp, err := p.getForecast(lat, lng, date)
 	if err != nil {
-		logger.ERROR("get weather %s failed: %s", u, err)
 		return ""
 	}
 	icon := ""
@@ -605,6 +710,54 @@ func (p *Platform) GetWeatherIcon(lat, lng float64, date string) string {
 	return fmt.Sprintf("%s/static/img/climacons/%s", p.config.SiteUrl, ret)
 }
 
+type forecast struct {
+	List []struct {
+		DtTxt   string `json:"dt_txt"`
+		Weather []struct {
+			Icon string `json:"icon"`
+		} `json:"weather"`
+	} `json:"list"`
+}
+
+// getForecast returns the forecast around lat and lng. If cache is set, it's
+// cached by lat and lng rounded to 0.01 degree(about 1km), and the day of date.
+func (p *Platform) getForecast(lat, lng float64, date string) (forecast, error) {
+	var ret forecast
+	if p.cache == nil {
+		return ret, p.loadForecast(lat, lng, &ret)
+	}
+	group := fmt.Sprintf("weather:%.2f,%.2f", lat, lng)
+	key := date
+	if len(key) > 10 {
+		key = key[:10]
+	}
+	if b, ok, err := p.cache.Get(group, key); err != nil {
+		logger.ERROR("get cache of %s failed: %s", group, err)
+	} else if ok && json.Unmarshal(b, &ret) == nil {
+		return ret, nil
+	}
+	lat, _ = strconv.ParseFloat(fmt.Sprintf("%.2f", lat), 64)
+	lng, _ = strconv.ParseFloat(fmt.Sprintf("%.2f", lng), 64)
+	if err := p.loadForecast(lat, lng, &ret); err != nil {
+		return ret, err
+	}
+	if b, err := json.Marshal(ret); err == nil {
+		if err := p.cache.Set(group, key, b, p.weatherTTL); err != nil {
+			logger.ERROR("set cache of %s failed: %s", group, err)
+		}
+	}
+	return ret, nil
+}
+
+func (p *Platform) loadForecast(lat, lng float64, ret *forecast) error {
+	u := fmt.Sprintf("http://api.openweathermap.org/data/2.5/forecast?lat=%.7f&lon=%.7f", lat, lng)
+	_, err := RestHttp("GET", u, "application/json", nil, ret)
+	if err != nil {
+		logger.ERROR("get weather %s failed: %s", u, err)
+	}
+	return err
+}
+
 func (p *Platform) GetPlace(lat, lng float64, language string, radius int, query url.Values) ([]model.Place, error) {
 	if query == nil {
 		query = make(url.Values)
@@ -0,0 +1,122 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"model"
+)
+
+// PreferenceSaver saves preferences of users and identities in a redis hash.
+// Unsubscribed categories are flags of identities in their own sets, so
+// opting out doesn't touch the preference.
+type PreferenceSaver struct {
+	redis  *redis.Pool
+	key    string
+	prefix string
+}
+
+func NewPreferenceSaver(prefix string, redis *redis.Pool) *PreferenceSaver {
+	return &PreferenceSaver{
+		redis:  redis,
+		key:    fmt.Sprintf("%s:preference", prefix),
+		prefix: prefix,
+	}
+}
+
+func UserPreference(userId int64) string {
+	return fmt.Sprintf("user:%d", userId)
+}
+
+func IdentityPreference(identityId int64) string {
+	return fmt.Sprintf("identity:%d", identityId)
+}
+
+// Save saves p to field. Unsubscribed of p isn't saved, use Unsubscribe.
+func (s *PreferenceSaver) Save(field string, p model.Preference) error {
+	conn := s.redis.Get()
+	defer conn.Close()
+
+	p.Unsubscribed = nil
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Do("HSET", s.key, field, b)
+	return err
+}
+
+func (s *PreferenceSaver) Load(field string) (model.Preference, bool, error) {
+	conn := s.redis.Get()
+	defer conn.Close()
+
+	var ret model.Preference
+	b, err := redis.Bytes(conn.Do("HGET", s.key, field))
+	if err == redis.ErrNil {
+		return ret, false, nil
+	}
+	if err != nil {
+		return ret, false, err
+	}
+	if err := json.Unmarshal(b, &ret); err != nil {
+		return ret, false, err
+	}
+	return ret, true, nil
+}
+
+func (s *PreferenceSaver) Remove(field string) (bool, error) {
+	conn := s.redis.Get()
+	defer conn.Close()
+
+	n, err := redis.Int(conn.Do("HDEL", s.key, field))
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// Unsubscribe opts out category of the identity.
+func (s *PreferenceSaver) Unsubscribe(identityId int64, category string) error {
+	conn := s.redis.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("SADD", s.unsubscribedKey(identityId), category)
+	return err
+}
+
+// Unsubscribed returns categories opted out by the identity.
+func (s *PreferenceSaver) Unsubscribed(identityId int64) ([]string, error) {
+	conn := s.redis.Get()
+	defer conn.Close()
+
+	return redis.Strings(conn.Do("SMEMBERS", s.unsubscribedKey(identityId)))
+}
+
+// Find returns the preference of the identity, or the user's if the identity
+// has none, with categories unsubscribed by the identity.
+func (s *PreferenceSaver) Find(userId, identityId int64) (model.Preference, bool, error) {
+	var ret model.Preference
+	found := false
+	for _, field := range []string{IdentityPreference(identityId), UserPreference(userId)} {
+		p, ok, err := s.Load(field)
+		if err != nil {
+			return p, false, err
+		}
+		if ok {
+			ret, found = p, true
+			break
+		}
+	}
+	unsubscribed, err := s.Unsubscribed(identityId)
+	if err != nil {
+		return ret, found, err
+	}
+	for _, category := range unsubscribed {
+		ret.Unsubscribe(category)
+	}
+	return ret, found || len(unsubscribed) > 0, nil
+}
+
+func (s *PreferenceSaver) unsubscribedKey(identityId int64) string {
+	return fmt.Sprintf("%s:unsubscribed:%d", s.prefix, identityId)
+}
@@ -0,0 +1,84 @@
+package broker
+
+import (
+	"github.com/stretchrcom/testify/assert"
+	"model"
+	"testing"
+)
+
+func TestPreferenceSaver(t *testing.T) {
+	prefix := testPrefix()
+	defer clearPrefix(prefix)
+	s := NewPreferenceSaver(prefix, redisPool)
+
+	_, ok, err := s.Find(1, 11)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ok, false)
+
+	user := model.Preference{
+		Muted: map[string][]string{"iOS": []string{"cross_conversation"}},
+	}
+	identity := model.Preference{
+		QuietHours: &model.QuietHours{Start: "22:00", End: "08:00"},
+	}
+	assert.Equal(t, s.Save(UserPreference(1), user), nil)
+
+	p, ok, err := s.Find(1, 11)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, p.IsMuted("iOS", "cross_conversation"), true)
+
+	assert.Equal(t, s.Save(IdentityPreference(11), identity), nil)
+	p, ok, err = s.Find(1, 11)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, p.IsMuted("iOS", "cross_conversation"), false)
+	assert.Equal(t, *p.QuietHours, *identity.QuietHours)
+
+	removed, err := s.Remove(IdentityPreference(11))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, removed, true)
+	removed, err = s.Remove(IdentityPreference(11))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, removed, false)
+	p, ok, err = s.Find(1, 11)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, p.QuietHours == nil, true)
+}
+
+func TestPreferenceSaverUnsubscribe(t *testing.T) {
+	prefix := testPrefix()
+	defer clearPrefix(prefix)
+	s := NewPreferenceSaver(prefix, redisPool)
+
+	user := model.Preference{
+		Muted:        map[string][]string{"iOS": []string{"cross_conversation"}},
+		Unsubscribed: []string{"invitation"},
+	}
+	assert.Equal(t, s.Save(UserPreference(1), user), nil)
+
+	assert.Equal(t, s.Unsubscribe(11, "conversation"), nil)
+	assert.Equal(t, s.Unsubscribe(11, "conversation"), nil)
+
+	p, ok, err := s.Find(1, 11)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, p.IsMuted("iOS", "cross_conversation"), true)
+	assert.Equal(t, p.Unsubscribed, []string{"conversation"})
+
+	p, ok, err = s.Find(1, 12)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, p.IsUnsubscribed("conversation"), false)
+
+	p, ok, err = s.Find(2, 11)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, p.Muted == nil, true)
+	assert.Equal(t, p.Unsubscribed, []string{"conversation"})
+
+	_, ok, err = s.Load(IdentityPreference(11))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ok, false)
+}
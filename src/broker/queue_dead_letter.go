@@ -0,0 +1,196 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"time"
+)
+
+type DeadLetter struct {
+	Id       string   `json:"id"`
+	Key      string   `json:"key"`
+	Priority string   `json:"priority,omitempty"`
+	Data     []string `json:"data"`
+	Attempts int      `json:"attempts"`
+	Reason   string   `json:"reason"`
+	FailedAt int64    `json:"failed_at"`
+}
+
+type QueueDeadLetter struct {
+	redis      *redis.Pool
+	idKey      string
+	listKey    string
+	entryKey   string
+	attemptKey string
+}
+
+func NewQueueDeadLetter(prefix string, redis *redis.Pool) *QueueDeadLetter {
+	return &QueueDeadLetter{
+		redis:      redis,
+		idKey:      fmt.Sprintf("%s:dead:id", prefix),
+		listKey:    fmt.Sprintf("%s:dead", prefix),
+		entryKey:   fmt.Sprintf("%s:dead:entry", prefix),
+		attemptKey: fmt.Sprintf("%s:attempts", prefix),
+	}
+}
+
+// Attempt counts one more failed delivery of key and returns the total.
+func (s *QueueDeadLetter) Attempt(key string) (int, error) {
+	conn := s.redis.Get()
+	defer conn.Close()
+
+	return redis.Int(conn.Do("HINCRBY", s.attemptKey, key, 1))
+}
+
+// Reset forgets failed deliveries of key, called after a successful delivery.
+func (s *QueueDeadLetter) Reset(key string) error {
+	conn := s.redis.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("HDEL", s.attemptKey, key)
+	return err
+}
+
+func (s *QueueDeadLetter) Save(key, priority string, datas [][]byte, attempts int, reason string) (DeadLetter, error) {
+	conn := s.redis.Get()
+	defer conn.Close()
+
+	id, err := redis.Int64(conn.Do("INCR", s.idKey))
+	if err != nil {
+		return DeadLetter{}, err
+	}
+	ret := DeadLetter{
+		Id:       fmt.Sprintf("%d", id),
+		Key:      key,
+		Priority: priority,
+		Data:     make([]string, len(datas)),
+		Attempts: attempts,
+		Reason:   reason,
+		FailedAt: time.Now().Unix(),
+	}
+	for i, data := range datas {
+		ret.Data[i] = string(data)
+	}
+	b, err := json.Marshal(ret)
+	if err != nil {
+		return ret, err
+	}
+
+	if err := conn.Send("MULTI"); err != nil {
+		return ret, err
+	}
+	if err := conn.Send("HSET", s.entryKey, ret.Id, b); err != nil {
+		return ret, err
+	}
+	if err := conn.Send("LPUSH", s.listKey, ret.Id); err != nil {
+		return ret, err
+	}
+	if err := conn.Send("HDEL", s.attemptKey, key); err != nil {
+		return ret, err
+	}
+	if _, err := conn.Do("EXEC"); err != nil {
+		return ret, err
+	}
+	return ret, nil
+}
+
+// List returns dead letters from newest to oldest.
+func (s *QueueDeadLetter) List(offset, count int) ([]DeadLetter, error) {
+	conn := s.redis.Get()
+	defer conn.Close()
+
+	if count <= 0 {
+		return nil, nil
+	}
+	ids, err := redis.Values(conn.Do("LRANGE", s.listKey, offset, offset+count-1))
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	reply, err := redis.Values(conn.Do("HMGET", redis.Args{}.Add(s.entryKey).Add(ids...)...))
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]DeadLetter, 0, len(reply))
+	for _, r := range reply {
+		b, err := redis.Bytes(r, nil)
+		if err == redis.ErrNil {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var letter DeadLetter
+		if err := json.Unmarshal(b, &letter); err != nil {
+			return nil, err
+		}
+		ret = append(ret, letter)
+	}
+	return ret, nil
+}
+
+func (s *QueueDeadLetter) Load(id string) (DeadLetter, bool, error) {
+	conn := s.redis.Get()
+	defer conn.Close()
+
+	var ret DeadLetter
+	b, err := redis.Bytes(conn.Do("HGET", s.entryKey, id))
+	if err == redis.ErrNil {
+		return ret, false, nil
+	}
+	if err != nil {
+		return ret, false, err
+	}
+	if err := json.Unmarshal(b, &ret); err != nil {
+		return ret, false, err
+	}
+	return ret, true, nil
+}
+
+func (s *QueueDeadLetter) Remove(id string) (bool, error) {
+	conn := s.redis.Get()
+	defer conn.Close()
+
+	if err := conn.Send("MULTI"); err != nil {
+		return false, err
+	}
+	if err := conn.Send("HDEL", s.entryKey, id); err != nil {
+		return false, err
+	}
+	if err := conn.Send("LREM", s.listKey, 0, id); err != nil {
+		return false, err
+	}
+	reply, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return false, err
+	}
+	n, err := redis.Int(reply[0], nil)
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// Purge removes all dead letters and returns how many were removed.
+func (s *QueueDeadLetter) Purge() (int, error) {
+	conn := s.redis.Get()
+	defer conn.Close()
+
+	if err := conn.Send("MULTI"); err != nil {
+		return 0, err
+	}
+	if err := conn.Send("HLEN", s.entryKey); err != nil {
+		return 0, err
+	}
+	if err := conn.Send("DEL", s.entryKey, s.listKey); err != nil {
+		return 0, err
+	}
+	reply, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return 0, err
+	}
+	return redis.Int(reply[0], nil)
+}
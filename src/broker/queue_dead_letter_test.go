@@ -0,0 +1,114 @@
+package broker
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/stretchrcom/testify/assert"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+var redisPool = &redis.Pool{
+	MaxIdle:     3,
+	IdleTimeout: 30 * time.Minute,
+	Dial: func() (redis.Conn, error) {
+		c, err := redis.Dial("tcp", "127.0.0.1:6379")
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	},
+	TestOnBorrow: func(c redis.Conn, t time.Time) error {
+		_, err := c.Do("PING")
+		return err
+	},
+}
+
+func testPrefix() string {
+	return fmt.Sprintf("queue:test:%d.%d", time.Now().Unix(), rand.Intn(10000))
+}
+
+func clearPrefix(prefix string) {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	keys, err := redis.Strings(conn.Do("KEYS", prefix+"*"))
+	if err != nil {
+		return
+	}
+	for _, key := range keys {
+		conn.Do("DEL", key)
+	}
+}
+
+func TestDeadLetterAttempt(t *testing.T) {
+	prefix := testPrefix()
+	defer clearPrefix(prefix)
+	s := NewQueueDeadLetter(prefix, redisPool)
+
+	for i := 1; i <= 3; i++ {
+		n, err := s.Attempt("POST,http://a/b,123")
+		assert.Equal(t, err, nil)
+		assert.Equal(t, n, i)
+	}
+	err := s.Reset("POST,http://a/b,123")
+	assert.Equal(t, err, nil)
+	n, err := s.Attempt("POST,http://a/b,123")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, n, 1)
+}
+
+func TestDeadLetter(t *testing.T) {
+	prefix := testPrefix()
+	defer clearPrefix(prefix)
+	s := NewQueueDeadLetter(prefix, redisPool)
+
+	_, err := s.Attempt("key1")
+	assert.Equal(t, err, nil)
+	first, err := s.Save("key1", "normal", [][]byte{[]byte("a"), []byte("b")}, 5, "(500)error")
+	assert.Equal(t, err, nil)
+	second, err := s.Save("key2", "instant", [][]byte{[]byte("c")}, 5, "(404)not found")
+	assert.Equal(t, err, nil)
+
+	n, err := s.Attempt("key1")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, n, 1)
+
+	letters, err := s.List(0, 10)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(letters), 2)
+	assert.Equal(t, letters[0].Id, second.Id)
+	assert.Equal(t, letters[1].Id, first.Id)
+	assert.Equal(t, letters[1].Data, []string{"a", "b"})
+	assert.Equal(t, letters[1].Reason, "(500)error")
+
+	letters, err = s.List(1, 10)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(letters), 1)
+	assert.Equal(t, letters[0].Key, "key1")
+
+	letter, ok, err := s.Load(second.Id)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, letter.Key, "key2")
+	assert.Equal(t, letter.Data, []string{"c"})
+	assert.Equal(t, letter.Priority, "instant")
+
+	ok, err = s.Remove(second.Id)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ok, true)
+	ok, err = s.Remove(second.Id)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ok, false)
+	_, ok, err = s.Load(second.Id)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ok, false)
+
+	count, err := s.Purge()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, count, 1)
+	letters, err = s.List(0, 10)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(letters), 0)
+}
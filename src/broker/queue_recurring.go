@@ -0,0 +1,106 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"sort"
+)
+
+// RecurringJob is a queue key which is pushed again with Data after each
+// dispatch, by Cron or Every seconds.
+type RecurringJob struct {
+	Key       string `json:"key"`
+	Priority  string `json:"priority,omitempty"`
+	Cron      string `json:"cron,omitempty"`
+	Every     int64  `json:"every,omitempty"`
+	Data      string `json:"data"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+type QueueRecurring struct {
+	redis  *redis.Pool
+	jobKey string
+}
+
+func NewQueueRecurring(prefix string, redis *redis.Pool) *QueueRecurring {
+	return &QueueRecurring{
+		redis:  redis,
+		jobKey: fmt.Sprintf("%s:recurring", prefix),
+	}
+}
+
+// Save adds job, or replaces the job with the same key.
+func (s *QueueRecurring) Save(job RecurringJob) error {
+	conn := s.redis.Get()
+	defer conn.Close()
+
+	b, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Do("HSET", s.jobKey, job.Key, b)
+	return err
+}
+
+func (s *QueueRecurring) Load(key string) (RecurringJob, bool, error) {
+	conn := s.redis.Get()
+	defer conn.Close()
+
+	var ret RecurringJob
+	b, err := redis.Bytes(conn.Do("HGET", s.jobKey, key))
+	if err == redis.ErrNil {
+		return ret, false, nil
+	}
+	if err != nil {
+		return ret, false, err
+	}
+	if err := json.Unmarshal(b, &ret); err != nil {
+		return ret, false, err
+	}
+	return ret, true, nil
+}
+
+type recurringJobs []RecurringJob
+
+func (s recurringJobs) Len() int {
+	return len(s)
+}
+
+func (s recurringJobs) Less(i, j int) bool {
+	return s[i].Key < s[j].Key
+}
+
+func (s recurringJobs) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+// List returns all jobs ordered by key.
+func (s *QueueRecurring) List() ([]RecurringJob, error) {
+	conn := s.redis.Get()
+	defer conn.Close()
+
+	reply, err := redis.Values(conn.Do("HVALS", s.jobKey))
+	if err != nil {
+		return nil, err
+	}
+	ret := make(recurringJobs, len(reply))
+	for i, r := range reply {
+		b, err := redis.Bytes(r, nil)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(b, &ret[i]); err != nil {
+			return nil, err
+		}
+	}
+	sort.Sort(ret)
+	return ret, nil
+}
+
+func (s *QueueRecurring) Remove(key string) (bool, error) {
+	conn := s.redis.Get()
+	defer conn.Close()
+
+	return redis.Bool(conn.Do("HDEL", s.jobKey, key))
+}
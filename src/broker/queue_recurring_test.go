@@ -0,0 +1,40 @@
+package broker
+
+import (
+	"github.com/stretchrcom/testify/assert"
+	"testing"
+)
+
+func TestQueueRecurring(t *testing.T) {
+	prefix := testPrefix()
+	defer clearPrefix(prefix)
+	s := NewQueueRecurring(prefix, redisPool)
+
+	_, ok, err := s.Load("key1")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ok, false)
+
+	assert.Equal(t, s.Save(RecurringJob{Key: "key2", Every: 60, Data: "b"}), nil)
+	assert.Equal(t, s.Save(RecurringJob{Key: "key1", Cron: "0 1 * * *", Data: "a"}), nil)
+	assert.Equal(t, s.Save(RecurringJob{Key: "key1", Cron: "0 2 * * *", Data: "c"}), nil)
+
+	job, ok, err := s.Load("key1")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, job.Cron, "0 2 * * *")
+	assert.Equal(t, job.Data, "c")
+
+	jobs, err := s.List()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(jobs), 2)
+	assert.Equal(t, jobs[0].Key, "key1")
+	assert.Equal(t, jobs[1].Key, "key2")
+	assert.Equal(t, jobs[1].Every, int64(60))
+
+	ok, err = s.Remove("key1")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ok, true)
+	ok, err = s.Remove("key1")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ok, false)
+}
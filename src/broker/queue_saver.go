@@ -3,6 +3,7 @@ package broker
 import (
 	"fmt"
 	"github.com/garyburd/redigo/redis"
+	"time"
 )
 
 type UpdateType string
@@ -16,30 +17,57 @@ type QueueRedisStorage struct {
 	redis    *redis.Pool
 	prefix   string
 	timerKey string
+	leaseKey string
+	save     *redis.Script
+	delete   *redis.Script
+	claim    *redis.Script
+	ack      *redis.Script
+	release  *redis.Script
+	next     *redis.Script
 }
 
-func NewQueueRedisStorage(prefix string, redis *redis.Pool) *QueueRedisStorage {
+func NewQueueRedisStorage(prefix string, redis_ *redis.Pool) *QueueRedisStorage {
 	return &QueueRedisStorage{
-		redis:    redis,
+		redis:    redis_,
 		prefix:   prefix,
 		timerKey: fmt.Sprintf("%s:timer", prefix),
+		leaseKey: fmt.Sprintf("%s:lease", prefix),
+		save:     redis.NewScript(2, saveScript),
+		delete:   redis.NewScript(2, deleteScript),
+		claim:    redis.NewScript(2, claimScript),
+		ack:      redis.NewScript(2, ackScript),
+		release:  redis.NewScript(2, releaseScript),
+		next:     redis.NewScript(1, nextScript),
 	}
 }
 
+const saveScript = `
+local prefix = KEYS[1]
+local key    = KEYS[2]
+local update = ARGV[1]
+local ontime = ARGV[2]
+local data   = ARGV[3]
+local timer   = prefix..":timer"
+local storage = prefix..":storage:"..key
+
+if update == "always" or not redis.call("ZSCORE", timer, key) then
+	redis.call("ZADD", timer, ontime, key)
+end
+redis.call("RPUSH", storage, data)`
+
+// Save appends data to key. With update type "always" the key is rescheduled
+// to ontime, with "once" it keeps the first scheduled ontime.
 func (s *QueueRedisStorage) Save(updateType UpdateType, ontime int64, key string, data []byte) error {
 	conn := s.redis.Get()
 	defer conn.Close()
 
-	if err := conn.Send("MULTI"); err != nil {
-		return err
-	}
-	if err := conn.Send("RPUSH", fmt.Sprintf("%s:storage:%s", s.prefix, key), data); err != nil {
-		return err
+	switch updateType {
+	case Always:
+	case Once:
+	default:
+		return fmt.Errorf("invalid update type: %s", updateType)
 	}
-	if err := conn.Send("ZADD", s.timerKey, ontime, key); err != nil {
-		return err
-	}
-	if _, err := conn.Do("EXEC"); err != nil {
+	if _, err := s.save.Do(conn, s.prefix, key, string(updateType), ontime, data); err != nil {
 		return err
 	}
 	return nil
@@ -49,7 +77,7 @@ func (s *QueueRedisStorage) Load(key string) ([][]byte, error) {
 	conn := s.redis.Get()
 	defer conn.Close()
 
-	storageKey := fmt.Sprintf("%s:storage:%s", s.prefix, key)
+	storageKey := s.storageKey(key)
 	reply, err := redis.Values(conn.Do("LRANGE", storageKey, 0, -1))
 	if err != nil {
 		return nil, err
@@ -81,30 +109,324 @@ func (s *QueueRedisStorage) Load(key string) ([][]byte, error) {
 	return data, nil
 }
 
+const deleteScript = `
+local prefix = KEYS[1]
+local key    = KEYS[2]
+local timer   = prefix..":timer"
+local lease   = prefix..":lease"
+local storage = prefix..":storage:"..key
+local claimed = prefix..":claimed:"..key
+
+local existed = redis.call("ZREM", timer, key) + redis.call("ZREM", lease, key)
+existed = existed + redis.call("DEL", storage, claimed)
+if existed > 0 then
+	return 1
+end
+return 0`
+
+// Delete removes all data of key, including the claimed but not acked ones.
+func (s *QueueRedisStorage) Delete(key string) (bool, error) {
+	conn := s.redis.Get()
+	defer conn.Close()
+
+	return redis.Bool(s.delete.Do(conn, s.prefix, key))
+}
+
+const claimScript = `
+local prefix = KEYS[1]
+local key    = KEYS[2]
+local now      = tonumber(ARGV[1])
+local deadline = tonumber(ARGV[2])
+local timer   = prefix..":timer"
+local lease   = prefix..":lease"
+local storage = prefix..":storage:"..key
+local claimed = prefix..":claimed:"..key
+
+local leased = redis.call("ZSCORE", lease, key)
+if leased and tonumber(leased) > now then
+	if redis.call("ZSCORE", timer, key) then
+		redis.call("ZADD", timer, leased, key)
+	end
+	return {}
+end
+
+if redis.call("EXISTS", claimed) == 1 then
+	local data = redis.call("LRANGE", storage, 0, -1)
+	for i=1, #data do
+		redis.call("RPUSH", claimed, data[i])
+	end
+	redis.call("DEL", storage)
+elseif redis.call("EXISTS", storage) == 1 then
+	redis.call("RENAME", storage, claimed)
+end
+redis.call("ZREM", timer, key)
+
+local data = redis.call("LRANGE", claimed, 0, -1)
+if #data == 0 then
+	redis.call("ZREM", lease, key)
+	return {}
+end
+redis.call("ZADD", lease, deadline, key)
+return data`
+
+// Claim leases all data of key till visibility passed. The data stays in
+// storage and will be claimed again after visibility if it isn't acked.
+func (s *QueueRedisStorage) Claim(key string, visibility time.Duration) ([][]byte, error) {
+	conn := s.redis.Get()
+	defer conn.Close()
+
+	now := time.Now()
+	reply, err := redis.Values(s.claim.Do(conn, s.prefix, key, now.Unix(), now.Add(visibility).Unix()))
+	if err != nil {
+		return nil, err
+	}
+	if len(reply) == 0 {
+		return nil, nil
+	}
+	data := make([][]byte, len(reply))
+	for i, d := range reply {
+		data[i], err = redis.Bytes(d, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+const ackScript = `
+local prefix = KEYS[1]
+local key    = KEYS[2]
+local lease   = prefix..":lease"
+local claimed = prefix..":claimed:"..key
+
+redis.call("DEL", claimed)
+redis.call("ZREM", lease, key)`
+
+// Ack drops claimed data of key after it was handled.
+func (s *QueueRedisStorage) Ack(key string) error {
+	conn := s.redis.Get()
+	defer conn.Close()
+
+	if _, err := s.ack.Do(conn, s.prefix, key); err != nil {
+		return err
+	}
+	return nil
+}
+
+const releaseScript = `
+local prefix = KEYS[1]
+local key    = KEYS[2]
+local ontime = tonumber(ARGV[1])
+local timer   = prefix..":timer"
+local lease   = prefix..":lease"
+local storage = prefix..":storage:"..key
+local claimed = prefix..":claimed:"..key
+
+local data = redis.call("LRANGE", claimed, 0, -1)
+for i=#data, 1, -1 do
+	redis.call("LPUSH", storage, data[i])
+end
+redis.call("DEL", claimed)
+redis.call("ZREM", lease, key)
+if redis.call("EXISTS", storage) == 0 then
+	return
+end
+local current = redis.call("ZSCORE", timer, key)
+if not current or ontime < tonumber(current) then
+	redis.call("ZADD", timer, ontime, key)
+end`
+
+// Release gives claimed data of key back to storage, to be claimed at ontime.
+func (s *QueueRedisStorage) Release(key string, ontime int64) error {
+	conn := s.redis.Get()
+	defer conn.Close()
+
+	if _, err := s.release.Do(conn, s.prefix, key, ontime); err != nil {
+		return err
+	}
+	return nil
+}
+
 func (s *QueueRedisStorage) Ontime(key string) (int64, error) {
 	conn := s.redis.Get()
 	defer conn.Close()
 
-	ontime, err := redis.Int64(conn.Do("ZSCORE", s.timerKey, key))
-	if err == redis.ErrNil {
-		ontime, err = 0, nil
+	ret := int64(0)
+	for _, k := range []string{s.timerKey, s.leaseKey} {
+		ontime, err := redis.Int64(conn.Do("ZSCORE", k, key))
+		if err == redis.ErrNil {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if ret == 0 || ontime < ret {
+			ret = ontime
+		}
 	}
-	return ontime, err
+	return ret, nil
 }
 
+const nextScript = `
+local prefix = KEYS[1]
+local timer = prefix..":timer"
+local lease = prefix..":lease"
+
+local first = redis.call("ZRANGEBYSCORE", timer, "-INF", "+INF", "WITHSCORES", "LIMIT", 0, 1)
+local leased = redis.call("ZRANGEBYSCORE", lease, "-INF", "+INF", "WITHSCORES", "LIMIT", 0, 1)
+if next(first) == nil then
+	first = leased
+elseif next(leased) ~= nil and tonumber(leased[2]) < tonumber(first[2]) then
+	first = leased
+end
+if next(first) == nil then
+	return ""
+end
+return first[1]`
+
+// Next returns the key which should be claimed first, counting in the keys
+// whose lease will expire.
 func (s *QueueRedisStorage) Next() (string, error) {
 	conn := s.redis.Get()
 	defer conn.Close()
 
-	reply, err := redis.Values(conn.Do("ZRANGEBYSCORE", s.timerKey, "-inf", "+inf", "LIMIT", 0, 1, "WITHSCORES"))
+	return redis.String(s.next.Do(conn, s.prefix))
+}
+
+type QueueKey struct {
+	Key     string
+	Ontime  int64
+	Count   int
+	Claimed bool
+	First   []byte
+}
+
+// Range returns scheduled keys ordered by ontime, from start to stop(included).
+func (s *QueueRedisStorage) Range(start, stop int) ([]QueueKey, error) {
+	conn := s.redis.Get()
+	defer conn.Close()
+
+	reply, err := redis.Values(conn.Do("ZRANGE", s.timerKey, start, stop, "WITHSCORES"))
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	if len(reply) == 0 {
-		return "", nil
+	ret := make([]QueueKey, len(reply)/2)
+	for i := range ret {
+		ret[i].Key, err = redis.String(reply[i*2], nil)
+		if err != nil {
+			return nil, err
+		}
+		ret[i].Ontime, err = redis.Int64(reply[i*2+1], nil)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.peek(conn, &ret[i]); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// Peek returns the key and all of its data, including the claimed ones.
+func (s *QueueRedisStorage) Peek(key string) (QueueKey, [][]byte, error) {
+	conn := s.redis.Get()
+	defer conn.Close()
+
+	ret := QueueKey{
+		Key: key,
+	}
+	ontime, err := s.Ontime(key)
+	if err != nil {
+		return ret, nil, err
+	}
+	ret.Ontime = ontime
+	if err := s.peek(conn, &ret); err != nil {
+		return ret, nil, err
+	}
+	var data [][]byte
+	for _, k := range []string{s.claimedKey(key), s.storageKey(key)} {
+		reply, err := redis.Values(conn.Do("LRANGE", k, 0, -1))
+		if err != nil {
+			return ret, nil, err
+		}
+		for _, d := range reply {
+			b, err := redis.Bytes(d, nil)
+			if err != nil {
+				return ret, nil, err
+			}
+			data = append(data, b)
+		}
+	}
+	return ret, data, nil
+}
+
+// Depth returns the count of scheduled keys and how many of them are due
+// before now.
+func (s *QueueRedisStorage) Depth(now int64) (total int, due int, err error) {
+	conn := s.redis.Get()
+	defer conn.Close()
+
+	if err = conn.Send("ZCARD", s.timerKey); err != nil {
+		return
+	}
+	if err = conn.Send("ZCOUNT", s.timerKey, "-inf", now); err != nil {
+		return
+	}
+	reply, err := redis.Values(conn.Do(""))
+	if err != nil {
+		return
+	}
+	if total, err = redis.Int(reply[0], nil); err != nil {
+		return
+	}
+	due, err = redis.Int(reply[1], nil)
+	return
+}
+
+func (s *QueueRedisStorage) peek(conn redis.Conn, key *QueueKey) error {
+	if err := conn.Send("LLEN", s.claimedKey(key.Key)); err != nil {
+		return err
+	}
+	if err := conn.Send("LLEN", s.storageKey(key.Key)); err != nil {
+		return err
+	}
+	if err := conn.Send("LINDEX", s.claimedKey(key.Key), 0); err != nil {
+		return err
+	}
+	if err := conn.Send("LINDEX", s.storageKey(key.Key), 0); err != nil {
+		return err
 	}
+	reply, err := redis.Values(conn.Do(""))
+	if err != nil {
+		return err
+	}
+	claimed, err := redis.Int(reply[0], nil)
+	if err != nil {
+		return err
+	}
+	count, err := redis.Int(reply[1], nil)
+	if err != nil {
+		return err
+	}
+	key.Count = claimed + count
+	key.Claimed = claimed > 0
+	for _, r := range reply[2:] {
+		if r == nil {
+			continue
+		}
+		key.First, err = redis.Bytes(r, nil)
+		if err != nil {
+			return err
+		}
+		break
+	}
+	return nil
+}
 
-	key, err := redis.String(reply[0], nil)
+func (s *QueueRedisStorage) storageKey(key string) string {
+	return fmt.Sprintf("%s:storage:%s", s.prefix, key)
+}
 
-	return key, err
+func (s *QueueRedisStorage) claimedKey(key string) string {
+	return fmt.Sprintf("%s:claimed:%s", s.prefix, key)
 }
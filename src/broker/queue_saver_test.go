@@ -0,0 +1,249 @@
+package broker
+
+import (
+	"fmt"
+	"github.com/stretchrcom/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestQueueStorageClaimAck(t *testing.T) {
+	prefix := testPrefix()
+	defer clearPrefix(prefix)
+	s := NewQueueRedisStorage(prefix, redisPool)
+
+	now := time.Now().Unix()
+	assert.Equal(t, s.Save(Always, now, "key", []byte("a")), nil)
+	assert.Equal(t, s.Save(Always, now, "key", []byte("b")), nil)
+
+	key, err := s.Next()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, key, "key")
+
+	data, err := s.Claim("key", time.Minute)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, fmt.Sprintf("%s", data), "[a b]")
+
+	ontime, err := s.Ontime("key")
+	assert.Equal(t, err, nil)
+	assert.True(t, ontime == now+60 || ontime == now+61, "ontime: %d", ontime)
+
+	// claimed key can't be claimed again before lease expired.
+	assert.Equal(t, s.Save(Always, now, "key", []byte("c")), nil)
+	data, err = s.Claim("key", time.Minute)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(data), 0)
+	ontime, err = s.Ontime("key")
+	assert.Equal(t, err, nil)
+	assert.True(t, ontime == now+60 || ontime == now+61, "ontime: %d", ontime)
+
+	assert.Equal(t, s.Ack("key"), nil)
+	ontime, err = s.Ontime("key")
+	assert.Equal(t, err, nil)
+	assert.True(t, ontime == now+60 || ontime == now+61, "ontime: %d", ontime)
+
+	data, err = s.Claim("key", time.Minute)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, fmt.Sprintf("%s", data), "[c]")
+	assert.Equal(t, s.Ack("key"), nil)
+
+	key, err = s.Next()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, key, "")
+}
+
+func TestQueueStorageLeaseExpired(t *testing.T) {
+	prefix := testPrefix()
+	defer clearPrefix(prefix)
+	s := NewQueueRedisStorage(prefix, redisPool)
+
+	now := time.Now().Unix()
+	assert.Equal(t, s.Save(Always, now, "key1", []byte("a")), nil)
+	assert.Equal(t, s.Save(Always, now+100, "key2", []byte("b")), nil)
+
+	data, err := s.Claim("key1", -time.Second)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, fmt.Sprintf("%s", data), "[a]")
+
+	key, err := s.Next()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, key, "key1")
+
+	assert.Equal(t, s.Save(Always, now, "key1", []byte("c")), nil)
+	data, err = s.Claim("key1", time.Minute)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, fmt.Sprintf("%s", data), "[a c]")
+	assert.Equal(t, s.Ack("key1"), nil)
+
+	key, err = s.Next()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, key, "key2")
+}
+
+func TestQueueStorageRelease(t *testing.T) {
+	prefix := testPrefix()
+	defer clearPrefix(prefix)
+	s := NewQueueRedisStorage(prefix, redisPool)
+
+	now := time.Now().Unix()
+	assert.Equal(t, s.Save(Always, now, "key", []byte("a")), nil)
+	data, err := s.Claim("key", time.Minute)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, fmt.Sprintf("%s", data), "[a]")
+
+	assert.Equal(t, s.Save(Always, now+100, "key", []byte("b")), nil)
+	assert.Equal(t, s.Release("key", now+10), nil)
+	ontime, err := s.Ontime("key")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ontime, now+10)
+
+	data, err = s.Claim("key", time.Minute)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, fmt.Sprintf("%s", data), "[a b]")
+}
+
+func TestQueueStorageSaveUpdateType(t *testing.T) {
+	type save struct {
+		update UpdateType
+		ontime int64
+		data   string
+	}
+	type test struct {
+		name   string
+		saves  []save
+		ontime int64
+		data   string
+	}
+	tests := []test{
+		{"once", []save{{Once, 100, "a"}}, 100, "[a]"},
+		{"always", []save{{Always, 100, "a"}}, 100, "[a]"},
+		{"once keeps first", []save{{Once, 100, "a"}, {Once, 200, "b"}, {Once, 50, "c"}}, 100, "[a b c]"},
+		{"always reschedules", []save{{Always, 100, "a"}, {Always, 200, "b"}, {Always, 50, "c"}}, 50, "[a b c]"},
+		{"once after always", []save{{Always, 100, "a"}, {Once, 200, "b"}}, 100, "[a b]"},
+		{"always after once", []save{{Once, 100, "a"}, {Always, 200, "b"}}, 200, "[a b]"},
+	}
+
+	for _, test := range tests {
+		prefix := testPrefix()
+		s := NewQueueRedisStorage(prefix, redisPool)
+		for _, save := range test.saves {
+			err := s.Save(save.update, save.ontime, "key", []byte(save.data))
+			assert.Equal(t, err, nil, "test %s", test.name)
+		}
+		ontime, err := s.Ontime("key")
+		assert.Equal(t, err, nil, "test %s", test.name)
+		assert.Equal(t, ontime, test.ontime, "test %s", test.name)
+		data, err := s.Load("key")
+		assert.Equal(t, err, nil, "test %s", test.name)
+		assert.Equal(t, fmt.Sprintf("%s", data), test.data, "test %s", test.name)
+		clearPrefix(prefix)
+	}
+}
+
+func TestQueueStorageSaveInvalidUpdateType(t *testing.T) {
+	prefix := testPrefix()
+	defer clearPrefix(prefix)
+	s := NewQueueRedisStorage(prefix, redisPool)
+
+	err := s.Save(UpdateType("sometimes"), 100, "key", []byte("a"))
+	assert.NotEqual(t, err, nil)
+	key, err := s.Next()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, key, "")
+}
+
+func TestQueueStorageDelete(t *testing.T) {
+	prefix := testPrefix()
+	defer clearPrefix(prefix)
+	s := NewQueueRedisStorage(prefix, redisPool)
+
+	existed, err := s.Delete("key")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, existed, false)
+
+	now := time.Now().Unix()
+	assert.Equal(t, s.Save(Always, now, "key", []byte("a")), nil)
+	existed, err = s.Delete("key")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, existed, true)
+	key, err := s.Next()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, key, "")
+
+	assert.Equal(t, s.Save(Always, now, "key", []byte("a")), nil)
+	_, err = s.Claim("key", time.Minute)
+	assert.Equal(t, err, nil)
+	existed, err = s.Delete("key")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, existed, true)
+	key, err = s.Next()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, key, "")
+	existed, err = s.Delete("key")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, existed, false)
+}
+
+func TestQueueStorageRangePeek(t *testing.T) {
+	prefix := testPrefix()
+	defer clearPrefix(prefix)
+	s := NewQueueRedisStorage(prefix, redisPool)
+
+	assert.Equal(t, s.Save(Always, 200, "key2", []byte("c")), nil)
+	assert.Equal(t, s.Save(Always, 100, "key1", []byte("a")), nil)
+	assert.Equal(t, s.Save(Always, 100, "key1", []byte("b")), nil)
+
+	keys, err := s.Range(0, 10)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(keys), 2)
+	assert.Equal(t, keys[0].Key, "key1")
+	assert.Equal(t, keys[0].Ontime, int64(100))
+	assert.Equal(t, keys[0].Count, 2)
+	assert.Equal(t, string(keys[0].First), "a")
+	assert.Equal(t, keys[1].Key, "key2")
+	assert.Equal(t, keys[1].Count, 1)
+
+	keys, err = s.Range(1, 1)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(keys), 1)
+	assert.Equal(t, keys[0].Key, "key2")
+
+	_, err = s.Claim("key1", time.Minute)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, s.Save(Always, 300, "key1", []byte("d")), nil)
+	key, data, err := s.Peek("key1")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, key.Claimed, true)
+	assert.Equal(t, key.Count, 3)
+	assert.Equal(t, string(key.First), "a")
+	assert.Equal(t, fmt.Sprintf("%s", data), "[a b d]")
+
+	key, data, err = s.Peek("nonexist")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, key.Count, 0)
+	assert.Equal(t, key.Ontime, int64(0))
+	assert.Equal(t, len(data), 0)
+}
+
+func TestQueueStorageDepth(t *testing.T) {
+	prefix := testPrefix()
+	defer clearPrefix(prefix)
+	s := NewQueueRedisStorage(prefix, redisPool)
+
+	assert.Equal(t, s.Save(Always, 100, "key1", []byte("a")), nil)
+	assert.Equal(t, s.Save(Always, 100, "key1", []byte("b")), nil)
+	assert.Equal(t, s.Save(Always, 200, "key2", []byte("c")), nil)
+	assert.Equal(t, s.Save(Always, 300, "key3", []byte("d")), nil)
+
+	total, due, err := s.Depth(200)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, total, 3)
+	assert.Equal(t, due, 2)
+
+	_, err = s.Claim("key1", time.Minute)
+	assert.Equal(t, err, nil)
+	total, due, err = s.Depth(200)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, total, 2)
+	assert.Equal(t, due, 1)
+}
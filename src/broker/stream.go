@@ -0,0 +1,170 @@
+package broker
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StreamEntry is an entry of Stream with its sequence id.
+type StreamEntry struct {
+	Seq  uint64
+	Data []byte
+}
+
+// Stream is a bounded stream in redis. Entries get increasing sequence ids,
+// and only the latest max entries are kept.
+//
+// Readers can range entries after the id they saw last, or share entries in a
+// group: each entry is claimed by one reader of the group, and claimed again
+// by others if not acked before the timeout.
+type Stream struct {
+	redis     *redis.Pool
+	prefix    string
+	max       int
+	streamKey string
+	append    *redis.Script
+	claim     *redis.Script
+}
+
+func NewStream(prefix string, max int, redis_ *redis.Pool) *Stream {
+	return &Stream{
+		redis:     redis_,
+		prefix:    prefix,
+		max:       max,
+		streamKey: fmt.Sprintf("%s:stream", prefix),
+		append:    redis.NewScript(1, streamAppendScript),
+		claim:     redis.NewScript(2, streamClaimScript),
+	}
+}
+
+const streamAppendScript = `
+local prefix = KEYS[1]
+local data   = ARGV[1]
+local max    = tonumber(ARGV[2])
+local stream = prefix..":stream"
+
+local seq = redis.call("INCR", prefix..":seq")
+redis.call("ZADD", stream, seq, seq..":"..data)
+redis.call("ZREMRANGEBYRANK", stream, 0, -max-1)
+return seq`
+
+// Append adds data to the end of stream and returns its sequence id.
+func (s *Stream) Append(data []byte) (uint64, error) {
+	conn := s.redis.Get()
+	defer conn.Close()
+
+	return redis.Uint64(s.append.Do(conn, s.prefix, data, s.max))
+}
+
+// Last returns the sequence id of the latest entry, or 0 if stream is empty.
+func (s *Stream) Last() (uint64, error) {
+	conn := s.redis.Get()
+	defer conn.Close()
+
+	ret, err := redis.Uint64(conn.Do("GET", fmt.Sprintf("%s:seq", s.prefix)))
+	if err == redis.ErrNil {
+		return 0, nil
+	}
+	return ret, err
+}
+
+// Range returns at most count entries after sequence id after. Entries
+// dropped out of the bound are skipped.
+func (s *Stream) Range(after uint64, count int) ([]StreamEntry, error) {
+	conn := s.redis.Get()
+	defer conn.Close()
+
+	reply, err := redis.Values(conn.Do("ZRANGEBYSCORE", s.streamKey, fmt.Sprintf("(%d", after), "+inf", "LIMIT", 0, count))
+	if err != nil {
+		return nil, err
+	}
+	return parseStreamEntries(reply)
+}
+
+const streamClaimScript = `
+local prefix   = KEYS[1]
+local group    = KEYS[2]
+local now      = ARGV[1]
+local deadline = ARGV[2]
+local count    = tonumber(ARGV[3])
+local stream   = prefix..":stream"
+local cursor   = prefix..":group:"..group..":cursor"
+local pending  = prefix..":group:"..group..":pending"
+
+local ret = {}
+local expired = redis.call("ZRANGEBYSCORE", pending, "-inf", now, "LIMIT", 0, count)
+for _, seq in ipairs(expired) do
+	local entry = redis.call("ZRANGEBYSCORE", stream, seq, seq)
+	if #entry == 0 then
+		redis.call("ZREM", pending, seq)
+	else
+		redis.call("ZADD", pending, deadline, seq)
+		table.insert(ret, entry[1])
+	end
+end
+
+local last = redis.call("GET", cursor)
+if not last then
+	last = redis.call("GET", prefix..":seq") or "0"
+	redis.call("SET", cursor, last)
+end
+if #ret < count then
+	local fresh = redis.call("ZRANGEBYSCORE", stream, "("..last, "+inf", "LIMIT", 0, count - #ret)
+	for _, entry in ipairs(fresh) do
+		local seq = string.match(entry, "^(%d+):")
+		redis.call("ZADD", pending, deadline, seq)
+		redis.call("SET", cursor, seq)
+		table.insert(ret, entry)
+	end
+end
+return ret`
+
+// Claim returns at most count entries for a reader of group. Entries not
+// acked in timeout are claimed again, before new entries. A new group starts
+// from the end of stream.
+func (s *Stream) Claim(group string, count int, timeout time.Duration) ([]StreamEntry, error) {
+	conn := s.redis.Get()
+	defer conn.Close()
+
+	now := time.Now()
+	reply, err := redis.Values(s.claim.Do(conn, s.prefix, group, now.Unix(), now.Add(timeout).Unix(), count))
+	if err != nil {
+		return nil, err
+	}
+	return parseStreamEntries(reply)
+}
+
+// Ack marks the entry handled by group, so it won't be claimed again.
+func (s *Stream) Ack(group string, seq uint64) error {
+	conn := s.redis.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("ZREM", fmt.Sprintf("%s:group:%s:pending", s.prefix, group), seq)
+	return err
+}
+
+func parseStreamEntries(reply []interface{}) ([]StreamEntry, error) {
+	ret := make([]StreamEntry, len(reply))
+	for i, r := range reply {
+		entry, err := redis.String(r, nil)
+		if err != nil {
+			return nil, err
+		}
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid stream entry: %s", entry)
+		}
+		seq, err := strconv.ParseUint(parts[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid stream entry: %s", entry)
+		}
+		ret[i] = StreamEntry{
+			Seq:  seq,
+			Data: []byte(parts[1]),
+		}
+	}
+	return ret, nil
+}
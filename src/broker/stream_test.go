@@ -0,0 +1,84 @@
+package broker
+
+import (
+	"github.com/stretchrcom/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestStreamRange(t *testing.T) {
+	prefix := testPrefix()
+	defer clearPrefix(prefix)
+	s := NewStream(prefix, 3, redisPool)
+
+	last, err := s.Last()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, last, uint64(0))
+
+	for i, data := range []string{"a", "b:1", "c", "d"} {
+		seq, err := s.Append([]byte(data))
+		assert.Equal(t, err, nil)
+		assert.Equal(t, seq, uint64(i+1))
+	}
+	last, err = s.Last()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, last, uint64(4))
+
+	entries, err := s.Range(0, 10)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, entries, []StreamEntry{
+		{2, []byte("b:1")},
+		{3, []byte("c")},
+		{4, []byte("d")},
+	})
+
+	entries, err = s.Range(2, 1)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, entries, []StreamEntry{{3, []byte("c")}})
+
+	entries, err = s.Range(4, 10)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(entries), 0)
+}
+
+func TestStreamClaim(t *testing.T) {
+	prefix := testPrefix()
+	defer clearPrefix(prefix)
+	s := NewStream(prefix, 10, redisPool)
+
+	_, err := s.Append([]byte("before group"))
+	assert.Equal(t, err, nil)
+
+	entries, err := s.Claim("g", 10, time.Second)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(entries), 0)
+
+	for _, data := range []string{"a", "b", "c"} {
+		_, err := s.Append([]byte(data))
+		assert.Equal(t, err, nil)
+	}
+
+	// readers of a group share entries
+	entries, err = s.Claim("g", 2, time.Second)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, entries, []StreamEntry{{2, []byte("a")}, {3, []byte("b")}})
+	entries, err = s.Claim("g", 2, time.Second)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, entries, []StreamEntry{{4, []byte("c")}})
+	assert.Equal(t, s.Ack("g", 2), nil)
+	assert.Equal(t, s.Ack("g", 4), nil)
+
+	// other group has its own cursor
+	entries, err = s.Claim("other", 10, time.Second)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(entries), 0)
+
+	// not acked entries are claimed again after timeout
+	entries, err = s.Claim("g", 10, time.Second)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(entries), 0)
+	time.Sleep(time.Second * 2)
+	entries, err = s.Claim("g", 10, time.Second)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, entries, []StreamEntry{{3, []byte("b")}})
+}
@@ -9,9 +9,11 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 )
 
-func Init(defaultConfig string, config *model.Config) (quit <-chan os.Signal) {
+// Init loads config and returns the handle of quitting.
+func Init(defaultConfig string, config *model.Config) *Shutdown {
 	var pidfile string
 	var configFile string
 	var syslog bool
@@ -41,12 +43,15 @@ func Init(defaultConfig string, config *model.Config) (quit <-chan os.Signal) {
 		pid.WriteString(fmt.Sprintf("%d", os.Getpid()))
 	}
 
-	sigChan := make(chan os.Signal)
-	quit = sigChan
+	sigChan := make(chan os.Signal, 2)
 	signal.Notify(sigChan, syscall.SIGTERM)
 	signal.Notify(sigChan, syscall.SIGQUIT)
 
 	logger.SetDebug(config.Debug)
 
-	return
+	timeout := time.Duration(config.ShutdownTimeoutInSecond) * time.Second
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	return newShutdown(timeout, sigChan)
 }
@@ -0,0 +1,186 @@
+package daemon
+
+import (
+	"logger"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Shutdown is a context-like handle of daemon quitting. Done is closed when
+// the daemon gets SIGTERM or SIGQUIT. Then functions added by OnDrain run
+// while still accepting requests, ListenAndServe stops accepting connections
+// and waits in-flight requests, and functions added by OnQuit run. Functions
+// run in the order they are added, and all of them share one deadline. After
+// the deadline, the rest are still called but not waited. A second signal
+// exits at once.
+type Shutdown struct {
+	timeout  time.Duration
+	done     chan struct{}
+	deadline time.Time
+	drains   []quitFunc
+	quits    []quitFunc
+	requests int
+	idle     chan struct{}
+	locker   sync.Mutex
+}
+
+type quitFunc struct {
+	name string
+	f    func()
+}
+
+func newShutdown(timeout time.Duration, signals <-chan os.Signal) *Shutdown {
+	ret := &Shutdown{
+		timeout: timeout,
+		done:    make(chan struct{}),
+	}
+	go func() {
+		sig := <-signals
+		logger.NOTICE("got %s, quit in %s", sig, timeout)
+		ret.locker.Lock()
+		ret.deadline = time.Now().Add(timeout)
+		ret.locker.Unlock()
+		close(ret.done)
+
+		sig = <-signals
+		logger.NOTICE("got %s again, quit now", sig)
+		os.Exit(-1)
+	}()
+	return ret
+}
+
+// Done is closed when daemon begins quitting.
+func (s *Shutdown) Done() <-chan struct{} {
+	return s.done
+}
+
+// Deadline returns the time when quitting must be finished. It is zero
+// before Done closed.
+func (s *Shutdown) Deadline() time.Time {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	return s.deadline
+}
+
+// OnDrain adds f to run first when quitting, while requests are still
+// accepted. It's for work sending requests to the daemon itself, or ending
+// streaming requests.
+func (s *Shutdown) OnDrain(name string, f func()) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	s.drains = append(s.drains, quitFunc{name, f})
+}
+
+// OnQuit adds f to run when quitting, after http requests drained.
+func (s *Shutdown) OnQuit(name string, f func()) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	s.quits = append(s.quits, quitFunc{name, f})
+}
+
+// ListenAndServe serves handler on addr until quitting, then waits in-flight
+// requests and runs the quit functions. It returns nil if quitting finished.
+func (s *Shutdown) ListenAndServe(addr string, handler http.Handler) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-s.done
+		s.run(&s.drains)
+		l.Close()
+	}()
+	err = http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.begin()
+		defer s.end()
+		handler.ServeHTTP(w, r)
+	}))
+	select {
+	case <-s.done:
+	default:
+		return err
+	}
+	logger.NOTICE("stop accepting %s", addr)
+	if !s.wait(s.waitRequests) {
+		logger.ERROR("http requests not finished before deadline")
+	}
+	s.Quit()
+	return nil
+}
+
+// Quit waits until quitting begins, then runs the drain and quit functions in
+// order till the deadline. It's for daemons without ListenAndServe.
+func (s *Shutdown) Quit() {
+	<-s.done
+
+	s.run(&s.drains)
+	s.run(&s.quits)
+	logger.NOTICE("quit")
+}
+
+func (s *Shutdown) run(funcs *[]quitFunc) {
+	s.locker.Lock()
+	quits := *funcs
+	*funcs = nil
+	s.locker.Unlock()
+
+	for _, q := range quits {
+		logger.NOTICE("quit %s", q.name)
+		if !s.wait(q.f) {
+			logger.ERROR("quit %s not finished before deadline", q.name)
+		}
+	}
+}
+
+// wait runs f and returns false if it doesn't return before the deadline.
+func (s *Shutdown) wait(f func()) bool {
+	finished := make(chan bool)
+	go func() {
+		f()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return true
+	case <-time.After(s.Deadline().Sub(time.Now())):
+		return false
+	}
+}
+
+func (s *Shutdown) begin() {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	s.requests++
+}
+
+func (s *Shutdown) end() {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	s.requests--
+	if s.requests == 0 && s.idle != nil {
+		close(s.idle)
+		s.idle = nil
+	}
+}
+
+func (s *Shutdown) waitRequests() {
+	s.locker.Lock()
+	if s.requests == 0 {
+		s.locker.Unlock()
+		return
+	}
+	if s.idle == nil {
+		s.idle = make(chan struct{})
+	}
+	idle := s.idle
+	s.locker.Unlock()
+	<-idle
+}
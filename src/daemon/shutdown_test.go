@@ -0,0 +1,45 @@
+package daemon
+
+import (
+	"github.com/stretchrcom/testify/assert"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestShutdownQuitInOrder(t *testing.T) {
+	signals := make(chan os.Signal, 1)
+	s := newShutdown(time.Second, signals)
+	var order []string
+	s.OnQuit("valve", func() { order = append(order, "valve") })
+	s.OnQuit("here", func() { order = append(order, "here") })
+	s.OnQuit("timer", func() { order = append(order, "timer") })
+	assert.Equal(t, s.Deadline().IsZero(), true)
+
+	signals <- syscall.SIGTERM
+	<-s.Done()
+	assert.Equal(t, s.Deadline().IsZero(), false)
+	s.Quit()
+	assert.Equal(t, order, []string{"valve", "here", "timer"})
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	signals := make(chan os.Signal, 1)
+	s := newShutdown(time.Second/10, signals)
+	called := make(chan bool, 1)
+	s.OnQuit("slow", func() { time.Sleep(time.Second) })
+	s.OnQuit("after deadline", func() { called <- true })
+
+	signals <- syscall.SIGTERM
+	begin := time.Now()
+	s.Quit()
+	if d := time.Now().Sub(begin); d > time.Second/2 {
+		t.Errorf("quit too long: %s", d)
+	}
+	select {
+	case <-called:
+	case <-time.After(time.Second / 10):
+		t.Errorf("quit after deadline not called")
+	}
+}
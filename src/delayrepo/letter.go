@@ -0,0 +1,239 @@
+package delayrepo
+
+import (
+	"broker"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryDeadLetter is broker.QueueDeadLetter in process. If it is created by
+// NewFileDeadLetter, dead letters are saved to the file after each change.
+// Attempts aren't saved, a restart only gives keys more retries.
+type MemoryDeadLetter struct {
+	Id       int64               `json:"id"`
+	Letters  []broker.DeadLetter `json:"letters"`
+	attempts map[string]int
+	path     string
+	locker   sync.Mutex
+}
+
+func NewMemoryDeadLetter() *MemoryDeadLetter {
+	return &MemoryDeadLetter{
+		attempts: make(map[string]int),
+	}
+}
+
+func NewFileDeadLetter(path string) (*MemoryDeadLetter, error) {
+	ret := NewMemoryDeadLetter()
+	if err := loadSnapshot(path, ret); err != nil {
+		return nil, err
+	}
+	ret.path = path
+	return ret, nil
+}
+
+func (s *MemoryDeadLetter) Attempt(key string) (int, error) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	s.attempts[key]++
+	return s.attempts[key], nil
+}
+
+func (s *MemoryDeadLetter) Reset(key string) error {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	delete(s.attempts, key)
+	return nil
+}
+
+func (s *MemoryDeadLetter) Save(key, priority string, datas [][]byte, attempts int, reason string) (broker.DeadLetter, error) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	s.Id++
+	ret := broker.DeadLetter{
+		Id:       fmt.Sprintf("%d", s.Id),
+		Key:      key,
+		Priority: priority,
+		Data:     make([]string, len(datas)),
+		Attempts: attempts,
+		Reason:   reason,
+		FailedAt: time.Now().Unix(),
+	}
+	for i, data := range datas {
+		ret.Data[i] = string(data)
+	}
+	s.Letters = append([]broker.DeadLetter{ret}, s.Letters...)
+	delete(s.attempts, key)
+	return ret, s.save()
+}
+
+// List returns dead letters from newest to oldest.
+func (s *MemoryDeadLetter) List(offset, count int) ([]broker.DeadLetter, error) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	if count <= 0 || offset < 0 || offset >= len(s.Letters) {
+		return nil, nil
+	}
+	end := offset + count
+	if end > len(s.Letters) {
+		end = len(s.Letters)
+	}
+	return append([]broker.DeadLetter(nil), s.Letters[offset:end]...), nil
+}
+
+func (s *MemoryDeadLetter) Load(id string) (broker.DeadLetter, bool, error) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	for _, letter := range s.Letters {
+		if letter.Id == id {
+			return letter, true, nil
+		}
+	}
+	return broker.DeadLetter{}, false, nil
+}
+
+func (s *MemoryDeadLetter) Remove(id string) (bool, error) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	for i, letter := range s.Letters {
+		if letter.Id == id {
+			s.Letters = append(s.Letters[:i], s.Letters[i+1:]...)
+			return true, s.save()
+		}
+	}
+	return false, nil
+}
+
+// Purge removes all dead letters and returns how many were removed.
+func (s *MemoryDeadLetter) Purge() (int, error) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	ret := len(s.Letters)
+	s.Letters = nil
+	return ret, s.save()
+}
+
+func (s *MemoryDeadLetter) save() error {
+	if s.path == "" {
+		return nil
+	}
+	return saveSnapshot(s.path, s)
+}
+
+// MemoryRecurring is broker.QueueRecurring in process. If it is created by
+// NewFileRecurring, jobs are saved to the file after each change.
+type MemoryRecurring struct {
+	Jobs   map[string]broker.RecurringJob `json:"jobs"`
+	path   string
+	locker sync.Mutex
+}
+
+func NewMemoryRecurring() *MemoryRecurring {
+	return &MemoryRecurring{
+		Jobs: make(map[string]broker.RecurringJob),
+	}
+}
+
+func NewFileRecurring(path string) (*MemoryRecurring, error) {
+	ret := NewMemoryRecurring()
+	if err := loadSnapshot(path, ret); err != nil {
+		return nil, err
+	}
+	if ret.Jobs == nil {
+		ret.Jobs = make(map[string]broker.RecurringJob)
+	}
+	ret.path = path
+	return ret, nil
+}
+
+// Save adds job, or replaces the job with the same key.
+func (s *MemoryRecurring) Save(job broker.RecurringJob) error {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	s.Jobs[job.Key] = job
+	return s.save()
+}
+
+func (s *MemoryRecurring) Load(key string) (broker.RecurringJob, bool, error) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	job, ok := s.Jobs[key]
+	return job, ok, nil
+}
+
+// List returns all jobs ordered by key.
+func (s *MemoryRecurring) List() ([]broker.RecurringJob, error) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	keys := make([]string, 0, len(s.Jobs))
+	for key := range s.Jobs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	ret := make([]broker.RecurringJob, len(keys))
+	for i, key := range keys {
+		ret[i] = s.Jobs[key]
+	}
+	return ret, nil
+}
+
+func (s *MemoryRecurring) Remove(key string) (bool, error) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	if _, ok := s.Jobs[key]; !ok {
+		return false, nil
+	}
+	delete(s.Jobs, key)
+	return true, s.save()
+}
+
+func (s *MemoryRecurring) save() error {
+	if s.path == "" {
+		return nil
+	}
+	return saveSnapshot(s.path, s)
+}
+
+// loadSnapshot reads v from json file path, if it exists.
+func loadSnapshot(path string, v interface{}) error {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("load %s failed: %s", path, err)
+	}
+	return nil
+}
+
+// saveSnapshot writes v to path as json, replacing the old one at once.
+func saveSnapshot(path string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,123 @@
+package delayrepo
+
+import (
+	"broker"
+	"github.com/stretchrcom/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestFileDeadLetter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "delayrepo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := dir + "/dead"
+
+	s, err := NewFileDeadLetter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := s.Attempt("key1")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, n, 1)
+	n, err = s.Attempt("key1")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, n, 2)
+	assert.Equal(t, s.Reset("key1"), nil)
+	n, err = s.Attempt("key1")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, n, 1)
+
+	first, err := s.Save("key1", "normal", [][]byte{[]byte("a")}, 5, "500")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, first.Id, "1")
+	second, err := s.Save("key2", "bulk", [][]byte{[]byte("b"), []byte("c")}, 5, "timeout")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, second.Id, "2")
+	n, err = s.Attempt("key1")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, n, 1)
+
+	s, err = NewFileDeadLetter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	letters, err := s.List(0, 10)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, letters, []broker.DeadLetter{second, first})
+	letters, err = s.List(1, 10)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, letters, []broker.DeadLetter{first})
+
+	ok, err := s.Remove("1")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ok, true)
+	_, ok, err = s.Load("1")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ok, false)
+	third, err := s.Save("key3", "normal", nil, 5, "500")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, third.Id, "3")
+
+	s, err = NewFileDeadLetter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	letter, ok, err := s.Load("2")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, letter, second)
+	n, err = s.Purge()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, n, 2)
+}
+
+func TestFileRecurring(t *testing.T) {
+	dir, err := ioutil.TempDir("", "delayrepo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := dir + "/recurring"
+
+	s, err := NewFileRecurring(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, s.Save(broker.RecurringJob{Key: "key2", Every: 60, Data: "b"}), nil)
+	assert.Equal(t, s.Save(broker.RecurringJob{Key: "key1", Cron: "0 1 * * *", Data: "a"}), nil)
+	assert.Equal(t, s.Save(broker.RecurringJob{Key: "key1", Cron: "0 2 * * *", Data: "c"}), nil)
+
+	s, err = NewFileRecurring(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs, err := s.List()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, jobs, []broker.RecurringJob{
+		{Key: "key1", Cron: "0 2 * * *", Data: "c"},
+		{Key: "key2", Every: 60, Data: "b"},
+	})
+
+	ok, err := s.Remove("key1")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ok, true)
+	ok, err = s.Remove("key1")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ok, false)
+
+	s, err = NewFileRecurring(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ok, err = s.Load("key1")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ok, false)
+	job, ok, err := s.Load("key2")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, job.Data, "b")
+}
@@ -0,0 +1,407 @@
+package delayrepo
+
+import (
+	"broker"
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStorage is a TimerStorage in process, with the same ordering and
+// merge semantics as broker.QueueRedisStorage. If it is created by
+// NewFileStorage, all changes are appended to a log file and replayed when
+// opened again.
+type MemoryStorage struct {
+	timer   map[string]int64
+	lease   map[string]int64
+	storage map[string][][]byte
+	claimed map[string][][]byte
+	file    *os.File
+	encoder *json.Encoder
+	locker  sync.Mutex
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		timer:   make(map[string]int64),
+		lease:   make(map[string]int64),
+		storage: make(map[string][][]byte),
+		claimed: make(map[string][][]byte),
+	}
+}
+
+// NewFileStorage replays the log in path and compacts it, then appends
+// further changes to it.
+func NewFileStorage(path string) (*MemoryStorage, error) {
+	ret := NewMemoryStorage()
+	f, err := os.Open(path)
+	if err == nil {
+		err = ret.replay(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("replay %s failed: %s", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err := ret.compact(path); err != nil {
+		return nil, fmt.Errorf("compact %s failed: %s", path, err)
+	}
+	ret.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	ret.encoder = json.NewEncoder(ret.file)
+	return ret, nil
+}
+
+// Close closes the log file if there is one.
+func (s *MemoryStorage) Close() error {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file, s.encoder = nil, nil
+	return err
+}
+
+const (
+	opSave    = "save"
+	opDelete  = "delete"
+	opClaim   = "claim"
+	opAck     = "ack"
+	opRelease = "release"
+)
+
+// logEntry is one change in the log. Claim records its now and deadline, so
+// replaying gets the same result.
+type logEntry struct {
+	Op       string `json:"op"`
+	Key      string `json:"key"`
+	Update   string `json:"update,omitempty"`
+	Ontime   int64  `json:"ontime,omitempty"`
+	Deadline int64  `json:"deadline,omitempty"`
+	Data     []byte `json:"data,omitempty"`
+}
+
+func (s *MemoryStorage) Save(updateType broker.UpdateType, ontime int64, key string, data []byte) error {
+	switch updateType {
+	case broker.Always:
+	case broker.Once:
+	default:
+		return fmt.Errorf("invalid update type: %s", updateType)
+	}
+	_, _, err := s.do(logEntry{
+		Op:     opSave,
+		Key:    key,
+		Update: string(updateType),
+		Ontime: ontime,
+		Data:   data,
+	})
+	return err
+}
+
+func (s *MemoryStorage) Delete(key string) (bool, error) {
+	_, existed, err := s.do(logEntry{
+		Op:  opDelete,
+		Key: key,
+	})
+	return existed, err
+}
+
+func (s *MemoryStorage) Claim(key string, visibility time.Duration) ([][]byte, error) {
+	now := time.Now()
+	data, _, err := s.do(logEntry{
+		Op:       opClaim,
+		Key:      key,
+		Ontime:   now.Unix(),
+		Deadline: now.Add(visibility).Unix(),
+	})
+	return data, err
+}
+
+func (s *MemoryStorage) Ack(key string) error {
+	_, _, err := s.do(logEntry{
+		Op:  opAck,
+		Key: key,
+	})
+	return err
+}
+
+func (s *MemoryStorage) Release(key string, ontime int64) error {
+	_, _, err := s.do(logEntry{
+		Op:     opRelease,
+		Key:    key,
+		Ontime: ontime,
+	})
+	return err
+}
+
+func (s *MemoryStorage) Ontime(key string) (int64, error) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	return s.ontime(key), nil
+}
+
+func (s *MemoryStorage) Next() (string, error) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	key, ontime, ok := first(s.timer)
+	leased, deadline, leaseOk := first(s.lease)
+	if !ok || (leaseOk && deadline < ontime) {
+		key = leased
+	}
+	return key, nil
+}
+
+// Range returns scheduled keys ordered by ontime, from start to stop(included).
+func (s *MemoryStorage) Range(start, stop int) ([]broker.QueueKey, error) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	keys := sorted(s.timer)
+	if stop < 0 || stop >= len(keys) {
+		stop = len(keys) - 1
+	}
+	if start < 0 || start > stop {
+		return nil, nil
+	}
+	ret := make([]broker.QueueKey, 0, stop-start+1)
+	for _, k := range keys[start : stop+1] {
+		ret = append(ret, s.peek(k.key, k.ontime))
+	}
+	return ret, nil
+}
+
+// Peek returns the key and all of its data, including the claimed ones.
+func (s *MemoryStorage) Peek(key string) (broker.QueueKey, [][]byte, error) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	var data [][]byte
+	data = append(data, s.claimed[key]...)
+	data = append(data, s.storage[key]...)
+	return s.peek(key, s.ontime(key)), data, nil
+}
+
+// Depth returns the count of scheduled keys and how many of them are due
+// before now.
+func (s *MemoryStorage) Depth(now int64) (total int, due int, err error) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	for _, ontime := range s.timer {
+		if ontime <= now {
+			due++
+		}
+	}
+	return len(s.timer), due, nil
+}
+
+func (s *MemoryStorage) do(entry logEntry) ([][]byte, bool, error) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	if s.encoder != nil {
+		if err := s.encoder.Encode(entry); err != nil {
+			return nil, false, err
+		}
+	}
+	data, existed := s.apply(entry)
+	return data, existed, nil
+}
+
+func (s *MemoryStorage) apply(entry logEntry) ([][]byte, bool) {
+	key := entry.Key
+	switch entry.Op {
+	case opSave:
+		if _, ok := s.timer[key]; entry.Update == string(broker.Always) || !ok {
+			s.timer[key] = entry.Ontime
+		}
+		s.storage[key] = append(s.storage[key], entry.Data)
+	case opDelete:
+		_, inTimer := s.timer[key]
+		_, inLease := s.lease[key]
+		existed := inTimer || inLease || len(s.storage[key]) > 0 || len(s.claimed[key]) > 0
+		delete(s.timer, key)
+		delete(s.lease, key)
+		delete(s.storage, key)
+		delete(s.claimed, key)
+		return nil, existed
+	case opClaim:
+		if leased, ok := s.lease[key]; ok && leased > entry.Ontime {
+			if _, ok := s.timer[key]; ok {
+				s.timer[key] = leased
+			}
+			return nil, false
+		}
+		data := make([][]byte, 0, len(s.claimed[key])+len(s.storage[key]))
+		data = append(data, s.claimed[key]...)
+		data = append(data, s.storage[key]...)
+		delete(s.storage, key)
+		delete(s.timer, key)
+		if len(data) == 0 {
+			delete(s.claimed, key)
+			delete(s.lease, key)
+			return nil, false
+		}
+		s.claimed[key] = data
+		s.lease[key] = entry.Deadline
+		return append([][]byte(nil), data...), true
+	case opAck:
+		delete(s.claimed, key)
+		delete(s.lease, key)
+	case opRelease:
+		if claimed := s.claimed[key]; len(claimed) > 0 {
+			s.storage[key] = append(claimed, s.storage[key]...)
+		}
+		delete(s.claimed, key)
+		delete(s.lease, key)
+		if len(s.storage[key]) == 0 {
+			return nil, false
+		}
+		if current, ok := s.timer[key]; !ok || entry.Ontime < current {
+			s.timer[key] = entry.Ontime
+		}
+	}
+	return nil, false
+}
+
+func (s *MemoryStorage) replay(r io.Reader) error {
+	decoder := json.NewDecoder(bufio.NewReader(r))
+	for {
+		var entry logEntry
+		err := decoder.Decode(&entry)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// the last entry may be half written if crashed.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		s.apply(entry)
+	}
+}
+
+// compact rewrites the log with the least entries to rebuild the current
+// state.
+func (s *MemoryStorage) compact(path string) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	encoder := json.NewEncoder(w)
+	encode := func(entry logEntry) {
+		if err == nil {
+			err = encoder.Encode(entry)
+		}
+	}
+	for key, data := range s.claimed {
+		for _, d := range data {
+			encode(logEntry{Op: opSave, Key: key, Update: string(broker.Always), Data: d})
+		}
+		encode(logEntry{Op: opClaim, Key: key, Deadline: s.lease[key]})
+	}
+	for key, data := range s.storage {
+		ontime, ok := s.timer[key]
+		if !ok {
+			ontime = s.lease[key]
+		}
+		for _, d := range data {
+			encode(logEntry{Op: opSave, Key: key, Update: string(broker.Always), Ontime: ontime, Data: d})
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *MemoryStorage) ontime(key string) int64 {
+	ret := int64(0)
+	for _, m := range []map[string]int64{s.timer, s.lease} {
+		if ontime, ok := m[key]; ok && (ret == 0 || ontime < ret) {
+			ret = ontime
+		}
+	}
+	return ret
+}
+
+func (s *MemoryStorage) peek(key string, ontime int64) broker.QueueKey {
+	ret := broker.QueueKey{
+		Key:     key,
+		Ontime:  ontime,
+		Count:   len(s.claimed[key]) + len(s.storage[key]),
+		Claimed: len(s.claimed[key]) > 0,
+	}
+	for _, data := range [][][]byte{s.claimed[key], s.storage[key]} {
+		if len(data) > 0 {
+			ret.First = data[0]
+			break
+		}
+	}
+	return ret
+}
+
+type keyOntime struct {
+	key    string
+	ontime int64
+}
+
+type keyOntimes []keyOntime
+
+func (s keyOntimes) Len() int {
+	return len(s)
+}
+
+// Less orders by ontime then key, as redis sorted set does.
+func (s keyOntimes) Less(i, j int) bool {
+	if s[i].ontime != s[j].ontime {
+		return s[i].ontime < s[j].ontime
+	}
+	return s[i].key < s[j].key
+}
+
+func (s keyOntimes) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func sorted(m map[string]int64) keyOntimes {
+	ret := make(keyOntimes, 0, len(m))
+	for key, ontime := range m {
+		ret = append(ret, keyOntime{key, ontime})
+	}
+	sort.Sort(ret)
+	return ret
+}
+
+func first(m map[string]int64) (string, int64, bool) {
+	var ret keyOntime
+	ok := false
+	for key, ontime := range m {
+		k := keyOntime{key, ontime}
+		if !ok || (keyOntimes{k, ret}).Less(0, 1) {
+			ret, ok = k, true
+		}
+	}
+	return ret.key, ret.ontime, ok
+}
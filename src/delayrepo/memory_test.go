@@ -0,0 +1,90 @@
+package delayrepo
+
+import (
+	"broker"
+	"fmt"
+	"github.com/stretchrcom/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestFileStorageReplay(t *testing.T) {
+	f, err := ioutil.TempFile("", "delayrepo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	s, err := NewFileStorage(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Unix()
+	assert.Equal(t, s.Save(broker.Always, now, "1", []byte("a")), nil)
+	assert.Equal(t, s.Save(broker.Always, now, "1", []byte("b")), nil)
+	assert.Equal(t, s.Save(broker.Once, now+100, "2", []byte("c")), nil)
+	assert.Equal(t, s.Save(broker.Always, now+200, "3", []byte("d")), nil)
+	data, err := s.Claim("1", time.Minute)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, fmt.Sprintf("%s", data), "[a b]")
+	assert.Equal(t, s.Save(broker.Always, now+10, "1", []byte("e")), nil)
+	existed, err := s.Delete("3")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, existed, true)
+	assert.Equal(t, s.Close(), nil)
+
+	for i := 0; i < 2; i++ {
+		// reopen twice to check the compacted log too.
+		s, err = NewFileStorage(f.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, data, err := s.Peek("1")
+		assert.Equal(t, err, nil)
+		assert.Equal(t, key.Claimed, true)
+		assert.Equal(t, fmt.Sprintf("%s", data), "[a b e]")
+		ontime, err := s.Ontime("1")
+		assert.Equal(t, err, nil)
+		assert.Equal(t, ontime, now+10)
+		ontime, err = s.Ontime("2")
+		assert.Equal(t, err, nil)
+		assert.Equal(t, ontime, now+100)
+		ontime, err = s.Ontime("3")
+		assert.Equal(t, err, nil)
+		assert.Equal(t, ontime, int64(0))
+		assert.Equal(t, s.Close(), nil)
+	}
+
+	s, err = NewFileStorage(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	assert.Equal(t, s.Release("1", now), nil)
+	data, err = s.Claim("1", time.Minute)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, fmt.Sprintf("%s", data), "[a b e]")
+}
+
+func TestFileStorageHalfWritten(t *testing.T) {
+	f, err := ioutil.TempFile("", "delayrepo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprintln(f, `{"op":"save","key":"1","update":"always","ontime":100,"data":"YQ=="}`)
+	fmt.Fprint(f, `{"op":"save","key":"1","upd`)
+	f.Close()
+
+	s, err := NewFileStorage(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	_, data, err := s.Peek("1")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, fmt.Sprintf("%s", data), "[a]")
+}
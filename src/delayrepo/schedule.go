@@ -0,0 +1,163 @@
+package delayrepo
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule gives the next time of a recurring job.
+type Schedule interface {
+	Next(t time.Time) time.Time
+}
+
+// Every runs a job each interval.
+type Every time.Duration
+
+func (e Every) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(e))
+}
+
+// Cron is a schedule in crontab format: "minute hour day-of-month month
+// day-of-week", each field supports "*", "a-b", "*/n", "a-b/n" and lists
+// separated by ",". Like crontab, if both day-of-month and day-of-week are
+// restricted, a day matching either of them is fine.
+type Cron struct {
+	expr   string
+	minute uint64
+	hour   uint64
+	dom    uint64
+	month  uint64
+	dow    uint64
+	anyDom bool
+	anyDow bool
+}
+
+type cronField struct {
+	name     string
+	min, max int
+}
+
+var cronFields = []cronField{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+func ParseCron(expr string) (*Cron, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("invalid cron %q: need %d fields", expr, len(cronFields))
+	}
+	bits := make([]uint64, len(fields))
+	for i, field := range fields {
+		var err error
+		bits[i], err = parseCronField(field, cronFields[i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron %q: %s", expr, err)
+		}
+	}
+	ret := &Cron{
+		expr:   expr,
+		minute: bits[0],
+		hour:   bits[1],
+		dom:    bits[2],
+		month:  bits[3],
+		dow:    bits[4],
+		anyDom: fields[2] == "*",
+		anyDow: fields[4] == "*",
+	}
+	// 7 is sunday too.
+	if ret.dow&(1<<7) != 0 {
+		ret.dow |= 1
+	}
+	return ret, nil
+}
+
+func parseCronField(field string, f cronField) (uint64, error) {
+	var ret uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step of %s: %s", f.name, part)
+			}
+			part = part[:i]
+		}
+		min, max := f.min, f.max
+		switch {
+		case part == "*":
+		case strings.Contains(part, "-"):
+			r := strings.SplitN(part, "-", 2)
+			var err error
+			if min, err = strconv.Atoi(r[0]); err != nil {
+				return 0, fmt.Errorf("invalid %s: %s", f.name, part)
+			}
+			if max, err = strconv.Atoi(r[1]); err != nil {
+				return 0, fmt.Errorf("invalid %s: %s", f.name, part)
+			}
+		default:
+			n, err := strconv.Atoi(part)
+			if err != nil {
+				return 0, fmt.Errorf("invalid %s: %s", f.name, part)
+			}
+			min, max = n, n
+			if step > 1 {
+				max = f.max
+			}
+		}
+		if min < f.min || max > f.max || min > max {
+			return 0, fmt.Errorf("%s out of range: %s", f.name, part)
+		}
+		for i := min; i <= max; i += step {
+			ret |= 1 << uint(i)
+		}
+	}
+	return ret, nil
+}
+
+func (c *Cron) String() string {
+	return c.expr
+}
+
+// Next returns the first matched minute after t, in the location of t. It
+// returns zero time if nothing matched in 5 years, like "0 0 30 2 *".
+func (c *Cron) Next(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Add(time.Minute - time.Duration(t.Second())*time.Second - time.Duration(t.Nanosecond()))
+	end := t.AddDate(5, 0, 0)
+	for t.Before(end) {
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !c.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+			continue
+		}
+		if c.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+func (c *Cron) matchDay(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.anyDom || c.anyDow {
+		return dom && dow
+	}
+	return dom || dow
+}
@@ -0,0 +1,51 @@
+package delayrepo
+
+import (
+	"github.com/stretchrcom/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	type test struct {
+		expr string
+		from string
+		next string
+	}
+	var tests = []test{
+		{"* * * * *", "2013-05-01 10:20:30", "2013-05-01 10:21:00"},
+		{"0 1 * * *", "2013-05-01 10:20:30", "2013-05-02 01:00:00"},
+		{"*/15 * * * *", "2013-05-01 10:20:30", "2013-05-01 10:30:00"},
+		{"5,35 9-17 * * *", "2013-05-01 17:40:00", "2013-05-02 09:05:00"},
+		{"0 0 1 * *", "2013-05-01 00:00:00", "2013-06-01 00:00:00"},
+		{"0 0 * * 0", "2013-05-01 00:00:00", "2013-05-05 00:00:00"},
+		{"0 0 * * 7", "2013-05-01 00:00:00", "2013-05-05 00:00:00"},
+		{"0 0 13 * 5", "2013-05-01 00:00:00", "2013-05-03 00:00:00"},
+		{"0 0 29 2 *", "2013-05-01 00:00:00", "2016-02-29 00:00:00"},
+		{"0 0 30 2 *", "2013-05-01 00:00:00", "0001-01-01 00:00:00"},
+	}
+	for _, test := range tests {
+		c, err := ParseCron(test.expr)
+		if err != nil {
+			t.Fatalf("parse %s failed: %s", test.expr, err)
+		}
+		from, err := time.Parse("2006-01-02 15:04:05", test.from)
+		if err != nil {
+			t.Fatal(err)
+		}
+		next := c.Next(from)
+		assert.Equal(t, next.Format("2006-01-02 15:04:05"), test.next, "cron %s from %s", test.expr, test.from)
+	}
+}
+
+func TestCronInvalid(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "*/0 * * * *", "a * * * *", "5-1 * * * *"} {
+		_, err := ParseCron(expr)
+		assert.NotEqual(t, err, nil, "cron %q", expr)
+	}
+}
+
+func TestEvery(t *testing.T) {
+	from := time.Unix(1000, 0)
+	assert.Equal(t, Every(time.Minute).Next(from).Unix(), int64(1060))
+}
@@ -4,6 +4,7 @@ import (
 	"broker"
 	"fmt"
 	"launchpad.net/tomb"
+	"sync/atomic"
 	"time"
 )
 
@@ -14,71 +15,162 @@ const (
 	Once              = "once"
 )
 
+// Handler handles the data popped from lane of timer. Data is acked if Do
+// returns nil, or released to retry after timeout if Do returns error.
 type Handler interface {
-	Do(key string, data [][]byte)
+	Do(lane int, key string, data [][]byte) error
 	OnError(err error)
 }
 
+// TimerStorage saves data with ontime. Data of a key is claimed before
+// handling and removed only after acked, claimed data which isn't acked in
+// visibility will be claimed again.
 type TimerStorage interface {
 	Save(updateType broker.UpdateType, ontime int64, key string, data []byte) error
-	Load(key string) ([][]byte, error)
+	Delete(key string) (existed bool, err error)
+	Claim(key string, visibility time.Duration) ([][]byte, error)
+	Ack(key string) error
+	Release(key string, ontime int64) error
 	Ontime(key string) (int64, error)
 	Next() (string, error)
 }
 
 type Timer struct {
-	storage   TimerStorage
-	pushArg   chan pushArg
-	deleteArg chan deleteArg
-	timeout   time.Duration
-	tomb      tomb.Tomb
+	lanes      []TimerStorage
+	pushArg    chan pushArg
+	deleteArg  chan deleteArg
+	ackArg     chan ackArg
+	timeout    time.Duration
+	visibility time.Duration
+	workers    int32
+	running    int32
+	tomb       tomb.Tomb
 }
 
-func NewTimer(storage TimerStorage, timeout time.Duration) (*Timer, error) {
+// NewTimer creates a timer which handles at most workers keys at the same
+// time. Keys which are due while all workers are busy stay in storage until a
+// worker is free. workers <= 0 means no limit.
+func NewTimer(storage TimerStorage, timeout, visibility time.Duration, workers int) (*Timer, error) {
+	return NewLaneTimer([]TimerStorage{storage}, timeout, visibility, workers)
+}
+
+// NewLaneTimer creates a timer with lanes of storage. If keys in several
+// lanes are due, the one in the lower lane is handled first, so lanes[0] has
+// the highest priority.
+func NewLaneTimer(lanes []TimerStorage, timeout, visibility time.Duration, workers int) (*Timer, error) {
+	if len(lanes) == 0 {
+		return nil, fmt.Errorf("need at least one lane")
+	}
 	return &Timer{
-		storage:   storage,
-		pushArg:   make(chan pushArg),
-		deleteArg: make(chan deleteArg),
-		timeout:   timeout,
+		lanes:      lanes,
+		pushArg:    make(chan pushArg),
+		deleteArg:  make(chan deleteArg),
+		ackArg:     make(chan ackArg),
+		timeout:    timeout,
+		visibility: visibility,
+		workers:    int32(workers),
 	}, nil
 }
 
+// Running returns the count of keys being handled.
+func (t *Timer) Running() int {
+	return int(atomic.LoadInt32(&t.running))
+}
+
+func (t *Timer) busy() bool {
+	return t.workers > 0 && atomic.LoadInt32(&t.running) >= t.workers
+}
+
 func (t *Timer) Serve(handler Handler) {
 	defer t.tomb.Done()
 
 	for {
-		next, err := t.NextWakeup()
-		if err != nil {
-			handler.OnError(fmt.Errorf("next wake up failed: %s", err))
+		var wakeup <-chan time.Time
+		if !t.busy() {
+			next, err := t.NextWakeup()
+			if err != nil {
+				handler.OnError(fmt.Errorf("next wake up failed: %s", err))
+			}
+			wakeup = time.After(next)
 		}
 		select {
 		case <-t.tomb.Dying():
+			t.drain(handler)
 			return
-		case <-time.After(next):
-			key, data, err := t.pop()
+		case <-wakeup:
+			lane, key, data, err := t.pop()
 			if err != nil {
 				handler.OnError(fmt.Errorf("pop failed: %s", err))
 				continue
 			}
 			if len(data) > 0 {
-				go handler.Do(key, data)
+				atomic.AddInt32(&t.running, 1)
+				go t.do(handler, lane, key, data)
 			}
 		case p := <-t.pushArg:
-			err = t.push(p.updateType, p.ontime, p.key, p.data)
+			err := t.push(p.lane, p.updateType, p.ontime, p.key, p.data)
 			p.err <- err
 		case p := <-t.deleteArg:
-			err = t.delete(p.key)
+			existed, err := t.delete(p.key)
+			p.ret <- deleteRet{existed, err}
+		case p := <-t.ackArg:
+			t.onAck(handler, p)
+		}
+	}
+}
+
+// drain stops popping and waits all running keys acked. Handlers may still
+// push while running.
+func (t *Timer) drain(handler Handler) {
+	for t.Running() > 0 {
+		select {
+		case p := <-t.pushArg:
+			err := t.push(p.lane, p.updateType, p.ontime, p.key, p.data)
 			p.err <- err
+		case p := <-t.deleteArg:
+			existed, err := t.delete(p.key)
+			p.ret <- deleteRet{existed, err}
+		case p := <-t.ackArg:
+			t.onAck(handler, p)
 		}
 	}
 }
 
+func (t *Timer) onAck(handler Handler, p ackArg) {
+	atomic.AddInt32(&t.running, -1)
+	if p.err != nil {
+		handler.OnError(fmt.Errorf("do %s failed: %s", p.key, p.err))
+	}
+	err := t.ack(p.lane, p.key, p.err)
+	if err != nil {
+		handler.OnError(fmt.Errorf("ack %s failed: %s", p.key, err))
+	}
+}
+
+type ackArg struct {
+	lane int
+	key  string
+	err  error
+}
+
+func (t *Timer) do(handler Handler, lane int, key string, data [][]byte) {
+	arg := ackArg{
+		lane: lane,
+		key:  key,
+		err:  handler.Do(lane, key, data),
+	}
+	t.ackArg <- arg
+}
+
+// Quit stops popping keys, and returns after all running keys are handled and
+// acked.
 func (t *Timer) Quit() {
 	t.tomb.Kill(nil)
 	t.tomb.Wait()
 }
 
 type pushArg struct {
+	lane       int
 	updateType broker.UpdateType
 	ontime     int64
 	key        string
@@ -87,13 +179,21 @@ type pushArg struct {
 }
 
 func (t *Timer) Push(updateType UpdateType, ontime int64, key string, data []byte) error {
+	return t.PushLane(0, updateType, ontime, key, data)
+}
+
+func (t *Timer) PushLane(lane int, updateType UpdateType, ontime int64, key string, data []byte) error {
 	switch updateType {
 	case Always:
 	case Once:
 	default:
 		return fmt.Errorf("invalid update type: %s", updateType)
 	}
+	if lane < 0 || lane >= len(t.lanes) {
+		return fmt.Errorf("invalid lane: %d", lane)
+	}
 	arg := pushArg{
+		lane:       lane,
 		updateType: broker.UpdateType(updateType),
 		ontime:     ontime,
 		key:        key,
@@ -108,53 +208,97 @@ func (t *Timer) Push(updateType UpdateType, ontime int64, key string, data []byt
 
 type deleteArg struct {
 	key string
-	err chan error
+	ret chan deleteRet
+}
+
+type deleteRet struct {
+	existed bool
+	err     error
 }
 
-func (t *Timer) Delete(key string) error {
+// Delete removes all data of key in all lanes, returns whether key existed.
+func (t *Timer) Delete(key string) (bool, error) {
 	arg := deleteArg{
 		key: key,
-		err: make(chan error),
+		ret: make(chan deleteRet),
 	}
 	t.deleteArg <- arg
-	err := <-arg.err
-	close(arg.err)
-	return err
+	ret := <-arg.ret
+	close(arg.ret)
+	return ret.existed, ret.err
 }
 
-func (t *Timer) push(updateType broker.UpdateType, ontime int64, key string, data []byte) error {
-	return t.storage.Save(updateType, ontime, key, data)
+func (t *Timer) push(lane int, updateType broker.UpdateType, ontime int64, key string, data []byte) error {
+	return t.lanes[lane].Save(updateType, ontime, key, data)
 }
 
-func (t *Timer) pop() (string, [][]byte, error) {
-	key, err := t.storage.Next()
-	if err != nil {
-		return "", nil, err
+// pop claims the due key in the highest lane.
+func (t *Timer) pop() (int, string, [][]byte, error) {
+	now := time.Now().Unix()
+	for lane, storage := range t.lanes {
+		key, ontime, err := t.next(storage)
+		if err != nil {
+			return lane, "", nil, err
+		}
+		if key == "" || ontime > now {
+			continue
+		}
+		data, err := storage.Claim(key, t.visibility)
+		if err != nil {
+			return lane, "", nil, err
+		}
+		return lane, key, data, nil
 	}
-	data, err := t.storage.Load(key)
-	if err != nil {
-		return "", nil, err
+	return 0, "", nil, nil
+}
+
+func (t *Timer) ack(lane int, key string, err error) error {
+	if err == nil {
+		return t.lanes[lane].Ack(key)
 	}
-	return key, data, nil
+	return t.lanes[lane].Release(key, time.Now().Add(t.timeout).Unix())
 }
 
-func (t *Timer) delete(key string) error {
-	_, err := t.storage.Load(key)
-	return err
+func (t *Timer) delete(key string) (bool, error) {
+	ret := false
+	for _, storage := range t.lanes {
+		existed, err := storage.Delete(key)
+		if err != nil {
+			return ret, err
+		}
+		ret = ret || existed
+	}
+	return ret, nil
 }
 
+// NextWakeup returns the duration to the first key in all lanes.
 func (t *Timer) NextWakeup() (time.Duration, error) {
-	key, err := t.storage.Next()
-	if err != nil {
-		return t.timeout, err
+	ret := t.timeout
+	found := false
+	for _, storage := range t.lanes {
+		key, ontime, err := t.next(storage)
+		if err != nil {
+			return t.timeout, err
+		}
+		if key == "" {
+			continue
+		}
+		next := time.Unix(ontime, 0).Sub(time.Now())
+		if !found || next < ret {
+			ret, found = next, true
+		}
 	}
-	if key == "" {
-		return t.timeout, nil
+	return ret, nil
+}
+
+func (t *Timer) next(storage TimerStorage) (string, int64, error) {
+	key, err := storage.Next()
+	if err != nil || key == "" {
+		return "", 0, err
 	}
-	ontime, err := t.storage.Ontime(key)
+	ontime, err := storage.Ontime(key)
 	if err != nil {
-		return t.timeout, err
+		return "", 0, err
 	}
-	next := time.Unix(ontime, 0).Sub(time.Now())
-	return next, nil
+	return key, ontime, nil
 }
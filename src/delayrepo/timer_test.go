@@ -3,107 +3,107 @@ package delayrepo
 import (
 	"broker"
 	"fmt"
+	"github.com/garyburd/redigo/redis"
 	"github.com/stretchrcom/testify/assert"
-	"sort"
+	"io/ioutil"
+	"math/rand"
+	"os"
 	"testing"
 	"time"
 )
 
-type timeData struct {
-	timer int64
-	key   string
-}
-
-type timeDatas []timeData
-
-func (s timeDatas) Len() int {
-	return len(s)
-}
-
-func (s timeDatas) Less(i, j int) bool {
-	return s[i].timer < s[j].timer
-}
-
-func (s timeDatas) Swap(i, j int) {
-	s[i], s[j] = s[j], s[i]
-}
-
-type FakeStorage struct {
-	timer timeDatas
-	array map[string][][]byte
+var redisPool = &redis.Pool{
+	MaxIdle:     3,
+	IdleTimeout: 30 * time.Minute,
+	Dial: func() (redis.Conn, error) {
+		c, err := redis.Dial("tcp", "127.0.0.1:6379")
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	},
+	TestOnBorrow: func(c redis.Conn, t time.Time) error {
+		_, err := c.Do("PING")
+		return err
+	},
 }
 
-func newFakeStorage() *FakeStorage {
-	return &FakeStorage{
-		timer: make(timeDatas, 0),
-		array: make(map[string][][]byte),
-	}
+type storageMaker struct {
+	name string
+	new  func(t *testing.T) (s TimerStorage, clean func())
 }
 
-func (s *FakeStorage) Save(iupdate broker.UpdateType, ontime int64, key string, data []byte) error {
-	exist := false
-	for i := range s.timer {
-		if s.timer[i].key == key {
-			s.timer[i].timer = ontime
-			exist = true
-			break
+var storageMakers = []storageMaker{
+	{"memory", func(t *testing.T) (TimerStorage, func()) {
+		return NewMemoryStorage(), func() {}
+	}},
+	{"file", func(t *testing.T) (TimerStorage, func()) {
+		f, err := ioutil.TempFile("", "delayrepo")
+		if err != nil {
+			t.Fatal(err)
 		}
-	}
-	if !exist {
-		s.timer = append(s.timer, timeData{
-			timer: ontime,
-			key:   key,
-		})
-	}
-	sort.Sort(s.timer)
-	s.array[key] = append(s.array[key], data)
-	return nil
-}
-
-func (s *FakeStorage) Load(key string) ([][]byte, error) {
-	ret := s.array[key]
-	delete(s.array, key)
-	for i := range s.timer {
-		if s.timer[i].key == key {
-			s.timer = append(s.timer[:i], s.timer[i+1:]...)
-			break
+		f.Close()
+		s, err := NewFileStorage(f.Name())
+		if err != nil {
+			t.Fatal(err)
 		}
-	}
-	return ret, nil
-}
-
-func (s *FakeStorage) Ontime(key string) (int64, error) {
-	for i := range s.timer {
-		if s.timer[i].key == key {
-			return s.timer[i].timer, nil
+		return s, func() {
+			s.Close()
+			os.Remove(f.Name())
 		}
-	}
-	return 0, nil
+	}},
+	// redis must be the last one, since t.Skipf stops the rest of the test.
+	{"redis", func(t *testing.T) (TimerStorage, func()) {
+		conn := redisPool.Get()
+		_, err := conn.Do("PING")
+		conn.Close()
+		if err != nil {
+			t.Skipf("skip redis storage: %s", err)
+		}
+		prefix := fmt.Sprintf("delayrepo:test:%d.%d", time.Now().Unix(), rand.Intn(10000))
+		return broker.NewQueueRedisStorage(prefix, redisPool), func() {
+			conn := redisPool.Get()
+			defer conn.Close()
+			keys, err := redis.Strings(conn.Do("KEYS", prefix+"*"))
+			if err != nil {
+				return
+			}
+			for _, key := range keys {
+				conn.Do("DEL", key)
+			}
+		}
+	}},
 }
 
-func (s *FakeStorage) Next() (string, error) {
-	if len(s.timer) == 0 {
-		return "", nil
+// forEachStorage runs test with every TimerStorage implementation.
+func forEachStorage(t *testing.T, test func(t *testing.T, s TimerStorage)) {
+	for _, maker := range storageMakers {
+		t.Logf("storage: %s", maker.name)
+		s, clean := maker.new(t)
+		test(t, s)
+		clean()
 	}
-	return s.timer[0].key, nil
 }
 
 func TestTimer(t *testing.T) {
-	s := newFakeStorage()
-	timer, err := NewTimer(s, time.Second)
+	forEachStorage(t, testTimer)
+}
+
+func testTimer(t *testing.T, s TimerStorage) {
+	timer, err := NewTimer(s, time.Second, time.Second, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
 	ontime := time.Now().Add(time.Second).Unix()
-	err = timer.push(broker.Always, ontime, "123", []byte("a"))
+	err = timer.push(0, broker.Always, ontime, "123", []byte("a"))
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = timer.push(broker.Always, ontime, "123", []byte("b"))
+	err = timer.push(0, broker.Always, ontime, "123", []byte("b"))
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = timer.push(broker.Always, ontime, "123", []byte("c"))
+	err = timer.push(0, broker.Always, ontime, "123", []byte("c"))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -115,7 +115,7 @@ func TestTimer(t *testing.T) {
 
 	time.Sleep(wait)
 
-	key, data, err := timer.pop()
+	_, key, data, err := timer.pop()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -125,8 +125,11 @@ func TestTimer(t *testing.T) {
 }
 
 func TestEmptyTimer(t *testing.T) {
-	s := newFakeStorage()
-	timer, err := NewTimer(s, time.Second)
+	forEachStorage(t, testEmptyTimer)
+}
+
+func testEmptyTimer(t *testing.T, s TimerStorage) {
+	timer, err := NewTimer(s, time.Second, time.Second, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -138,13 +141,16 @@ func TestEmptyTimer(t *testing.T) {
 }
 
 func TestTimerUpdate(t *testing.T) {
-	s := newFakeStorage()
-	timer, err := NewTimer(s, time.Second)
+	forEachStorage(t, testTimerUpdate)
+}
+
+func testTimerUpdate(t *testing.T, s TimerStorage) {
+	timer, err := NewTimer(s, time.Second, time.Second, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
 	ontime := time.Now().Add(time.Second * 10).Unix()
-	err = timer.push(broker.Always, ontime, "123", []byte("a"))
+	err = timer.push(0, broker.Always, ontime, "123", []byte("a"))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -157,7 +163,7 @@ func TestTimerUpdate(t *testing.T) {
 	}
 
 	ontime = time.Now().Unix()
-	err = timer.push(broker.Always, ontime, "123", []byte("b"))
+	err = timer.push(0, broker.Always, ontime, "123", []byte("b"))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -171,7 +177,7 @@ func TestTimerUpdate(t *testing.T) {
 
 	time.Sleep(wait)
 
-	key, data, err := timer.pop()
+	_, key, data, err := timer.pop()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -181,17 +187,20 @@ func TestTimerUpdate(t *testing.T) {
 }
 
 func TestTimerDelete(t *testing.T) {
-	s := newFakeStorage()
-	timer, err := NewTimer(s, time.Second)
+	forEachStorage(t, testTimerDelete)
+}
+
+func testTimerDelete(t *testing.T, s TimerStorage) {
+	timer, err := NewTimer(s, time.Second, time.Second, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
 	ontime := time.Now().Add(time.Second * 10).Unix()
-	err = timer.push(broker.Always, ontime, "123", []byte("a"))
+	err = timer.push(0, broker.Always, ontime, "123", []byte("a"))
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = timer.push(broker.Always, ontime, "123", []byte("b"))
+	err = timer.push(0, broker.Always, ontime, "123", []byte("b"))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -203,7 +212,16 @@ func TestTimerDelete(t *testing.T) {
 		t.Fatalf("wait too short: %s", wait)
 	}
 
-	timer.delete("123")
+	existed, err := timer.delete("123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, existed, true)
+	existed, err = timer.delete("123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, existed, false)
 
 	wait, err = timer.NextWakeup()
 	if err != nil {
@@ -211,7 +229,7 @@ func TestTimerDelete(t *testing.T) {
 	}
 	assert.Equal(t, wait, time.Second, "wait: %s", wait)
 
-	key, data, err := timer.pop()
+	_, key, data, err := timer.pop()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -219,3 +237,269 @@ func TestTimerDelete(t *testing.T) {
 	assert.Equal(t, key, "")
 	assert.Equal(t, fmt.Sprintf("%v", data), "[]")
 }
+
+func TestTimerNotAcked(t *testing.T) {
+	forEachStorage(t, testTimerNotAcked)
+}
+
+func testTimerNotAcked(t *testing.T, s TimerStorage) {
+	timer, err := NewTimer(s, time.Second, time.Second, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ontime := time.Now().Unix()
+	err = timer.push(0, broker.Always, ontime, "123", []byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, key, data, err := timer.pop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, key, "123")
+	assert.Equal(t, fmt.Sprintf("%v", data), "[[97]]")
+
+	err = timer.push(0, broker.Always, ontime, "123", []byte("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, key, data, err = timer.pop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, key, "123")
+	assert.Equal(t, fmt.Sprintf("%v", data), "[]")
+
+	wait, err := timer.NextWakeup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wait > time.Second {
+		t.Fatalf("wait too long: %s", wait)
+	}
+	time.Sleep(wait + time.Second)
+
+	_, key, data, err = timer.pop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, key, "123")
+	assert.Equal(t, fmt.Sprintf("%v", data), "[[97] [98]]")
+
+	err = timer.ack(0, key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wait, err = timer.NextWakeup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, wait, time.Second)
+}
+
+func TestTimerRelease(t *testing.T) {
+	forEachStorage(t, testTimerRelease)
+}
+
+func testTimerRelease(t *testing.T, s TimerStorage) {
+	timer, err := NewTimer(s, time.Second, time.Second*10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ontime := time.Now().Unix()
+	err = timer.push(0, broker.Always, ontime, "123", []byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, key, data, err := timer.pop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, fmt.Sprintf("%v", data), "[[97]]")
+
+	err = timer.push(0, broker.Always, ontime+10, "123", []byte("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = timer.ack(0, key, fmt.Errorf("failed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wait, err := timer.NextWakeup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wait > time.Second {
+		t.Fatalf("wait too long: %s", wait)
+	}
+	time.Sleep(wait)
+
+	_, key, data, err = timer.pop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, key, "123")
+	assert.Equal(t, fmt.Sprintf("%v", data), "[[97] [98]]")
+}
+
+type blockHandler struct {
+	keys    chan string
+	release chan bool
+}
+
+func (h *blockHandler) Do(lane int, key string, data [][]byte) error {
+	h.keys <- key
+	<-h.release
+	return nil
+}
+
+func (h *blockHandler) OnError(err error) {}
+
+func TestTimerWorkers(t *testing.T) {
+	forEachStorage(t, testTimerWorkers)
+}
+
+func testTimerWorkers(t *testing.T, s TimerStorage) {
+	timer, err := NewTimer(s, time.Second, time.Second*10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := &blockHandler{
+		keys:    make(chan string, 2),
+		release: make(chan bool),
+	}
+	go timer.Serve(handler)
+	defer timer.Quit()
+
+	ontime := time.Now().Unix()
+	err = timer.Push(Always, ontime, "1", []byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = timer.Push(Always, ontime+1, "2", []byte("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case key := <-handler.keys:
+		assert.Equal(t, key, "1")
+	case <-time.After(time.Second * 2):
+		t.Fatal("key 1 not handled")
+	}
+	assert.Equal(t, timer.Running(), 1)
+
+	// key 2 is due but waits for the busy worker.
+	select {
+	case key := <-handler.keys:
+		t.Fatalf("%s handled while worker busy", key)
+	case <-time.After(time.Second * 2):
+	}
+
+	handler.release <- true
+	select {
+	case key := <-handler.keys:
+		assert.Equal(t, key, "2")
+	case <-time.After(time.Second * 2):
+		t.Fatal("key 2 not handled")
+	}
+	handler.release <- true
+}
+
+func TestTimerLanes(t *testing.T) {
+	timer, err := NewLaneTimer([]TimerStorage{NewMemoryStorage(), NewMemoryStorage()}, time.Second, time.Second*10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Unix()
+	err = timer.push(1, broker.Always, now-5, "bulk", []byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = timer.push(0, broker.Always, now+5, "later", []byte("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lane, key, data, err := timer.pop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, lane, 1)
+	assert.Equal(t, key, "bulk")
+
+	err = timer.push(1, broker.Always, now-5, "bulk", []byte("c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = timer.push(0, broker.Always, now, "instant", []byte("d"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lane, key, data, err = timer.pop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, lane, 0)
+	assert.Equal(t, key, "instant")
+	assert.Equal(t, fmt.Sprintf("%s", data), "[d]")
+
+	existed, err := timer.delete("bulk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, existed, true)
+	wait, err := timer.NextWakeup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wait > time.Second*10 {
+		t.Fatalf("wait too long: %s", wait)
+	}
+}
+
+func TestTimerQuitDrain(t *testing.T) {
+	s := NewMemoryStorage()
+	timer, err := NewTimer(s, time.Second, time.Second*10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := &blockHandler{
+		keys:    make(chan string, 1),
+		release: make(chan bool),
+	}
+	go timer.Serve(handler)
+
+	err = timer.Push(Always, time.Now().Unix(), "1", []byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-handler.keys:
+	case <-time.After(time.Second * 2):
+		t.Fatal("key 1 not handled")
+	}
+
+	quit := make(chan bool)
+	go func() {
+		timer.Quit()
+		close(quit)
+	}()
+	select {
+	case <-quit:
+		t.Fatal("quit before running key acked")
+	case <-time.After(time.Second / 2):
+	}
+	handler.release <- true
+	select {
+	case <-quit:
+	case <-time.After(time.Second):
+		t.Fatal("quit not finished")
+	}
+	key, _, err := s.Peek("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, key.Count, 0)
+}
@@ -3,11 +3,14 @@ package formatter
 import (
 	"bytes"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"io/ioutil"
 	"os"
 	"reflect"
+	"sort"
 	"strings"
 	"text/template"
 	"unicode/utf8"
@@ -113,14 +116,33 @@ func NewTemplate(name string) *template.Template {
 		"trim": func(content string) string {
 			return strings.Trim(content, " \t\n\r")
 		},
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+		// unsubscribe returns the opt-out url of the recipient and
+		// category, or "" if not set by LocalTemplate.Funcs.
+		"unsubscribe": func(to interface{}, category string) string {
+			return ""
+		},
 	}
 	ret.Funcs(funcs)
 	return ret
 }
 
+// ControlVariant is the variant executing the template itself.
+const ControlVariant = "a"
+
 type LocalTemplate struct {
 	defaultLang string
 	templates   map[string]*template.Template
+	experiments map[string]experiment
+}
+
+type experiment struct {
+	variants []string
+	weights  []int
+	total    int
 }
 
 func NewLocalTemplate(path string, defaultLang string) (*LocalTemplate, error) {
@@ -135,6 +157,7 @@ func NewLocalTemplate(path string, defaultLang string) (*LocalTemplate, error) {
 	ret := &LocalTemplate{
 		defaultLang: strings.ToLower(defaultLang),
 		templates:   make(map[string]*template.Template),
+		experiments: make(map[string]experiment),
 	}
 	for _, i := range infos {
 		if i.Name()[0] == '.' {
@@ -183,6 +206,74 @@ func (l *LocalTemplate) Execute(wr io.Writer, lang, name string, data interface{
 	return t.ExecuteTemplate(wr, name, data)
 }
 
+// Funcs replaces functions of templates in all languages, like
+// "unsubscribe". It should be called before executing templates.
+func (l *LocalTemplate) Funcs(funcs template.FuncMap) {
+	for _, t := range l.templates {
+		t.Funcs(funcs)
+	}
+}
+
+// SetExperiment splits recipients of template name, like
+// "email/cross_invitation", to variants by weights. Variant b executes
+// template "email/cross_invitation@b", and ControlVariant executes name
+// itself. It should be called before executing templates.
+func (l *LocalTemplate) SetExperiment(name string, weights map[string]int) error {
+	var e experiment
+	for v, w := range weights {
+		if v == "" || strings.Contains(v, "@") {
+			return fmt.Errorf("invalid variant %q of %s", v, name)
+		}
+		if w < 0 {
+			return fmt.Errorf("invalid weight %d of %s@%s", w, name, v)
+		}
+		if w == 0 {
+			continue
+		}
+		e.variants = append(e.variants, v)
+	}
+	if len(e.variants) == 0 {
+		delete(l.experiments, name)
+		return nil
+	}
+	sort.Strings(e.variants)
+	for _, v := range e.variants {
+		e.weights = append(e.weights, weights[v])
+		e.total += weights[v]
+	}
+	l.experiments[name] = e
+	return nil
+}
+
+// Variant returns the template to execute for recipient key, and its
+// variant. The same key always gets the same variant of a template. Variant
+// is "" if name is not in experiment. If the chosen variant doesn't exist in
+// lang, it executes name as ControlVariant.
+func (l *LocalTemplate) Variant(lang, name, key string) (string, string) {
+	e, ok := l.experiments[name]
+	if !ok {
+		return name, ""
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	h.Write([]byte{0})
+	h.Write([]byte(key))
+	n := int(h.Sum32() % uint32(e.total))
+	variant := e.variants[len(e.variants)-1]
+	for i, w := range e.weights {
+		if n < w {
+			variant = e.variants[i]
+			break
+		}
+		n -= w
+	}
+	variantName := fmt.Sprintf("%s@%s", name, variant)
+	if l.IsExist(lang, variantName) {
+		return variantName, variant
+	}
+	return name, ControlVariant
+}
+
 func parseDirTemplate(t *template.Template, dir, name string) error {
 	f, err := os.Open(dir)
 	if err != nil {
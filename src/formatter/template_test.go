@@ -3,6 +3,7 @@ package formatter
 import (
 	"bytes"
 	"encoding/base64"
+	"fmt"
 	"github.com/stretchrcom/testify/assert"
 	"testing"
 )
@@ -146,6 +147,17 @@ func TestTemplatePlural(t *testing.T) {
 	assert.Equal(t, buf.String(), "isare")
 }
 
+func TestTemplateJson(t *testing.T) {
+	templ, err := NewTemplate("test").Parse(`{"text":{{json .}}}`)
+	if err != nil {
+		t.Fatalf("unexpect error: %s", err)
+	}
+	buf := bytes.NewBuffer(nil)
+	err = templ.Execute(buf, "say \"hi\"\n")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, buf.String(), `{"text":"say \"hi\"\n"}`)
+}
+
 func TestTemplateSub(t *testing.T) {
 	templ, err := NewTemplate("test").Parse(`{{sub . "a"}} {{sub . "b"}} {{sub . "a" "b"}} {{sub . "c" "b"}}`)
 	if err != nil {
@@ -199,3 +211,48 @@ func TestLocalTemplateExist(t *testing.T) {
 	assert.Equal(t, l.IsExist("en_US", "nonexist.template"), false)
 	assert.Equal(t, l.IsExist("en_CN", "nonexist.template"), false)
 }
+
+func TestLocalTemplateVariant(t *testing.T) {
+	l, err := NewLocalTemplate("./template_test", "en_US")
+	assert.Equal(t, err, nil)
+
+	name, variant := l.Variant("en_US", "test.template", "1")
+	assert.Equal(t, name, "test.template")
+	assert.Equal(t, variant, "")
+
+	assert.NotEqual(t, l.SetExperiment("test.template", map[string]int{"": 1}), nil)
+	assert.Equal(t, l.SetExperiment("test.template", map[string]int{"a": 1, "b": 1}), nil)
+	count := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("%d", i)
+		name, variant := l.Variant("en_US", "test.template", key)
+		count[variant]++
+		switch variant {
+		case "a":
+			assert.Equal(t, name, "test.template")
+		case "b":
+			assert.Equal(t, name, "test.template@b")
+		default:
+			t.Errorf("invalid variant %s", variant)
+		}
+		n, v := l.Variant("en_US", "test.template", key)
+		assert.Equal(t, n, name)
+		assert.Equal(t, v, variant)
+	}
+	assert.Equal(t, count["a"] > 400, true)
+	assert.Equal(t, count["b"] > 400, true)
+
+	buf := bytes.NewBuffer(nil)
+	l.Execute(buf, "en_US", "test.template@b", nil)
+	assert.Equal(t, buf.String(), "variant b\n")
+
+	// missing variant executes the template itself
+	assert.Equal(t, l.SetExperiment("test.template", map[string]int{"c": 1}), nil)
+	name, variant = l.Variant("en_US", "test.template", "1")
+	assert.Equal(t, name, "test.template")
+	assert.Equal(t, variant, ControlVariant)
+
+	assert.Equal(t, l.SetExperiment("test.template", nil), nil)
+	_, variant = l.Variant("en_US", "test.template", "1")
+	assert.Equal(t, variant, "")
+}
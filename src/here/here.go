@@ -62,6 +62,11 @@ func (h *Here) Serve() {
 	}
 }
 
+func (h *Here) Quit() {
+	h.tomb.Kill(nil)
+	h.tomb.Wait()
+}
+
 func (h *Here) UpdateChannel() chan Group {
 	return h.update
 }
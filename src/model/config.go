@@ -12,7 +12,8 @@ type Config struct {
 	TutorialBotUserIds []int64 `json:"tutorial_bot_user_ids"`
 	ServerCode         string  `json:"server_code"`
 
-	Debug bool `json:"debug"`
+	Debug                   bool `json:"debug"`
+	ShutdownTimeoutInSecond int  `json:"shutdown_timeout_in_second"`
 
 	DB struct {
 		Addr              string `json:"addr"`
@@ -33,6 +34,10 @@ type Config struct {
 		Db       int    `json:"db"`
 		Password string `json:"password"`
 	} `json:"redis_cache"`
+	PlatformCache struct {
+		Backend            string `json:"backend"`
+		WeatherTTLInSecond int    `json:"weather_ttl_in_second"`
+	} `json:"platform_cache"`
 	Email struct {
 		Host             string `json:"host"`
 		Username         string `json:"username"`
@@ -72,8 +77,18 @@ type Config struct {
 		} `json:"services"`
 	} `json:"exfe_service"`
 	ExfeQueue struct {
-		Addr string `json:"addr"`
-		Port uint   `json:"port"`
+		Addr  string `json:"addr"`
+		Port  uint   `json:"port"`
+		Retry struct {
+			MaxAttempts        int `json:"max_attempts"`
+			BackoffInSecond    int `json:"backoff_in_second"`
+			MaxBackoffInSecond int `json:"max_backoff_in_second"`
+		} `json:"retry"`
+		Dispatch struct {
+			Workers         int            `json:"workers"`
+			HostConcurrency int            `json:"host_concurrency"`
+			Hosts           map[string]int `json:"hosts"`
+		} `json:"dispatch"`
 	} `json:"exfe_queue"`
 	Wechat map[string]struct {
 		Addr     string `json:"addr"`
@@ -86,6 +101,11 @@ type Config struct {
 	Splitter struct {
 		SpeedOn map[string]int64 `json:"speed_on"`
 	}
+	Notifier struct {
+		DigestWindowInSecond map[string]int64          `json:"digest_window_in_second"`
+		Experiments          map[string]map[string]int `json:"experiments"`
+		UnsubscribeUrl       string                    `json:"unsubscribe_url"`
+	} `json:"notifier"`
 	Here struct {
 		Threshold       float64 `json:"threshold"`
 		SignThreshold   float64 `json:"sign_threshold"`
@@ -96,8 +116,14 @@ type Config struct {
 		TutorialDataFile map[string]string `json:"tutorial_data_file"`
 	}
 	Thirdpart struct {
-		MaxStateCache uint `json:"max_state_cache"`
-		Twitter       struct {
+		MaxStateCache  uint `json:"max_state_cache"`
+		CircuitBreaker struct {
+			Window           int     `json:"window"`
+			MinRequests      int     `json:"min_requests"`
+			FailureRate      float64 `json:"failure_rate"`
+			CooldownInSecond int     `json:"cooldown_in_second"`
+		} `json:"circuit_breaker"`
+		Twitter struct {
 			ClientToken  string `json:"client_token"`
 			ClientSecret string `json:"client_secret"`
 			AccessToken  string `json:"access_token"`
@@ -106,16 +132,29 @@ type Config struct {
 		} `json:"twitter"`
 		Apn struct {
 			Apps map[string]struct {
-				Cert   string `json:"cert"`
-				Key    string `json:"key"`
-				Server string `json:"server"`
-				RootCA string `json:"rootca"`
+				// Protocol is "binary"(default) with cert and key, or
+				// "http2" with auth_key(.p8), key_id and team_id.
+				Protocol string `json:"protocol"`
+				Cert     string `json:"cert"`
+				Key      string `json:"key"`
+				Server   string `json:"server"`
+				RootCA   string `json:"rootca"`
+				AuthKey  string `json:"auth_key"`
+				KeyId    string `json:"key_id"`
+				TeamId   string `json:"team_id"`
+				Topic    string `json:"topic"`
 			} `json:"apps"`
 			Default string `json:"default"`
 		} `json:"apn"`
 		Gcm struct {
 			Key string `json:"key"`
 		} `json:"gcm"`
+		// Fcm replaces gcm as Android poster if service_account is set.
+		Fcm struct {
+			ServiceAccount string `json:"service_account"`
+			Endpoint       string `json:"endpoint"`
+			TTLInSecond    int    `json:"ttl_in_second"`
+		} `json:"fcm"`
 		Sms struct {
 			AllToiMsg bool `json:"all_to_imsg"`
 			Twilio    struct {
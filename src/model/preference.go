@@ -0,0 +1,102 @@
+package model
+
+import (
+	"fmt"
+	"time"
+)
+
+// Preference is how a user or identity wants to be notified.
+type Preference struct {
+	// Muted maps provider to templates not sent with it. Provider or
+	// template "*" means all.
+	Muted      map[string][]string `json:"muted,omitempty"`
+	QuietHours *QuietHours         `json:"quiet_hours,omitempty"`
+	// Digest coalesces conversation posts in a window, and sends them as one
+	// cross_conversation_digest.
+	Digest bool `json:"digest,omitempty"`
+	// Unsubscribed are categories of notifications opted out by the
+	// identity, like "conversation". They are saved apart from the
+	// preference, and merged when it's found.
+	Unsubscribed []string `json:"unsubscribed,omitempty"`
+}
+
+// IsMuted returns true if template is not sent to provider.
+func (p Preference) IsMuted(provider, template string) bool {
+	for _, key := range []string{provider, "*"} {
+		for _, t := range p.Muted[key] {
+			if t == template || t == "*" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// IsUnsubscribed returns true if category is opted out.
+func (p Preference) IsUnsubscribed(category string) bool {
+	for _, c := range p.Unsubscribed {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
+
+// Unsubscribe opts out category.
+func (p *Preference) Unsubscribe(category string) {
+	if !p.IsUnsubscribed(category) {
+		p.Unsubscribed = append(p.Unsubscribed, category)
+	}
+}
+
+// QuietHours is a daily window in recipient's timezone, like "22:00" to
+// "08:00". Start is included and end is not.
+type QuietHours struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+func (q QuietHours) Validate() error {
+	if _, err := parseClock(q.Start); err != nil {
+		return err
+	}
+	if _, err := parseClock(q.End); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Until returns the end of the window if t is in quiet hours, in the
+// location of t.
+func (q QuietHours) Until(t time.Time) (time.Time, bool) {
+	start, err := parseClock(q.Start)
+	if err != nil {
+		return time.Time{}, false
+	}
+	end, err := parseClock(q.End)
+	if err != nil || start == end {
+		return time.Time{}, false
+	}
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	now := t.Sub(midnight)
+	switch {
+	case start < end && now >= start && now < end:
+		return midnight.Add(end), true
+	case start > end && now >= start:
+		return time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location()).Add(end), true
+	case start > end && now < end:
+		return midnight.Add(end), true
+	}
+	return time.Time{}, false
+}
+
+func parseClock(clock string) (time.Duration, error) {
+	var hour, minute int
+	if _, err := fmt.Sscanf(clock, "%d:%d", &hour, &minute); err != nil {
+		return 0, fmt.Errorf("invalid clock %q: %s", clock, err)
+	}
+	if hour < 0 || hour > 23 || minute < 0 || minute > 59 {
+		return 0, fmt.Errorf("invalid clock %q", clock)
+	}
+	return time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute, nil
+}
@@ -0,0 +1,65 @@
+package model
+
+import (
+	"github.com/stretchrcom/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestPreferenceMuted(t *testing.T) {
+	p := Preference{
+		Muted: map[string][]string{
+			"iOS": []string{"cross_conversation"},
+			"*":   []string{"cross_digest"},
+			"sms": []string{"*"},
+		},
+	}
+	assert.Equal(t, p.IsMuted("iOS", "cross_conversation"), true)
+	assert.Equal(t, p.IsMuted("Android", "cross_conversation"), false)
+	assert.Equal(t, p.IsMuted("email", "cross_digest"), true)
+	assert.Equal(t, p.IsMuted("sms", "cross_invitation"), true)
+	assert.Equal(t, p.IsMuted("email", "cross_invitation"), false)
+	assert.Equal(t, Preference{}.IsMuted("email", "cross_invitation"), false)
+}
+
+func TestPreferenceUnsubscribe(t *testing.T) {
+	var p Preference
+	assert.Equal(t, p.IsUnsubscribed("conversation"), false)
+	p.Unsubscribe("conversation")
+	p.Unsubscribe("conversation")
+	assert.Equal(t, p.IsUnsubscribed("conversation"), true)
+	assert.Equal(t, p.IsUnsubscribed("invitation"), false)
+	assert.Equal(t, p.Unsubscribed, []string{"conversation"})
+}
+
+func TestQuietHours(t *testing.T) {
+	loc := time.FixedZone("+08:00", 8*60*60)
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2013, 5, day, hour, minute, 0, 0, loc)
+	}
+	type test struct {
+		start, end string
+		now        time.Time
+		quiet      bool
+		until      time.Time
+	}
+	var tests = []test{
+		{"22:00", "08:00", at(1, 23, 30), true, at(2, 8, 0)},
+		{"22:00", "08:00", at(2, 7, 59), true, at(2, 8, 0)},
+		{"22:00", "08:00", at(2, 8, 0), false, time.Time{}},
+		{"22:00", "08:00", at(2, 21, 59), false, time.Time{}},
+		{"22:00", "08:00", at(2, 22, 0), true, at(3, 8, 0)},
+		{"12:30", "14:00", at(2, 13, 0), true, at(2, 14, 0)},
+		{"12:30", "14:00", at(2, 14, 0), false, time.Time{}},
+		{"12:30", "12:30", at(2, 12, 30), false, time.Time{}},
+		{"25:00", "08:00", at(2, 1, 0), false, time.Time{}},
+	}
+	for i, test := range tests {
+		q := QuietHours{test.start, test.end}
+		until, quiet := q.Until(test.now)
+		assert.Equal(t, quiet, test.quiet, "test %d", i)
+		assert.Equal(t, until.Unix(), test.until.Unix(), "test %d", i)
+	}
+	assert.NotEqual(t, QuietHours{"25:00", "08:00"}.Validate(), nil)
+	assert.Equal(t, QuietHours{"22:00", "08:00"}.Validate(), nil)
+}
@@ -6,6 +6,30 @@ import (
 	"strings"
 )
 
+// Named priorities of queue, from the highest. Items due at the same time are
+// dispatched in this order.
+const (
+	PriorityInstant = "instant"
+	PriorityNormal  = "normal"
+	PriorityBulk    = "bulk"
+)
+
+var Priorities = []string{PriorityInstant, PriorityNormal, PriorityBulk}
+
+// PriorityLane returns the index of priority in Priorities. Empty priority is
+// normal.
+func PriorityLane(priority string) (int, error) {
+	if priority == "" {
+		priority = PriorityNormal
+	}
+	for i, p := range Priorities {
+		if p == priority {
+			return i, nil
+		}
+	}
+	return -1, fmt.Errorf("invalid priority: %s", priority)
+}
+
 type QueuePush struct {
 	Service  string      `json:"service"`
 	Method   string      `json:"method"`
@@ -0,0 +1,29 @@
+package model
+
+import (
+	"testing"
+)
+
+func TestPriorityLane(t *testing.T) {
+	type test struct {
+		priority string
+		lane     int
+		ok       bool
+	}
+	var tests = []test{
+		{"instant", 0, true},
+		{"normal", 1, true},
+		{"", 1, true},
+		{"bulk", 2, true},
+		{"urgent", -1, false},
+	}
+	for _, test := range tests {
+		lane, err := PriorityLane(test.priority)
+		if (err == nil) != test.ok {
+			t.Errorf("priority %q error: %v", test.priority, err)
+		}
+		if lane != test.lane {
+			t.Errorf("priority %q got lane %d, expect %d", test.priority, lane, test.lane)
+		}
+	}
+}
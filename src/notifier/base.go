@@ -6,11 +6,19 @@ import (
 	"errors"
 	"fmt"
 	"formatter"
+	"github.com/googollee/go-rest"
 	"logger"
 	"model"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
 )
 
 var noneedSend = errors.New("no need send")
+var mutedSend = errors.New("muted by preference")
+var trippedSend = errors.New("provider tripped")
+var unsubscribedSend = errors.New("unsubscribed")
 
 func GenerateContent(localTemplate *formatter.LocalTemplate, template string, poster, lang string, arg interface{}) (string, error) {
 	templateName := fmt.Sprintf("%s/%s", poster, template)
@@ -31,21 +39,115 @@ func GenerateContent(localTemplate *formatter.LocalTemplate, template string, po
 	return ret.String(), nil
 }
 
+// variantOf returns the variant of template for the recipient in experiment,
+// like "cross_invitation@b". Recipients are split by identity id.
+func variantOf(localTemplate *formatter.LocalTemplate, template string, to model.Recipient) (string, string) {
+	prefix := fmt.Sprintf("%s/", to.Provider)
+	name, variant := localTemplate.Variant(to.Language, prefix+template, fmt.Sprintf("%d", to.IdentityID))
+	return strings.TrimPrefix(name, prefix), variant
+}
+
+var sending sync.WaitGroup
+
+// goSendAndSave runs SendAndSave in background, and Drain waits for it.
+func goSendAndSave(localTemplate *formatter.LocalTemplate, platform *broker.Platform, to *model.Recipient, crossId uint64, arg interface{}, template, failUrl string, failArg interface{}) {
+	sending.Add(1)
+	go func() {
+		defer sending.Done()
+		SendAndSave(localTemplate, platform, to, crossId, arg, template, failUrl, failArg)
+	}()
+}
+
+// sendOrDryRun sends in background and returns 202. If request has
+// dry_run=true, it returns texts of all fallbacks instead, without sending.
+func sendOrDryRun(ctx rest.Context, localTemplate *formatter.LocalTemplate, platform *broker.Platform, to *model.Recipient, crossId uint64, arg interface{}, template, failUrl string, failArg interface{}) {
+	if ctx.Request().URL.Query().Get("dry_run") == "true" {
+		ctx.Render(DryRun(localTemplate, *to, arg, template))
+		return
+	}
+	goSendAndSave(localTemplate, platform, to, crossId, arg, template, failUrl, failArg)
+	ctx.Return(http.StatusAccepted)
+}
+
+type DryRunText struct {
+	Provider         string `json:"provider"`
+	ExternalUsername string `json:"external_username"`
+	Language         string `json:"language"`
+	Variant          string `json:"variant,omitempty"`
+	Text             string `json:"text,omitempty"`
+	Error            string `json:"error,omitempty"`
+}
+
+// DryRun generates texts of template for the recipient and all fallbacks, in
+// the order SendAndSave tries them.
+func DryRun(localTemplate *formatter.LocalTemplate, to model.Recipient, arg interface{}, template string) []DryRunText {
+	var ret []DryRunText
+	for run := true; run; run = len(to.Fallbacks) > 0 {
+		fallback := to.PopRecipient()
+		variantTemplate, variant := variantOf(localTemplate, template, fallback)
+		text, err := GenerateContent(localTemplate, variantTemplate, fallback.Provider, fallback.Language, arg)
+		t := DryRunText{
+			Provider:         fallback.Provider,
+			ExternalUsername: fallback.ExternalUsername,
+			Language:         fallback.Language,
+			Variant:          variant,
+			Text:             text,
+		}
+		if err != nil {
+			t.Error = err.Error()
+		}
+		ret = append(ret, t)
+	}
+	return ret
+}
+
+// Drain waits for all sending started by notifiers.
+func Drain() {
+	sending.Wait()
+}
+
 // TODO: to是个指针有些过于精妙了。这个指针指向failArg里的to字段，在每次pop时会自动改变failArg里To字段的值，保证wait response的正确。
 //       由于interface{}也有可能传值，所以调用者传递failArg时，应该显式使用&保证传址而不是传值。
-func SendAndSave(localTemplate *formatter.LocalTemplate, platform *broker.Platform, to *model.Recipient, arg interface{}, template, failUrl string, failArg interface{}) {
+func SendAndSave(localTemplate *formatter.LocalTemplate, platform *broker.Platform, to *model.Recipient, crossId uint64, arg interface{}, template, failUrl string, failArg interface{}) {
 	var id string
 	var ontime int64
 	var defaultOk bool
+	preference := findPreference(*to)
+	if category := categoryOf(template); category != "" && preference.IsUnsubscribed(category) {
+		logger.DEBUG("notifier %s to %s unsubscribed %s", template, to, category)
+		addDelivery(*to, crossId, template, "", "", 0, unsubscribedSend)
+		return
+	}
+	if until, ok := quietUntil(preference, *to); ok {
+		logger.DEBUG("notifier %s to %s in quiet hours, delay to %s", template, to, until)
+		id := fmt.Sprintf("quiet.%d.%d", to.IdentityID, time.Now().UnixNano())
+		if err := response.PushQueue(id, failUrl, failArg, until.Unix()); err != nil {
+			logger.ERROR("delay %s to %s after quiet hours failed: %s", template, to, err)
+		}
+		return
+	}
 	needResponse := false
-	for run := true; run; run = len(to.Fallbacks) > 0 {
+	for step, run := 0, true; run; step, run = step+1, len(to.Fallbacks) > 0 {
 		fallback := to.PopRecipient()
-		text, err := GenerateContent(localTemplate, template, fallback.Provider, fallback.Language, arg)
+		if preference.IsMuted(fallback.Provider, template) {
+			logger.DEBUG("notifier %s to %s muted", template, fallback)
+			addDelivery(fallback, crossId, template, "", "", step, mutedSend)
+			continue
+		}
+		if len(to.Fallbacks) > 0 && platform.IsTripped(fallback.Provider) {
+			logger.INFO("notifier", fallback, template, "skip tripped provider")
+			addDelivery(fallback, crossId, template, "", "", step, trippedSend)
+			continue
+		}
+		variantTemplate, variant := variantOf(localTemplate, template, fallback)
+		text, err := batch.Generate(localTemplate, variantTemplate, fallback, arg)
 		if err != nil {
 			logger.ERROR("generate content failed: %s with %#v", err, arg)
+			addDelivery(fallback, crossId, template, variant, "", step, err)
 			continue
 		}
 		id, ontime, defaultOk, err = platform.Send(fallback, text)
+		addDelivery(fallback, crossId, template, variant, id, step, err)
 		if err != nil {
 			logger.INFO("notifier", id, template, fallback, "error", err)
 			if len(to.Fallbacks) == 0 {
@@ -0,0 +1,299 @@
+package notifier
+
+import (
+	"broker"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"formatter"
+	"model"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// batchWindow is how long a fan-out shares crosses and rendered texts. All
+// requests of a fan-out are pushed by splitter with the same ontime, so they
+// arrive in seconds.
+const batchWindow = 10 * time.Second
+
+// batchArg is implemented by args of fan-out notifications.
+type batchArg interface {
+	// batchKey returns the same key for args which only differ in fields of
+	// recipient, or "" if not batched. It includes what templates may check
+	// about the recipient, like rsvp status.
+	batchKey() string
+	// batchRecipient returns the recipient which templates see.
+	batchRecipient() model.Recipient
+}
+
+var batch = newBatchRenderer(batchWindow)
+
+const (
+	groupUnverified = iota
+	groupVerified
+	groupUnsubstitutable
+)
+
+type renderGroup struct {
+	sample model.Recipient
+	text   string
+	state  int
+	expire time.Time
+}
+
+// batchRenderer renders a template once per group of (template, provider,
+// language, timezone, batch key), then substitutes recipient fields for other
+// recipients in the group. The second recipient is rendered too, to verify
+// that the text only differs in those fields, otherwise the group is rendered
+// per recipient as before.
+type batchRenderer struct {
+	window  time.Duration
+	groups  map[string]*renderGroup
+	crosses map[string]*sharedCross
+	locker  sync.Mutex
+}
+
+type sharedCross struct {
+	cross  model.Cross
+	err    error
+	done   chan struct{}
+	expire time.Time
+}
+
+func newBatchRenderer(window time.Duration) *batchRenderer {
+	return &batchRenderer{
+		window:  window,
+		groups:  make(map[string]*renderGroup),
+		crosses: make(map[string]*sharedCross),
+	}
+}
+
+func (b *batchRenderer) Generate(localTemplate *formatter.LocalTemplate, template string, fallback model.Recipient, arg interface{}) (string, error) {
+	a, ok := arg.(batchArg)
+	if !ok || a.batchKey() == "" {
+		return GenerateContent(localTemplate, template, fallback.Provider, fallback.Language, arg)
+	}
+	to := a.batchRecipient()
+	key := fmt.Sprintf("%s|%s|%s|%s|%s", template, fallback.Provider, fallback.Language, to.Timezone, a.batchKey())
+
+	b.locker.Lock()
+	g := b.group(key)
+	var group renderGroup
+	if g != nil {
+		group = *g
+	}
+	b.locker.Unlock()
+
+	if g != nil && group.state == groupVerified {
+		if r, ok := substitution(group.sample, to, categoryOf(template)); ok {
+			return r.Replace(group.text), nil
+		}
+	}
+
+	ret, err := GenerateContent(localTemplate, template, fallback.Provider, fallback.Language, arg)
+	if err != nil {
+		return ret, err
+	}
+
+	b.locker.Lock()
+	defer b.locker.Unlock()
+
+	g = b.group(key)
+	if g == nil {
+		if _, ok := substitution(to, to, categoryOf(template)); ok {
+			b.sweep()
+			b.groups[key] = &renderGroup{
+				sample: to,
+				text:   ret,
+				expire: time.Now().Add(b.window),
+			}
+		}
+		return ret, nil
+	}
+	if g.state == groupUnverified && g.sample.Token != to.Token {
+		if r, ok := substitution(g.sample, to, categoryOf(template)); ok {
+			g.state = groupUnsubstitutable
+			if r.Replace(g.text) == ret {
+				g.state = groupVerified
+			}
+		}
+	}
+	return ret, nil
+}
+
+// FindCross returns the cross viewed by user userId. The cross is loaded once
+// without user and shared among requests of the same fan-out, requests
+// arriving while it is loading wait for the result. If the user isn't in the
+// exfee, the view of the user is loaded from platform as before.
+func (b *batchRenderer) FindCross(platform *broker.Platform, crossId, userId int64) (model.Cross, error) {
+	cross, err := b.sharedCross(platform, crossId)
+	if err == nil && cross.Exfee.FindUser(userId) != nil {
+		// updated info is relative to the user, templates of fan-out don't
+		// use it.
+		cross.Updated = nil
+		return cross, nil
+	}
+	query := make(url.Values)
+	query.Set("user_id", fmt.Sprintf("%d", userId))
+	return platform.FindCross(crossId, query)
+}
+
+func (b *batchRenderer) sharedCross(platform *broker.Platform, crossId int64) (model.Cross, error) {
+	key := fmt.Sprintf("%d", crossId)
+
+	b.locker.Lock()
+	c, ok := b.crosses[key]
+	if ok && time.Now().After(c.expire) {
+		delete(b.crosses, key)
+		ok = false
+	}
+	if !ok {
+		b.sweep()
+		c = &sharedCross{
+			done:   make(chan struct{}),
+			expire: time.Now().Add(b.window),
+		}
+		b.crosses[key] = c
+	}
+	b.locker.Unlock()
+
+	if ok {
+		<-c.done
+		return c.cross, c.err
+	}
+	c.cross, c.err = platform.FindCross(crossId, nil)
+	close(c.done)
+	if c.err != nil {
+		b.locker.Lock()
+		if b.crosses[key] == c {
+			delete(b.crosses, key)
+		}
+		b.locker.Unlock()
+	}
+	return c.cross, c.err
+}
+
+func (b *batchRenderer) group(key string) *renderGroup {
+	g, ok := b.groups[key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(g.expire) {
+		delete(b.groups, key)
+		return nil
+	}
+	return g
+}
+
+func (b *batchRenderer) sweep() {
+	now := time.Now()
+	for k, g := range b.groups {
+		if now.After(g.expire) {
+			delete(b.groups, k)
+		}
+	}
+	for k, c := range b.crosses {
+		select {
+		case <-c.done:
+			if now.After(c.expire) {
+				delete(b.crosses, k)
+			}
+		default:
+		}
+	}
+}
+
+// minSubstitution is the shortest field to substitute, shorter ones may
+// match other parts of the text.
+const minSubstitution = 4
+
+// substitution returns the replacer of recipient fields from one recipient to
+// another, or false if fields can't be substituted safely. Unsubscribe urls of
+// category are substituted too, if they are set.
+func substitution(from, to model.Recipient, category string) (*strings.Replacer, bool) {
+	fields := [][2]string{
+		{from.Token, to.Token},
+		{from.Name, to.Name},
+		{from.ExternalUsername, to.ExternalUsername},
+		{from.ExternalID, to.ExternalID},
+	}
+	if category != "" {
+		fromUrl, toUrl := unsubscribeUrl(from, category), unsubscribeUrl(to, category)
+		if fromUrl != "" || toUrl != "" {
+			fields = append(fields, [2]string{fromUrl, toUrl})
+		}
+	}
+	seen := make(map[string]string)
+	for _, f := range fields {
+		if len(f[0]) < minSubstitution || len(f[1]) < minSubstitution {
+			return nil, false
+		}
+		if to, ok := seen[f[0]]; ok {
+			if to != f[1] {
+				return nil, false
+			}
+			continue
+		}
+		seen[f[0]] = f[1]
+	}
+	// longer first, so a field containing another, like name in username,
+	// is replaced as a whole.
+	olds := make([]string, 0, len(seen))
+	for old := range seen {
+		olds = append(olds, old)
+	}
+	sort.Sort(byLength(olds))
+	pairs := make([]string, 0, len(olds)*2)
+	for _, old := range olds {
+		pairs = append(pairs, old, seen[old])
+	}
+	return strings.NewReplacer(pairs...), true
+}
+
+type byLength []string
+
+func (s byLength) Len() int {
+	return len(s)
+}
+
+func (s byLength) Less(i, j int) bool {
+	if len(s[i]) != len(s[j]) {
+		return len(s[i]) > len(s[j])
+	}
+	return s[i] < s[j]
+}
+
+func (s byLength) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+// recipientShape is what templates may check about the recipient in a cross:
+// the rsvp of the recipient, and whether the recipient did the change.
+func recipientShape(cross model.Cross, to model.Recipient, bys ...model.Identity) string {
+	invitation := "-"
+	if i := cross.Exfee.FindUser(to.UserID); i != nil {
+		invitation = fmt.Sprintf("%s/%v/%d", i.Response, i.Host, i.Mates)
+	}
+	isBy := false
+	for i := range bys {
+		if to.SameUser(&bys[i]) {
+			isBy = true
+			break
+		}
+	}
+	return fmt.Sprintf("%s|%v", invitation, isBy)
+}
+
+// contentHash returns the hash of v in json, or "" if failed.
+func contentHash(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	h := sha1.New()
+	h.Write(b)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
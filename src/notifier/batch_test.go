@@ -0,0 +1,126 @@
+package notifier
+
+import (
+	"broker"
+	"fmt"
+	"formatter"
+	"github.com/stretchrcom/testify/assert"
+	"model"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type testBatchArg struct {
+	To    model.Recipient
+	Title string
+}
+
+func (a testBatchArg) batchKey() string {
+	return a.Title
+}
+
+func (a testBatchArg) batchRecipient() model.Recipient {
+	return a.To
+}
+
+func testRecipient(name, token string) model.Recipient {
+	return model.Recipient{
+		Name:             name,
+		Token:            token,
+		Provider:         "iOS",
+		Language:         "en_US",
+		ExternalID:       name + "-device",
+		ExternalUsername: name + "-device",
+	}
+}
+
+func TestBatchRender(t *testing.T) {
+	l, err := formatter.NewLocalTemplate("./batch_test", "en_US")
+	assert.Equal(t, err, nil)
+	b := newBatchRenderer(time.Minute)
+
+	names := []string{"alice", "bobby", "carol", "david"}
+	for i, name := range names {
+		to := testRecipient(name, "token0123456789"+name)
+		text, err := b.Generate(l, "batch_plain", to, testBatchArg{to, "Dinner"})
+		assert.Equal(t, err, nil)
+		assert.Equal(t, text, "Dinner for "+name+": http://exfe.com/#!token=token0123456789"+name, "recipient %d", i)
+	}
+	assert.Equal(t, len(b.groups), 1)
+	for _, g := range b.groups {
+		assert.Equal(t, g.state, groupVerified)
+	}
+
+	// other group
+	to := testRecipient("alice", "token0123456789alice")
+	text, err := b.Generate(l, "batch_plain", to, testBatchArg{to, "Lunch"})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, text, "Lunch for alice: http://exfe.com/#!token=token0123456789alice")
+	assert.Equal(t, len(b.groups), 2)
+}
+
+func TestBatchRenderUnsubstitutable(t *testing.T) {
+	l, err := formatter.NewLocalTemplate("./batch_test", "en_US")
+	assert.Equal(t, err, nil)
+	b := newBatchRenderer(time.Minute)
+
+	tokens := map[string]string{
+		"alice": "0abcdefghij",
+		"bobby": "1klmnopqrst",
+		"carol": "2uvwxyzabcd",
+	}
+	for _, name := range []string{"alice", "bobby", "carol"} {
+		to := testRecipient(name, tokens[name])
+		text, err := b.Generate(l, "batch_derived", to, testBatchArg{to, "Dinner"})
+		assert.Equal(t, err, nil)
+		assert.Equal(t, text, "Dinner for "+name+": http://exfe.com/#!"+tokens[name][1:5])
+	}
+	for _, g := range b.groups {
+		assert.Equal(t, g.state, groupUnsubstitutable)
+	}
+}
+
+func TestSubstitution(t *testing.T) {
+	alice := testRecipient("alice", "token0123456789alice")
+	bobby := testRecipient("bobby", "token0123456789bobby")
+
+	r, ok := substitution(alice, bobby, "")
+	assert.Equal(t, ok, true)
+	assert.Equal(t, r.Replace("alice alice-device token0123456789alice"), "bobby bobby-device token0123456789bobby")
+
+	short := testRecipient("al", "token0123456789al")
+	_, ok = substitution(alice, short, "")
+	assert.Equal(t, ok, false)
+	_, ok = substitution(short, alice, "")
+	assert.Equal(t, ok, false)
+}
+
+func TestBatchFindCross(t *testing.T) {
+	var users []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := r.URL.Query().Get("user_id")
+		users = append(users, user)
+		fmt.Fprintf(w, `{"data":{"id":123,"title":"view of %s","exfee":{"invitations":[{"identity":{"connected_user_id":1}},{"identity":{"connected_user_id":2}}]}}}`, user)
+	}))
+	defer server.Close()
+
+	var config model.Config
+	config.SiteApi = server.URL
+	platform, err := broker.NewPlatform(&config)
+	assert.Equal(t, err, nil)
+	b := newBatchRenderer(time.Minute)
+
+	for _, user := range []int64{1, 2, 1} {
+		cross, err := b.FindCross(platform, 123, user)
+		assert.Equal(t, err, nil)
+		assert.Equal(t, cross.Title, "view of ")
+	}
+	assert.Equal(t, users, []string{""})
+
+	cross, err := b.FindCross(platform, 123, 3)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, cross.Title, "view of 3")
+	assert.Equal(t, users, []string{"", "3"})
+}
@@ -10,19 +10,21 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 )
 
 type Cross struct {
 	rest.Service `prefix:"/v3/notifier/cross"`
 
-	digest           rest.SimpleNode `route:"/digest" method:"POST"`
-	remind           rest.SimpleNode `route:"/remind" method:"POST"`
-	invitation       rest.SimpleNode `route:"/invitation" method:"POST"`
-	join             rest.SimpleNode `route:"/join" method:"POST"`
-	preview          rest.SimpleNode `route:"/preview" method:"POST"`
-	update           rest.SimpleNode `route:"/update" method:"POST"`
-	updateInvitation rest.SimpleNode `route:"/update_invitation" method:"POST"`
-	conversation     rest.SimpleNode `route:"/conversation" method:"POST"`
+	digest             rest.SimpleNode `route:"/digest" method:"POST"`
+	remind             rest.SimpleNode `route:"/remind" method:"POST"`
+	invitation         rest.SimpleNode `route:"/invitation" method:"POST"`
+	join               rest.SimpleNode `route:"/join" method:"POST"`
+	preview            rest.SimpleNode `route:"/preview" method:"POST"`
+	update             rest.SimpleNode `route:"/update" method:"POST"`
+	updateInvitation   rest.SimpleNode `route:"/update_invitation" method:"POST"`
+	conversation       rest.SimpleNode `route:"/conversation" method:"POST"`
+	conversationDigest rest.SimpleNode `route:"/conversation_digest" method:"POST"`
 
 	localTemplate *formatter.LocalTemplate
 	config        *model.Config
@@ -93,8 +95,7 @@ func (c Cross) Digest(ctx rest.Context, requests []model.CrossDigestRequest) {
 		"WeatherIcon":        weatherIcon,
 	}
 
-	go SendAndSave(c.localTemplate, c.platform, to, arg, "cross_digest", c.domain+"/v3/notifier/cross/digest", &failArg)
-	ctx.Return(http.StatusAccepted)
+	sendOrDryRun(ctx, c.localTemplate, c.platform, to, cross.ID, arg, "cross_digest", c.domain+"/v3/notifier/cross/digest", &failArg)
 }
 
 func (c Cross) Remind(ctx rest.Context, requests []model.CrossDigestRequest) {
@@ -133,8 +134,7 @@ func (c Cross) Remind(ctx rest.Context, requests []model.CrossDigestRequest) {
 		"Config":      c.config,
 		"WeatherIcon": weatherIcon,
 	}
-	go SendAndSave(c.localTemplate, c.platform, to, arg, "cross_remind", c.domain+"/v3/notifier/cross/remind", &failArg)
-	ctx.Return(http.StatusAccepted)
+	sendOrDryRun(ctx, c.localTemplate, c.platform, to, cross.ID, arg, "cross_remind", c.domain+"/v3/notifier/cross/remind", &failArg)
 }
 
 type InvitationArg struct {
@@ -154,9 +154,7 @@ func (a InvitationArg) String() string {
 func (a *InvitationArg) Parse(config *model.Config, platform *broker.Platform) (err error) {
 	a.Config = config
 
-	query := make(url.Values)
-	query.Set("user_id", fmt.Sprintf("%d", a.To.UserID))
-	cross, err := platform.FindCross(a.CrossId, query)
+	cross, err := batch.FindCross(platform, a.CrossId, a.To.UserID)
 	if err != nil {
 		return err
 	}
@@ -175,6 +173,14 @@ func (a *InvitationArg) Parse(config *model.Config, platform *broker.Platform) (
 	return nil
 }
 
+func (a InvitationArg) batchKey() string {
+	return fmt.Sprintf("%d|%d|%s", a.Cross.ID, a.By.ID, recipientShape(a.Cross, a.To, a.By))
+}
+
+func (a InvitationArg) batchRecipient() model.Recipient {
+	return a.To
+}
+
 func (a InvitationArg) ToIn(invitations []model.Invitation) bool {
 	for _, i := range invitations {
 		if a.To.SameUser(&i.Identity) {
@@ -237,8 +243,7 @@ func (c Cross) Invitation(ctx rest.Context, invitation InvitationArg) {
 	}
 	to := &invitation.To
 
-	go SendAndSave(c.localTemplate, c.platform, to, invitation, "cross_invitation", c.domain+"/v3/notifier/cross/invitation", &invitation)
-	ctx.Return(http.StatusAccepted)
+	sendOrDryRun(ctx, c.localTemplate, c.platform, to, invitation.Cross.ID, invitation, "cross_invitation", c.domain+"/v3/notifier/cross/invitation", &invitation)
 }
 
 type JoinArg struct {
@@ -283,8 +288,7 @@ func (c Cross) Join(ctx rest.Context, arg JoinArg) {
 	}
 	to := &arg.To
 
-	go SendAndSave(c.localTemplate, c.platform, to, arg, "cross_join", c.domain+"/v3/notifier/cross/arg", &arg)
-	ctx.Return(http.StatusAccepted)
+	sendOrDryRun(ctx, c.localTemplate, c.platform, to, arg.Cross.ID, arg, "cross_join", c.domain+"/v3/notifier/cross/join", &arg)
 }
 
 func (c Cross) Preview(ctx rest.Context, invitation InvitationArg) {
@@ -294,8 +298,7 @@ func (c Cross) Preview(ctx rest.Context, invitation InvitationArg) {
 	}
 	to := &invitation.To
 
-	go SendAndSave(c.localTemplate, c.platform, to, invitation, "cross_preview", c.domain+"/v3/notifier/cross/preview", &invitation)
-	ctx.Return(http.StatusAccepted)
+	sendOrDryRun(ctx, c.localTemplate, c.platform, to, invitation.Cross.ID, invitation, "cross_preview", c.domain+"/v3/notifier/cross/preview", &invitation)
 }
 
 func (c Cross) Update(ctx rest.Context, updates []model.CrossUpdate) {
@@ -325,8 +328,14 @@ func (c Cross) Update(ctx rest.Context, updates []model.CrossUpdate) {
 	failArg[0].OldCross = updates[0].OldCross
 	to = &failArg[0].To
 
-	go SendAndSave(c.localTemplate, c.platform, to, arg, "cross_update", c.domain+"/v3/notifier/cross/update", &failArg)
-	ctx.Return(http.StatusAccepted)
+	contents := make([]model.CrossUpdate, len(updates))
+	for i, update := range updates {
+		update.To = model.Recipient{}
+		contents[i] = update
+	}
+	arg.batch = contentHash(contents)
+
+	sendOrDryRun(ctx, c.localTemplate, c.platform, to, arg.Cross.ID, arg, "cross_update", c.domain+"/v3/notifier/cross/update", &failArg)
 }
 
 type UpdateInvitationArg struct {
@@ -375,8 +384,7 @@ func (c Cross) UpdateInvitation(ctx rest.Context, arg UpdateInvitationArg) {
 
 	to := &arg.To
 
-	go SendAndSave(c.localTemplate, c.platform, to, arg, "cross_update_invitation", c.domain+"/v3/notifier/cross/update_invitation", &arg)
-	ctx.Return(http.StatusAccepted)
+	sendOrDryRun(ctx, c.localTemplate, c.platform, to, arg.Cross.ID, arg, "cross_update_invitation", c.domain+"/v3/notifier/cross/update_invitation", &arg)
 }
 
 func (c Cross) Conversation(ctx rest.Context, updates []model.ConversationUpdate) {
@@ -386,6 +394,12 @@ func (c Cross) Conversation(ctx rest.Context, updates []model.ConversationUpdate
 		ctx.Return(http.StatusBadRequest, err)
 		return
 	}
+	contents := make([]model.ConversationUpdate, len(updates))
+	for i, update := range updates {
+		update.To = model.Recipient{}
+		contents[i] = update
+	}
+	arg.batch = contentHash(contents)
 	needSend := false
 	to := &failArg[0].To
 	for _, update := range updates {
@@ -399,6 +413,15 @@ func (c Cross) Conversation(ctx rest.Context, updates []model.ConversationUpdate
 		return
 	}
 
+	if ctx.Request().URL.Query().Get("dry_run") != "true" && findPreference(*to).Digest {
+		err := pushDigest(c.config, c.domain+"/v3/notifier/cross/conversation_digest", updates)
+		if err == nil {
+			ctx.Return(http.StatusAccepted)
+			return
+		}
+		logger.ERROR("push digest of %s failed, send directly: %s", to, err)
+	}
+
 	oldPosts, err := c.platform.GetConversation(arg.Cross.Exfee.ID, arg.Posts[0].CreatedAt, false, "older", 2)
 	if err != nil {
 		logger.ERROR("get conversation error: %s", err)
@@ -408,8 +431,32 @@ func (c Cross) Conversation(ctx rest.Context, updates []model.ConversationUpdate
 		}
 	}
 
-	go SendAndSave(c.localTemplate, c.platform, to, arg, "cross_conversation", c.domain+"/v3/notifier/cross/conversation", &failArg)
-	ctx.Return(http.StatusAccepted)
+	sendOrDryRun(ctx, c.localTemplate, c.platform, to, arg.Cross.ID, arg, "cross_conversation", c.domain+"/v3/notifier/cross/conversation", &failArg)
+}
+
+// ConversationDigest sends conversation updates accumulated in digest window,
+// as "N new messages from A, B, C".
+func (c Cross) ConversationDigest(ctx rest.Context, updates []model.ConversationUpdate) {
+	failArg := updates
+	arg, err := ArgFromConversations(updates, c.config, c.platform)
+	if err != nil {
+		ctx.Return(http.StatusBadRequest, err)
+		return
+	}
+	to := &failArg[0].To
+	var posts []*model.Post
+	for _, post := range arg.Posts {
+		if !to.SameUser(&post.By) {
+			posts = append(posts, post)
+		}
+	}
+	if len(posts) == 0 {
+		logger.DEBUG("not send with all self updates: %s", to)
+		return
+	}
+	arg.Posts = posts
+
+	sendOrDryRun(ctx, c.localTemplate, c.platform, to, arg.Cross.ID, arg, "cross_conversation_digest", c.domain+"/v3/notifier/cross/conversation_digest", &failArg)
 }
 
 type ConversationArg struct {
@@ -417,6 +464,8 @@ type ConversationArg struct {
 	Cross    model.Cross
 	OldPosts []model.Post
 	Posts    []*model.Post
+
+	batch string
 }
 
 func ArgFromConversations(updates []model.ConversationUpdate, config *model.Config, platform *broker.Platform) (*ConversationArg, error) {
@@ -436,9 +485,7 @@ func ArgFromConversations(updates []model.ConversationUpdate, config *model.Conf
 
 	crossId := updates[0].CrossId
 
-	query := make(url.Values)
-	query.Set("user_id", fmt.Sprintf("%d", to.UserID))
-	cross, err := platform.FindCross(crossId, query)
+	cross, err := batch.FindCross(platform, crossId, to.UserID)
 	if err != nil {
 		return nil, err
 	}
@@ -484,10 +531,34 @@ func (a ConversationArg) Bys() []*model.Identity {
 	return ret
 }
 
+// ByNames returns names of posters, like "A, B, C".
+func (a ConversationArg) ByNames() string {
+	var names []string
+	for _, by := range a.Bys() {
+		names = append(names, by.Name)
+	}
+	return strings.Join(names, ", ")
+}
+
 func (a ConversationArg) HasMany() bool {
 	return len(a.Posts) > 1
 }
 
+func (a ConversationArg) batchKey() string {
+	if a.batch == "" {
+		return ""
+	}
+	bys := make([]model.Identity, len(a.Posts))
+	for i, post := range a.Posts {
+		bys[i] = post.By
+	}
+	return fmt.Sprintf("%s|%s", a.batch, recipientShape(a.Cross, a.To, bys...))
+}
+
+func (a ConversationArg) batchRecipient() model.Recipient {
+	return a.To
+}
+
 func in(id *model.Invitation, ids []model.Invitation) bool {
 	for _, i := range ids {
 		if id.Identity.SameUser(i.Identity) {
@@ -514,6 +585,8 @@ type UpdateArg struct {
 	OldAccepted []model.Identity `json:"-"`
 	NewDeclined []model.Identity `json:"-"`
 	NewPending  []model.Identity `json:"-"`
+
+	batch string
 }
 
 func updateFromUpdates(updates []model.CrossUpdate, config *model.Config) (*UpdateArg, error) {
@@ -606,6 +679,17 @@ Bys:
 	return ret, nil
 }
 
+func (a *UpdateArg) batchKey() string {
+	if a.batch == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s|%s", a.batch, recipientShape(a.Cross, a.To, a.Bys...))
+}
+
+func (a *UpdateArg) batchRecipient() model.Recipient {
+	return a.To
+}
+
 func (a *UpdateArg) NeedShowBy() bool {
 	return true
 }
@@ -0,0 +1,92 @@
+package notifier
+
+import (
+	"broker"
+	"github.com/googollee/go-rest"
+	"logger"
+	"model"
+	"net/http"
+	"thirdpart"
+)
+
+var deliveryLog *broker.DeliveryLog
+
+// SetupDelivery makes SendAndSave write every attempt to log. Without it,
+// attempts are only logged.
+func SetupDelivery(log *broker.DeliveryLog) {
+	deliveryLog = log
+}
+
+func addDelivery(to model.Recipient, crossId uint64, template, variant, messageId string, step int, err error) {
+	if deliveryLog == nil {
+		return
+	}
+	d := broker.Delivery{
+		IdentityId:       to.IdentityID,
+		UserId:           to.UserID,
+		CrossId:          crossId,
+		Provider:         to.Provider,
+		ExternalUsername: to.ExternalUsername,
+		Template:         template,
+		Variant:          variant,
+		MessageId:        messageId,
+		Step:             step,
+		Status:           broker.DeliverySent,
+	}
+	if err != nil {
+		d.Status, d.Error = broker.DeliveryFailed, err.Error()
+	}
+	if _, err := deliveryLog.Add(d); err != nil {
+		logger.ERROR("save delivery %s to %s failed: %s", template, to, err)
+	}
+}
+
+func deliveryResult(resp thirdpart.PostResponse) {
+	if deliveryLog == nil {
+		return
+	}
+	if _, err := deliveryLog.Result(resp.Id, resp.Ok, resp.Error); err != nil {
+		logger.ERROR("save delivery result of %s failed: %s", resp.Id, err)
+	}
+}
+
+type Delivery struct {
+	rest.Service `prefix:"/v3/notifier/deliveries"`
+
+	find rest.SimpleNode `route:"" method:"GET"`
+
+	log *broker.DeliveryLog
+}
+
+func NewDelivery(log *broker.DeliveryLog) *Delivery {
+	return &Delivery{
+		log: log,
+	}
+}
+
+// Find returns deliveries to the identity or of the cross, newest first.
+func (d Delivery) Find(ctx rest.Context) {
+	var identityId int64
+	var crossId uint64
+	var limit int
+	ctx.Bind("identity_id", &identityId)
+	ctx.Bind("cross_id", &crossId)
+	ctx.Bind("limit", &limit)
+	if err := ctx.BindError(); err != nil {
+		ctx.Return(http.StatusBadRequest, err)
+		return
+	}
+	if identityId == 0 && crossId == 0 {
+		ctx.Return(http.StatusBadRequest, "need identity_id or cross_id")
+		return
+	}
+	if limit <= 0 {
+		limit = 50
+	}
+	ret, err := d.log.Find(identityId, crossId, limit)
+	if err != nil {
+		ctx.Return(http.StatusInternalServerError, err)
+		return
+	}
+	ctx.Render(ret)
+}
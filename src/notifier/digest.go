@@ -0,0 +1,65 @@
+package notifier
+
+import (
+	"broker"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"logger"
+	"model"
+	"time"
+)
+
+// digestWindows are default windows of conversation digest by provider. Push
+// is expected soon, and email can wait longer.
+var digestWindows = map[string]time.Duration{
+	"iOS":     5 * time.Minute,
+	"Android": 5 * time.Minute,
+	"email":   time.Hour,
+}
+
+const defaultDigestWindow = 5 * time.Minute
+
+// digestWindow returns how long conversation posts to provider accumulate
+// before sent as a digest. Windows in config override defaults.
+func digestWindow(config *model.Config, provider string) time.Duration {
+	if s, ok := config.Notifier.DigestWindowInSecond[provider]; ok && s > 0 {
+		return time.Duration(s) * time.Second
+	}
+	if w, ok := digestWindows[provider]; ok {
+		return w
+	}
+	return defaultDigestWindow
+}
+
+// digestMergeKey merges updates of a cross to the same recipient.
+func digestMergeKey(to model.Recipient, crossId int64) string {
+	key := fmt.Sprintf("digest.%d_%s@%s", crossId, to.ExternalUsername, to.Provider)
+	return base64.URLEncoding.EncodeToString([]byte(key))
+}
+
+// pushDigest pushes updates to queue one by one, so they are merged with
+// updates pushed before. The first push sets when the digest is sent, and
+// later ones don't postpone it.
+func pushDigest(config *model.Config, u string, updates []model.ConversationUpdate) error {
+	if len(updates) == 0 {
+		return nil
+	}
+	to := updates[0].To
+	ontime := time.Now().Add(digestWindow(config, to.Provider)).Unix()
+	queueUrl := fmt.Sprintf("http://%s:%d/v3/queue/%s/POST/%s?ontime=%d&update=once",
+		config.ExfeQueue.Addr, config.ExfeQueue.Port, digestMergeKey(to, updates[0].CrossId), base64.URLEncoding.EncodeToString([]byte(u)), ontime)
+	for _, update := range updates {
+		b, err := json.Marshal(update)
+		if err != nil {
+			return err
+		}
+		resp, err := broker.HttpResponse(broker.Http("POST", queueUrl, "text/plain", b))
+		if err != nil {
+			return err
+		}
+		resp.Close()
+	}
+	logger.INFO("notifier", to, "digest", len(updates), "until", ontime)
+	return nil
+}
@@ -0,0 +1,70 @@
+package notifier
+
+import (
+	"formatter"
+	"github.com/stretchrcom/testify/assert"
+	"model"
+	"testing"
+	"thirdpart"
+	"time"
+)
+
+func TestDigestWindow(t *testing.T) {
+	var config model.Config
+	assert.Equal(t, digestWindow(&config, "iOS"), 5*time.Minute)
+	assert.Equal(t, digestWindow(&config, "email"), time.Hour)
+	assert.Equal(t, digestWindow(&config, "twitter"), defaultDigestWindow)
+
+	config.Notifier.DigestWindowInSecond = map[string]int64{"email": 600}
+	assert.Equal(t, digestWindow(&config, "email"), 10*time.Minute)
+	assert.Equal(t, digestWindow(&config, "Android"), 5*time.Minute)
+}
+
+func TestConversationDigestText(t *testing.T) {
+	l, err := formatter.NewLocalTemplate("../../templates", "en_US")
+	assert.Equal(t, err, nil)
+
+	alice := model.Identity{ID: 11, UserID: 1, Name: "alice", Provider: "email", ExternalID: "alice@exfe.com", ExternalUsername: "alice@exfe.com"}
+	bobby := model.Identity{ID: 12, UserID: 2, Name: "bobby", Provider: "email", ExternalID: "bobby@exfe.com", ExternalUsername: "bobby@exfe.com"}
+	var config model.Config
+	config.SiteUrl = "http://exfe.com"
+	arg := ConversationArg{
+		Cross: model.Cross{Title: "Dinner"},
+		Posts: []*model.Post{
+			&model.Post{By: alice, Content: "hi"},
+			&model.Post{By: bobby, Content: "hello"},
+			&model.Post{By: alice, Content: "7pm?"},
+		},
+	}
+	arg.To = model.Recipient{Token: "token", Provider: "phone", Language: "en_US"}
+	arg.Parse(&config)
+	assert.Equal(t, arg.ByNames(), "alice, bobby")
+
+	text, err := GenerateContent(l, "cross_conversation_digest", "_default", "en_US", arg)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, text, `3 new messages from alice, bobby in "Dinner". http://exfe.com/#!token=token`)
+
+	arg.Posts = arg.Posts[:1]
+	text, err = GenerateContent(l, "cross_conversation_digest", "_default", "en_US", arg)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, text, `1 new message from alice in "Dinner". http://exfe.com/#!token=token`)
+
+	arg.Cross.ID = 123
+	arg.Config.ServerCode = "exfe"
+	text, err = GenerateContent(l, "cross_conversation_digest", "iOS", "en_US", arg)
+	assert.Equal(t, err, nil)
+	push, err := thirdpart.ParsePush(text)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, push, thirdpart.Push{
+		Text:     `1 new message from alice in "Dinner".`,
+		Title:    "Dinner",
+		Badge:    1,
+		Sound:    "default",
+		Category: "conversation",
+		ThreadId: "123",
+		Data: map[string]interface{}{
+			"url":  "exfe://exfe/!123/conversation",
+			"path": "/!123/conversation",
+		},
+	})
+}
@@ -0,0 +1,146 @@
+package notifier
+
+import (
+	"broker"
+	"github.com/googollee/go-rest"
+	"logger"
+	"model"
+	"net/http"
+	"time"
+)
+
+var preferences *broker.PreferenceSaver
+
+// SetupPreference makes SendAndSave follow preferences in saver.
+func SetupPreference(saver *broker.PreferenceSaver) {
+	preferences = saver
+}
+
+func findPreference(to model.Recipient) model.Preference {
+	if preferences == nil {
+		return model.Preference{}
+	}
+	ret, _, err := preferences.Find(to.UserID, to.IdentityID)
+	if err != nil {
+		logger.ERROR("load preference of %s failed: %s", to, err)
+	}
+	return ret
+}
+
+// quietUntil returns the end of quiet hours in recipient's timezone, or false
+// if not in quiet hours now.
+func quietUntil(p model.Preference, to model.Recipient) (time.Time, bool) {
+	if p.QuietHours == nil || to.Timezone == "" {
+		return time.Time{}, false
+	}
+	loc, err := model.LoadLocation(to.Timezone)
+	if err != nil {
+		logger.ERROR("invalid timezone of %s: %s", to, to.Timezone)
+		return time.Time{}, false
+	}
+	return p.QuietHours.Until(time.Now().In(loc))
+}
+
+type Preference struct {
+	rest.Service `prefix:"/v3/notifier/preferences"`
+
+	get    rest.SimpleNode `route:"/:kind/:id" method:"GET"`
+	set    rest.SimpleNode `route:"/:kind/:id" method:"POST"`
+	remove rest.SimpleNode `route:"/:kind/:id" method:"DELETE"`
+
+	saver *broker.PreferenceSaver
+}
+
+func NewPreference(saver *broker.PreferenceSaver) *Preference {
+	return &Preference{
+		saver: saver,
+	}
+}
+
+// Get returns the preference of user or identity, like /user/123 or
+// /identity/456. The preference of identity has categories it unsubscribed.
+func (p Preference) Get(ctx rest.Context) {
+	field, identityId, ok := p.field(ctx)
+	if !ok {
+		return
+	}
+	ret, ok, err := p.saver.Load(field)
+	if err != nil {
+		ctx.Return(http.StatusInternalServerError, err)
+		return
+	}
+	if identityId != 0 {
+		unsubscribed, err := p.saver.Unsubscribed(identityId)
+		if err != nil {
+			ctx.Return(http.StatusInternalServerError, err)
+			return
+		}
+		for _, category := range unsubscribed {
+			ret.Unsubscribe(category)
+		}
+		ok = ok || len(unsubscribed) > 0
+	}
+	if !ok {
+		ctx.Return(http.StatusNotFound, "no preference of %s", field)
+		return
+	}
+	ctx.Render(ret)
+}
+
+// Set saves the preference of user or identity. Unsubscribed in it is
+// ignored, categories are only opted out with unsubscribe links.
+func (p Preference) Set(ctx rest.Context, preference model.Preference) {
+	field, _, ok := p.field(ctx)
+	if !ok {
+		return
+	}
+	preference.Unsubscribed = nil
+	if preference.QuietHours != nil {
+		if err := preference.QuietHours.Validate(); err != nil {
+			ctx.Return(http.StatusBadRequest, err)
+			return
+		}
+	}
+	if err := p.saver.Save(field, preference); err != nil {
+		ctx.Return(http.StatusInternalServerError, err)
+		return
+	}
+	ctx.Render(preference)
+}
+
+func (p Preference) Remove(ctx rest.Context) {
+	field, _, ok := p.field(ctx)
+	if !ok {
+		return
+	}
+	removed, err := p.saver.Remove(field)
+	if err != nil {
+		ctx.Return(http.StatusInternalServerError, err)
+		return
+	}
+	if !removed {
+		ctx.Return(http.StatusNotFound, "no preference of %s", field)
+		return
+	}
+}
+
+// field returns the field of preference in ctx, and the id of identity if
+// it's an identity's.
+func (p Preference) field(ctx rest.Context) (string, int64, bool) {
+	var kind string
+	var id int64
+	ctx.Bind("kind", &kind)
+	ctx.Bind("id", &id)
+	if err := ctx.BindError(); err != nil {
+		ctx.Return(http.StatusBadRequest, err)
+		return "", 0, false
+	}
+	switch kind {
+	case "user":
+		return broker.UserPreference(id), 0, true
+	case "identity":
+		return broker.IdentityPreference(id), id, true
+	}
+	ctx.Return(http.StatusBadRequest, "invalid kind: %s", kind)
+	return "", 0, false
+}
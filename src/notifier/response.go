@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"logger"
 	"model"
+	"net/http"
 	"thirdpart"
 	"time"
 )
@@ -63,12 +64,21 @@ func (r *Response) WaitResponse(id string, ontime int64, defaultOk bool, recipie
 		return
 	}
 	if !defaultOk {
-		r.PushQueue(id, item.FailUrl, item.FailArg, ontime)
+		if err := r.PushQueue(id, item.FailUrl, item.FailArg, ontime); err != nil {
+			logger.ERROR("push fallback of %s failed: %s", id, err)
+		}
 	}
 }
 
+// responseGroup is the watch group of notifiers, all instances share
+// responses in it.
+const responseGroup = "notifier"
+
+// Listen handles responses from poster until the watch breaks. Responses are
+// acked after handled, so responses missed while reconnecting are resumed
+// next time.
 func (r *Response) Listen() error {
-	listenUrl := fmt.Sprintf("http://%s:%d/v3/poster", r.config.ExfeService.Addr, r.config.ExfeService.Port)
+	listenUrl := fmt.Sprintf("http://%s:%d/v3/poster?group=%s", r.config.ExfeService.Addr, r.config.ExfeService.Port, responseGroup)
 	reader, err := broker.HttpResponse(broker.Http("WATCH", listenUrl, "application/json", nil))
 	if err != nil {
 		return err
@@ -76,51 +86,78 @@ func (r *Response) Listen() error {
 	defer reader.Close()
 
 	decoder := json.NewDecoder(reader)
-	var resp thirdpart.PostResponse
 	for {
+		var resp thirdpart.PostResponse
 		err := decoder.Decode(&resp)
 		if err != nil {
-			logger.ERROR("can't decode from post watch: %s", err)
-			continue
+			return fmt.Errorf("can't decode from post watch: %s", err)
 		}
-		item, err := r.saver.Load(resp.Id)
-		if err != nil {
-			logger.ERROR("can't load response item(%s): %s", resp.Id, err)
-			continue
+		r.handle(resp)
+		if resp.Seq > 0 {
+			r.ack(resp.Seq)
 		}
-		if resp.Ok {
-			r.DeleteQueue(resp.Id, item.FailUrl)
-		} else {
-			r.Do(item.FailUrl, item.FailArg)
+	}
+}
+
+func (r *Response) handle(resp thirdpart.PostResponse) {
+	deliveryResult(resp)
+	item, err := r.saver.Load(resp.Id)
+	if err != nil {
+		logger.ERROR("can't load response item(%s): %s", resp.Id, err)
+		return
+	}
+	if resp.Ok {
+		cancelled, err := r.DeleteQueue(resp.Id, item.FailUrl)
+		if err != nil {
+			logger.ERROR("can't cancel fallback of %s: %s", resp.Id, err)
+		} else if !cancelled {
+			logger.DEBUG("fallback of %s not in queue", resp.Id)
 		}
+	} else {
+		r.Do(item.FailUrl, item.FailArg)
+	}
+}
+
+func (r *Response) ack(seq uint64) {
+	ackUrl := fmt.Sprintf("http://%s:%d/v3/poster/ack/%s/%d", r.config.ExfeService.Addr, r.config.ExfeService.Port, responseGroup, seq)
+	resp, err := broker.HttpResponse(broker.Http("POST", ackUrl, "plain/text", nil))
+	if err != nil {
+		logger.ERROR("ack response %d failed: %s", seq, err)
+		return
 	}
+	resp.Close()
 }
 
-func (r *Response) PushQueue(id, u string, arg interface{}, ontime int64) {
+// PushQueue pushes POST arg to u at ontime to queue.
+func (r *Response) PushQueue(id, u string, arg interface{}, ontime int64) error {
 	queueUrl := fmt.Sprintf("http://%s:%d/v3/queue/-%s/POST/%s?ontime=%d",
 		r.config.ExfeQueue.Addr, r.config.ExfeQueue.Port, id, base64.URLEncoding.EncodeToString([]byte(u)), ontime)
 	b, err := json.Marshal(arg)
 	if err != nil {
-		logger.ERROR("can't marshal: %s with %#v", err, arg)
-		return
+		return fmt.Errorf("can't marshal: %s with %#v", err, arg)
 	}
 	resp, err := broker.HttpResponse(broker.Http("POST", queueUrl, "text/plain", b))
 	if err != nil {
-		logger.ERROR("push to queue %s failed: %s with %s", queueUrl, err, string(b))
-		return
+		return fmt.Errorf("push to queue %s failed: %s with %s", queueUrl, err, string(b))
 	}
 	resp.Close()
+	return nil
 }
 
-func (r *Response) DeleteQueue(id, u string) {
+// DeleteQueue cancels the fallback of id, returns false if the fallback isn't
+// in queue, which means it was sent already or never pushed.
+func (r *Response) DeleteQueue(id, u string) (bool, error) {
 	queueUrl := fmt.Sprintf("http://%s:%d/v3/queue/-%s/POST/%s",
 		r.config.ExfeQueue.Addr, r.config.ExfeQueue.Port, id, base64.URLEncoding.EncodeToString([]byte(u)))
 	resp, err := broker.HttpResponse(broker.Http("DELETE", queueUrl, "text/plain", nil))
 	if err != nil {
-		logger.ERROR("delete queue %s failed: %s with %s", queueUrl, err)
-		return
+		if e, ok := err.(broker.HttpError); ok && e.Code == http.StatusNotFound {
+			return false, nil
+		}
+		return false, fmt.Errorf("delete queue %s failed: %s", queueUrl, err)
 	}
 	resp.Close()
+	return true, nil
 }
 
 func (r *Response) Do(u string, arg interface{}) {
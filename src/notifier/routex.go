@@ -46,6 +46,5 @@ func (w Routex) Request(ctx rest.Context, arg RequestArg) {
 		return
 	}
 
-	go SendAndSave(w.localTemplate, w.platform, &arg.To, arg, "routex_request", w.domain+"/v3/notifier/routex/request", &arg)
-	ctx.Return(http.StatusAccepted)
+	sendOrDryRun(ctx, w.localTemplate, w.platform, &arg.To, arg.CrossId, arg, "routex_request", w.domain+"/v3/notifier/routex/request", &arg)
 }
@@ -0,0 +1,167 @@
+package notifier
+
+import (
+	"broker"
+	"encoding/json"
+	"fmt"
+	"formatter"
+	"github.com/googollee/go-rest"
+	"logger"
+	"model"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+	"token"
+)
+
+const (
+	unsubscribeScope  = "exfe://notifier/unsubscribe"
+	unsubscribeExpire = 365 * 24 * time.Hour
+)
+
+// categories are what recipients can unsubscribe, by template. Templates not
+// here, like user_verify, are always sent.
+var categories = map[string]string{
+	"cross_invitation":          "invitation",
+	"cross_update_invitation":   "invitation",
+	"cross_update":              "update",
+	"cross_join":                "update",
+	"cross_conversation":        "conversation",
+	"cross_conversation_digest": "conversation",
+	"cross_digest":              "digest",
+	"cross_remind":              "remind",
+	"routex_request":            "routex",
+}
+
+// categoryOf returns the category of template, or "" if it can't be
+// unsubscribed.
+func categoryOf(template string) string {
+	if i := strings.Index(template, "@"); i >= 0 {
+		template = template[:i]
+	}
+	return categories[template]
+}
+
+type unsubscribeData struct {
+	IdentityId int64  `json:"identity_id"`
+	UserId     int64  `json:"user_id"`
+	Category   string `json:"category"`
+}
+
+var tokens *token.Manager
+var unsubscribeConfig *model.Config
+
+// SetupUnsubscribe mints unsubscribe tokens with manager, and makes
+// {{unsubscribe .To "conversation"}} in templates return the opt-out url.
+func SetupUnsubscribe(config *model.Config, localTemplate *formatter.LocalTemplate, manager *token.Manager) {
+	tokens = manager
+	unsubscribeConfig = config
+	localTemplate.Funcs(template.FuncMap{
+		"unsubscribe": unsubscribeUrl,
+	})
+}
+
+// unsubscribeUrl returns the opt-out url of (to, category), or "" if
+// unsubscribe isn't set up.
+func unsubscribeUrl(to model.Recipient, category string) string {
+	if unsubscribeConfig == nil || unsubscribeConfig.Notifier.UnsubscribeUrl == "" {
+		return ""
+	}
+	key, err := unsubscribeToken(to, category)
+	if err != nil {
+		logger.ERROR("mint unsubscribe token of %s for %s failed: %s", to, category, err)
+		return ""
+	}
+	return fmt.Sprintf("%s/%s", strings.TrimRight(unsubscribeConfig.Notifier.UnsubscribeUrl, "/"), key)
+}
+
+// unsubscribeToken returns the token of (identity, category), the same one
+// until it expires.
+func unsubscribeToken(to model.Recipient, category string) (string, error) {
+	if tokens == nil {
+		return "", fmt.Errorf("no token manager")
+	}
+	data, err := json.Marshal(unsubscribeData{
+		IdentityId: to.IdentityID,
+		UserId:     to.UserID,
+		Category:   category,
+	})
+	if err != nil {
+		return "", err
+	}
+	resource := fmt.Sprintf("unsubscribe/%d/%s", to.IdentityID, category)
+	t, err := tokens.Mint(resource, unsubscribeScope, string(data), unsubscribeExpire)
+	if err != nil {
+		return "", err
+	}
+	return t.Key, nil
+}
+
+type Unsubscribe struct {
+	rest.Service `prefix:"/v3/notifier/unsubscribe"`
+
+	get  rest.SimpleNode `route:"/:token" method:"GET"`
+	post rest.SimpleNode `route:"/:token" method:"POST"`
+
+	tokens *token.Manager
+	saver  *broker.PreferenceSaver
+}
+
+func NewUnsubscribe(manager *token.Manager, saver *broker.PreferenceSaver) *Unsubscribe {
+	return &Unsubscribe{
+		tokens: manager,
+		saver:  saver,
+	}
+}
+
+// Get shows what token unsubscribes, for links in notifications. It doesn't
+// opt out, since mail scanners and prefetchers open links too. The page of it
+// confirms with Post.
+func (u Unsubscribe) Get(ctx rest.Context) {
+	data, ok := u.find(ctx)
+	if !ok {
+		return
+	}
+	ctx.Render(data)
+}
+
+// Post opts out the identity and category of token. It's also the one-click
+// unsubscribe of List-Unsubscribe-Post header.
+func (u Unsubscribe) Post(ctx rest.Context) {
+	data, ok := u.find(ctx)
+	if !ok {
+		return
+	}
+	if err := u.saver.Unsubscribe(data.IdentityId, data.Category); err != nil {
+		ctx.Return(http.StatusInternalServerError, err)
+		return
+	}
+	logger.INFO("notifier", "unsubscribe", data.IdentityId, data.Category)
+	ctx.Render(data)
+}
+
+// find returns the data of token in ctx, or returns the error to ctx.
+func (u Unsubscribe) find(ctx rest.Context) (unsubscribeData, bool) {
+	var data unsubscribeData
+	var key string
+	ctx.Bind("token", &key)
+	if err := ctx.BindError(); err != nil {
+		ctx.Return(http.StatusBadRequest, err)
+		return data, false
+	}
+	t, ok, err := u.tokens.Find(key)
+	if err != nil {
+		ctx.Return(http.StatusInternalServerError, err)
+		return data, false
+	}
+	if !ok || t.Scope != unsubscribeScope {
+		ctx.Return(http.StatusNotFound, "invalid token %s", key)
+		return data, false
+	}
+	if err := json.Unmarshal([]byte(t.Data), &data); err != nil {
+		ctx.Return(http.StatusInternalServerError, "invalid token data: %s", err)
+		return data, false
+	}
+	return data, true
+}
@@ -0,0 +1,101 @@
+package notifier
+
+import (
+	"formatter"
+	"github.com/stretchrcom/testify/assert"
+	"model"
+	"strings"
+	"testing"
+	"token"
+)
+
+type testTokenRepo struct {
+	tokens []token.Token
+}
+
+func (r *testTokenRepo) Store(t token.Token) error {
+	r.tokens = append(r.tokens, t)
+	return nil
+}
+
+func (r *testTokenRepo) FindByKey(key string) ([]token.Token, error) {
+	for _, t := range r.tokens {
+		if t.Key == key {
+			return []token.Token{t}, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *testTokenRepo) FindByHash(hash string) ([]token.Token, error) {
+	var ret []token.Token
+	for _, t := range r.tokens {
+		if t.Hash == hash {
+			ret = append(ret, t)
+		}
+	}
+	return ret, nil
+}
+
+func (r *testTokenRepo) Touch(key, hash *string) error {
+	return nil
+}
+
+func (r *testTokenRepo) UpdateByKey(key string, data *string, expiresIn *int64) (int64, error) {
+	return 0, nil
+}
+
+func (r *testTokenRepo) UpdateByHash(hash string, data *string, expiresIn *int64) (int64, error) {
+	return 0, nil
+}
+
+func TestCategoryOf(t *testing.T) {
+	assert.Equal(t, categoryOf("cross_conversation_digest"), "conversation")
+	assert.Equal(t, categoryOf("cross_invitation@b"), "invitation")
+	assert.Equal(t, categoryOf("user_verify"), "")
+}
+
+func TestUnsubscribeUrl(t *testing.T) {
+	l, err := formatter.NewLocalTemplate("./unsubscribe_test", "en_US")
+	assert.Equal(t, err, nil)
+	var config model.Config
+	repo := &testTokenRepo{}
+	SetupUnsubscribe(&config, l, token.New(repo))
+	defer func() {
+		tokens = nil
+		unsubscribeConfig = nil
+	}()
+
+	alice := model.Recipient{IdentityID: 1, UserID: 11, Provider: "email", Language: "en_US"}
+	arg := map[string]interface{}{"To": &alice}
+
+	text, err := GenerateContent(l, "unsubscribe", "email", "en_US", arg)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, text, "Subject: test")
+
+	config.Notifier.UnsubscribeUrl = "https://api.exfe.com/v3/notifier/unsubscribe/"
+	text, err = GenerateContent(l, "unsubscribe", "email", "en_US", arg)
+	assert.Equal(t, err, nil)
+	prefix := "Subject: test\nList-Unsubscribe: <https://api.exfe.com/v3/notifier/unsubscribe/"
+	assert.Equal(t, strings.HasPrefix(text, prefix), true, text)
+	assert.Equal(t, len(repo.tokens), 1)
+	assert.Equal(t, text, prefix+repo.tokens[0].Key+">")
+
+	again, err := GenerateContent(l, "unsubscribe", "email", "en_US", arg)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, again, text)
+	assert.Equal(t, len(repo.tokens), 1)
+
+	bobby := model.Recipient{IdentityID: 2, UserID: 12, Provider: "email", Language: "en_US"}
+	other, err := GenerateContent(l, "unsubscribe", "email", "en_US", map[string]interface{}{"To": bobby})
+	assert.Equal(t, err, nil)
+	assert.NotEqual(t, other, text)
+	assert.Equal(t, len(repo.tokens), 2)
+
+	from, to := testRecipient("alice", "token0123456789alice"), testRecipient("bobby", "token0123456789bobby")
+	from.IdentityID, to.IdentityID = alice.IdentityID, bobby.IdentityID
+	from.UserID, to.UserID = alice.UserID, bobby.UserID
+	r, ok := substitution(from, to, "conversation")
+	assert.Equal(t, ok, true)
+	assert.Equal(t, r.Replace(text), other)
+}
@@ -38,8 +38,7 @@ func (u User) Welcome(ctx rest.Context, arg model.UserWelcome) {
 		return
 	}
 
-	go SendAndSave(u.localTemplate, u.platform, &arg.To, arg, "user_welcome", u.domain+"/v3/notifier/user/welcome", &arg)
-	ctx.Return(http.StatusAccepted)
+	sendOrDryRun(ctx, u.localTemplate, u.platform, &arg.To, 0, arg, "user_welcome", u.domain+"/v3/notifier/user/welcome", &arg)
 }
 
 func (u User) Verify(ctx rest.Context, arg model.UserVerify) {
@@ -49,8 +48,7 @@ func (u User) Verify(ctx rest.Context, arg model.UserVerify) {
 		return
 	}
 
-	go SendAndSave(u.localTemplate, u.platform, &arg.To, arg, "user_verify", u.domain+"/v3/notifier/user/verify", &arg)
-	ctx.Return(http.StatusAccepted)
+	sendOrDryRun(ctx, u.localTemplate, u.platform, &arg.To, 0, arg, "user_verify", u.domain+"/v3/notifier/user/verify", &arg)
 }
 
 func (u User) Reset(ctx rest.Context, arg model.UserVerify) {
@@ -60,6 +58,5 @@ func (u User) Reset(ctx rest.Context, arg model.UserVerify) {
 		return
 	}
 
-	go SendAndSave(u.localTemplate, u.platform, &arg.To, arg, "user_resetpass", u.domain+"/v3/notifier/user/reset", &arg)
-	ctx.Return(http.StatusAccepted)
+	sendOrDryRun(ctx, u.localTemplate, u.platform, &arg.To, 0, arg, "user_resetpass", u.domain+"/v3/notifier/user/reset", &arg)
 }
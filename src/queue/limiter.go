@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/url"
+	"sync"
+	"time"
+)
+
+// hostLimiter caps concurrent requests to each destination host, so a burst
+// of keys to one service won't flood it.
+type hostLimiter struct {
+	defaultLimit int
+	limits       map[string]int
+	slots        map[string]chan bool
+	locker       sync.Mutex
+}
+
+func newHostLimiter(defaultLimit int, limits map[string]int) *hostLimiter {
+	return &hostLimiter{
+		defaultLimit: defaultLimit,
+		limits:       limits,
+		slots:        make(map[string]chan bool),
+	}
+}
+
+// Acquire blocks until a request to service is allowed, or returns false if
+// it isn't allowed before deadline. Call the returned function after the
+// request is done.
+func (l *hostLimiter) Acquire(service string, deadline time.Time) (func(), bool) {
+	slot := l.slot(hostOf(service))
+	if slot == nil {
+		return func() {}, true
+	}
+	select {
+	case slot <- true:
+		return func() { <-slot }, true
+	default:
+	}
+	wait := time.NewTimer(deadline.Sub(time.Now()))
+	defer wait.Stop()
+	select {
+	case slot <- true:
+		return func() { <-slot }, true
+	case <-wait.C:
+		return nil, false
+	}
+}
+
+// Running returns the count of requests in flight for each host.
+func (l *hostLimiter) Running() map[string]int {
+	l.locker.Lock()
+	defer l.locker.Unlock()
+
+	ret := make(map[string]int)
+	for host, slot := range l.slots {
+		ret[host] = len(slot)
+	}
+	return ret
+}
+
+func (l *hostLimiter) slot(host string) chan bool {
+	l.locker.Lock()
+	defer l.locker.Unlock()
+
+	if ret, ok := l.slots[host]; ok {
+		return ret
+	}
+	limit, ok := l.limits[host]
+	if !ok {
+		limit = l.defaultLimit
+	}
+	if limit <= 0 {
+		return nil
+	}
+	ret := make(chan bool, limit)
+	l.slots[host] = ret
+	return ret
+}
+
+func hostOf(service string) string {
+	u, err := url.Parse(service)
+	if err != nil || u.Host == "" {
+		return service
+	}
+	return u.Host
+}
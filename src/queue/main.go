@@ -1,23 +1,25 @@
 package main
 
 import (
+	"broker"
 	"daemon"
+	"delayrepo"
+	"flag"
 	"fmt"
 	"github.com/garyburd/redigo/redis"
 	"github.com/googollee/go-rest"
-	"launchpad.net/tomb"
 	"logger"
 	"model"
-	"net/http"
 	"os"
 	"time"
 )
 
+var storageType = flag.String("storage", "redis", "Specify the storage of queue: memory, file or redis")
+var storageFile = flag.String("storage_file", "exfe_queue.log", "Specify the log file of file storage")
+
 func main() {
 	var config model.Config
-	quit := daemon.Init("exfe.json", &config)
-
-	tombs := make([]*tomb.Tomb, 0)
+	shutdown := daemon.Init("exfe.json", &config)
 
 	addr := fmt.Sprintf("%s:%d", config.ExfeQueue.Addr, config.ExfeQueue.Port)
 	logger.NOTICE("start at %s", addr)
@@ -40,13 +42,66 @@ func main() {
 		},
 	}
 
-	q, err := NewQueue(&config, redisPool)
+	// lane of normal priority keeps the names before priorities added.
+	storages := make([]Storage, len(model.Priorities))
+	for lane, priority := range model.Priorities {
+		prefix, file := "exfe:v3:queue", *storageFile
+		if priority != model.PriorityNormal {
+			prefix = fmt.Sprintf("%s:%s", prefix, priority)
+			file = fmt.Sprintf("%s.%s", file, priority)
+		}
+		switch *storageType {
+		case "memory":
+			storages[lane] = delayrepo.NewMemoryStorage()
+		case "file":
+			fileStorage, err := delayrepo.NewFileStorage(file)
+			if err != nil {
+				logger.ERROR("open storage file %s failed: %s", file, err)
+				os.Exit(-1)
+				return
+			}
+			defer fileStorage.Close()
+			storages[lane] = fileStorage
+		case "redis":
+			storages[lane] = broker.NewQueueRedisStorage(prefix, redisPool)
+		default:
+			logger.ERROR("invalid storage: %s", *storageType)
+			os.Exit(-1)
+			return
+		}
+	}
+	var deadLetter DeadLetterStorage
+	var recurring RecurringStorage
+	switch *storageType {
+	case "memory":
+		deadLetter = delayrepo.NewMemoryDeadLetter()
+		recurring = delayrepo.NewMemoryRecurring()
+	case "file":
+		var err error
+		deadLetter, err = delayrepo.NewFileDeadLetter(*storageFile + ".dead")
+		if err != nil {
+			logger.ERROR("open dead letter file failed: %s", err)
+			os.Exit(-1)
+			return
+		}
+		recurring, err = delayrepo.NewFileRecurring(*storageFile + ".recurring")
+		if err != nil {
+			logger.ERROR("open recurring file failed: %s", err)
+			os.Exit(-1)
+			return
+		}
+	default:
+		deadLetter = broker.NewQueueDeadLetter("exfe:v3:queue", redisPool)
+		recurring = broker.NewQueueRecurring("exfe:v3:queue", redisPool)
+	}
+	logger.NOTICE("queue storage: %s", *storageType)
+
+	q, err := NewQueue(&config, storages, deadLetter, recurring)
 	if err != nil {
 		logger.ERROR("launch queue failed: %s", err)
 		os.Exit(-1)
 		return
 	}
-	defer q.Quit()
 
 	err = service.Add(q)
 	if err != nil {
@@ -55,19 +110,9 @@ func main() {
 		return
 	}
 	logger.NOTICE("launch queue")
+	shutdown.OnQuit("queue", q.Quit)
 
-	go func() {
-		<-quit
-		for i, _ := range tombs {
-			tombs[i].Kill(nil)
-			tombs[i].Wait()
-		}
-		logger.NOTICE("quit")
-		os.Exit(-1)
-		return
-	}()
-
-	err = http.ListenAndServe(addr, service)
+	err = shutdown.ListenAndServe(addr, service)
 	if err != nil {
 		logger.ERROR("gobus launch failed: %s", err)
 		os.Exit(-1)
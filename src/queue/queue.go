@@ -4,13 +4,16 @@ import (
 	"broker"
 	"delayrepo"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
-	"github.com/garyburd/redigo/redis"
 	"github.com/googollee/go-rest"
+	"hash/fnv"
 	"logger"
 	"model"
 	"net/http"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -18,26 +21,109 @@ func init() {
 	rest.RegisterMarshaller("plain/text", new(broker.PlainText))
 }
 
+// Storage saves the items of queue. It can be listed besides the methods
+// used by timer.
+type Storage interface {
+	delayrepo.TimerStorage
+	Range(start, stop int) ([]broker.QueueKey, error)
+	Peek(key string) (broker.QueueKey, [][]byte, error)
+	Depth(now int64) (total int, due int, err error)
+}
+
+// DeadLetterStorage counts failed deliveries and keeps the keys failed too
+// many times, like broker.QueueDeadLetter.
+type DeadLetterStorage interface {
+	Attempt(key string) (int, error)
+	Reset(key string) error
+	Save(key, priority string, datas [][]byte, attempts int, reason string) (broker.DeadLetter, error)
+	List(offset, count int) ([]broker.DeadLetter, error)
+	Load(id string) (broker.DeadLetter, bool, error)
+	Remove(id string) (bool, error)
+	Purge() (int, error)
+}
+
+// RecurringStorage saves recurring jobs, like broker.QueueRecurring.
+type RecurringStorage interface {
+	Save(job broker.RecurringJob) error
+	Load(key string) (broker.RecurringJob, bool, error)
+	List() ([]broker.RecurringJob, error)
+	Remove(key string) (bool, error)
+}
+
 type Queue struct {
 	rest.Service `prefix:"/v3/queue" mime:"plain/text"`
 
-	config  *model.Config
-	timeout time.Duration
+	config      *model.Config
+	timeout     time.Duration
+	visibility  time.Duration
+	maxAttempts int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	workers     int
+	hosts       *hostLimiter
+
+	list       rest.SimpleNode `route:"" method:"GET"`
+	stats      rest.SimpleNode `route:"/_stats" method:"GET"`
+	inspect    rest.SimpleNode `route:"/:merge_key/:method/*service" method:"GET"`
+	push       rest.SimpleNode `route:"/:merge_key/:method/*service" method:"POST"`
+	delete     rest.SimpleNode `route:"/:merge_key/:method/*service" method:"DELETE"`
+	listDead   rest.SimpleNode `route:"/_dead" method:"GET"`
+	getDead    rest.SimpleNode `route:"/_dead/:id" method:"GET"`
+	replayDead rest.SimpleNode `route:"/_dead/:id" method:"POST"`
+	removeDead rest.SimpleNode `route:"/_dead/:id" method:"DELETE"`
+	purgeDead  rest.SimpleNode `route:"/_dead" method:"DELETE"`
+
+	listRecurring   rest.SimpleNode `route:"/_recurring" method:"GET"`
+	cancelRecurring rest.SimpleNode `route:"/_recurring/:id" method:"DELETE"`
 
-	push   rest.SimpleNode `route:"/:merge_key/:method/*service" method:"POST"`
-	delete rest.SimpleNode `route:"/:merge_key/:method/*service" method:"DELETE"`
-	timer  *delayrepo.Timer
+	timer      *delayrepo.Timer
+	storages   []Storage
+	deadLetter DeadLetterStorage
+	recurring  RecurringStorage
 }
 
-func NewQueue(config *model.Config, redis *redis.Pool) (*Queue, error) {
+// NewQueue creates queue with storages of each priority lane, ordered as
+// model.Priorities.
+func NewQueue(config *model.Config, storages []Storage, deadLetter DeadLetterStorage, recurring RecurringStorage) (*Queue, error) {
+	if len(storages) != len(model.Priorities) {
+		return nil, fmt.Errorf("need %d storages for priorities %v, got %d", len(model.Priorities), model.Priorities, len(storages))
+	}
 	ret := &Queue{
-		config:  config,
-		timeout: time.Second * 30,
+		config:      config,
+		timeout:     time.Second * 30,
+		visibility:  time.Minute * 5,
+		maxAttempts: config.ExfeQueue.Retry.MaxAttempts,
+		backoff:     time.Duration(config.ExfeQueue.Retry.BackoffInSecond) * time.Second,
+		maxBackoff:  time.Duration(config.ExfeQueue.Retry.MaxBackoffInSecond) * time.Second,
+		workers:     config.ExfeQueue.Dispatch.Workers,
+		storages:    storages,
+		deadLetter:  deadLetter,
+		recurring:   recurring,
+	}
+	if ret.maxAttempts <= 0 {
+		ret.maxAttempts = 5
 	}
+	if ret.backoff <= 0 {
+		ret.backoff = time.Second * 30
+	}
+	if ret.maxBackoff < ret.backoff {
+		ret.maxBackoff = time.Hour
+	}
+	if ret.workers <= 0 {
+		ret.workers = 100
+	}
+	hostConcurrency := config.ExfeQueue.Dispatch.HostConcurrency
+	if hostConcurrency <= 0 {
+		hostConcurrency = 10
+	}
+	ret.hosts = newHostLimiter(hostConcurrency, config.ExfeQueue.Dispatch.Hosts)
 
 	logger.NOTICE("launching timer")
-	storage := broker.NewQueueRedisStorage("exfe:v3:queue", redis)
-	timer, err := delayrepo.NewTimer(storage, ret.timeout)
+	lanes := make([]delayrepo.TimerStorage, len(storages))
+	for i, storage := range storages {
+		lanes[i] = storage
+	}
+	timer, err := delayrepo.NewLaneTimer(lanes, ret.timeout, ret.visibility, ret.workers)
 	if err != nil {
 		return nil, err
 	}
@@ -47,47 +133,187 @@ func NewQueue(config *model.Config, redis *redis.Pool) (*Queue, error) {
 	return ret, nil
 }
 
-func (q *Queue) Do(key string, datas [][]byte) {
-	fl := logger.FUNC(key)
+func (q *Queue) Do(lane int, key string, datas [][]byte) error {
+	fl := logger.FUNC(lane, key)
 	defer fl.Quit()
 
-	splits := strings.Split(key, ",")
-	if len(splits) != 3 {
+	method, service, mergeKey, ok := splitKey(key)
+	if !ok {
 		logger.ERROR("pop error key: %s", key)
-		return
+		return nil
 	}
-	method, service, mergeKey := splits[0], splits[1], splits[2]
 	needMerge := mergeKey[0] != '-'
+	// datas are claimed for visibility, leave half of it to post.
+	deadline := time.Now().Add(q.visibility / 2)
 
-	args := []byte("[")
-	for _, data := range datas {
-		if needMerge {
-			args = append(args, data...)
-			args = append(args, []byte(",")...)
-		} else {
-			go func() {
-				resp, err := broker.HttpResponse(broker.Http(method, service, "application/json", data))
-				if err != nil {
-					logger.ERROR("%s %s: %s, with %s", method, service, err, string(data))
-				} else {
-					resp.Close()
-					logger.INFO("queue", "do", method, service, mergeKey)
+	if !needMerge {
+		var wg sync.WaitGroup
+		var finished int32
+		errs := make(chan error, len(datas))
+		for _, data := range datas {
+			release, ok := q.hosts.Acquire(service, deadline)
+			if !ok {
+				errs <- q.postpone(lane, key, data)
+				continue
+			}
+			wg.Add(1)
+			go func(data []byte) {
+				defer wg.Done()
+				defer release()
+				done, err := q.post(lane, key, itemAttemptKey(key, data), method, service, mergeKey, data, [][]byte{data})
+				if done {
+					atomic.AddInt32(&finished, 1)
 				}
-			}()
+				errs <- err
+			}(data)
+		}
+		wg.Wait()
+		close(errs)
+		if finished > 0 {
+			q.rearm(key)
+		}
+		for err := range errs {
+			if err != nil {
+				return err
+			}
 		}
+		return nil
 	}
-	if needMerge && len(args) > 1 {
+
+	args := []byte("[")
+	for _, data := range datas {
+		args = append(args, data...)
+		args = append(args, []byte(",")...)
+	}
+	if len(args) > 1 {
 		args[len(args)-1] = byte(']')
-		go func() {
-			resp, err := broker.HttpResponse(broker.Http(method, service, "application/json", args))
-			if err != nil {
-				logger.ERROR("%s %s: %s, with %s", method, service, err, string(args))
-			} else {
-				resp.Close()
-				logger.INFO("queue", "do", method, service, mergeKey)
+		release, ok := q.hosts.Acquire(service, deadline)
+		if !ok {
+			logger.INFO("queue", "postpone", key)
+			return fmt.Errorf("%s is busy", hostOf(service))
+		}
+		defer release()
+		done, err := q.post(lane, key, key, method, service, mergeKey, args, datas)
+		if done {
+			q.rearm(key)
+		}
+		return err
+	}
+	return nil
+}
+
+// post sends body to service and returns whether datas are done: delivered,
+// or moved to dead letters. Otherwise datas will be retried later, and post
+// returns error only if the retry can't be saved. Failures are counted by
+// attempt key.
+func (q *Queue) post(lane int, key, attempt, method, service, mergeKey string, body []byte, datas [][]byte) (bool, error) {
+	resp, err := broker.HttpResponse(broker.Http(method, service, "application/json", body))
+	if err == nil {
+		resp.Close()
+		logger.INFO("queue", "do", method, service, mergeKey)
+		if err := q.deadLetter.Reset(attempt); err != nil {
+			logger.ERROR("reset attempts of %s failed: %s", attempt, err)
+		}
+		return true, nil
+	}
+	logger.ERROR("%s %s: %s, with %s", method, service, err, string(body))
+	return q.retry(lane, key, attempt, datas, err)
+}
+
+// itemAttemptKey is the attempt key of one data of a non-merged key, so items
+// sharing the key are retried and dead-lettered on their own.
+func itemAttemptKey(key string, data []byte) string {
+	h := fnv.New64a()
+	h.Write(data)
+	return fmt.Sprintf("%s#%x", key, h.Sum64())
+}
+
+// postpone pushes data back to lane after timeout, when the host of it is
+// too busy to post before the claim expires. It doesn't count as an attempt.
+func (q *Queue) postpone(lane int, key string, data []byte) error {
+	ontime := time.Now().Add(q.timeout).Unix()
+	if err := q.timer.PushLane(lane, delayrepo.Once, ontime, key, data); err != nil {
+		return fmt.Errorf("postpone %s failed: %s", key, err)
+	}
+	logger.INFO("queue", "postpone", key, ontime)
+	return nil
+}
+
+// rearm pushes the data of recurring job key again at its next schedule. It's
+// called once the dispatch is done, failed or not, so a failing job keeps
+// running.
+func (q *Queue) rearm(key string) {
+	job, ok, err := q.recurring.Load(key)
+	if err != nil {
+		logger.ERROR("load recurring job %s failed: %s", key, err)
+		return
+	}
+	if !ok {
+		return
+	}
+	schedule, err := scheduleOf(job.Cron, job.Every)
+	if err != nil {
+		logger.ERROR("recurring job %s invalid: %s", key, err)
+		return
+	}
+	next := schedule.Next(time.Now())
+	if next.IsZero() {
+		logger.ERROR("recurring job %s(%s) never runs again", key, job.Cron)
+		return
+	}
+	lane, err := model.PriorityLane(job.Priority)
+	if err != nil {
+		logger.ERROR("recurring job %s invalid: %s", key, err)
+		return
+	}
+	if err := q.timer.PushLane(lane, delayrepo.Always, next.Unix(), key, []byte(job.Data)); err != nil {
+		logger.ERROR("rearm recurring job %s failed: %s", key, err)
+		return
+	}
+	logger.INFO("queue", "rearm", key, next.Unix())
+}
+
+// retry pushes datas back to the lane of timer with exponential backoff, or
+// moves them to the dead letters once attempt failed maxAttempts times and
+// returns true.
+func (q *Queue) retry(lane int, key, attempt string, datas [][]byte, reason error) (bool, error) {
+	attempts, err := q.deadLetter.Attempt(attempt)
+	if err != nil {
+		logger.ERROR("count attempts of %s failed: %s", attempt, err)
+		attempts = 1
+	}
+	if attempts >= q.maxAttempts {
+		letter, err := q.deadLetter.Save(key, model.Priorities[lane], datas, attempts, reason.Error())
+		if err != nil {
+			return false, fmt.Errorf("save dead letter %s failed: %s", key, err)
+		}
+		if attempt != key {
+			if err := q.deadLetter.Reset(attempt); err != nil {
+				logger.ERROR("reset attempts of %s failed: %s", attempt, err)
 			}
-		}()
+		}
+		logger.INFO("queue", "dead", key, letter.Id, attempts, reason)
+		return true, nil
 	}
+	ontime := time.Now().Add(q.backoffOf(attempts)).Unix()
+	for _, data := range datas {
+		if err := q.timer.PushLane(lane, delayrepo.Once, ontime, key, data); err != nil {
+			return false, fmt.Errorf("retry %s failed: %s", key, err)
+		}
+	}
+	logger.INFO("queue", "retry", key, attempts, ontime)
+	return false, nil
+}
+
+func (q *Queue) backoffOf(attempts int) time.Duration {
+	ret := q.backoff
+	for i := 1; i < attempts; i++ {
+		ret *= 2
+		if ret >= q.maxBackoff {
+			return q.maxBackoff
+		}
+	}
+	return ret
 }
 
 func (q *Queue) OnError(err error) {
@@ -99,57 +325,274 @@ func (q *Queue) Quit() {
 	q.timer.Quit()
 }
 
+type QueueEntry struct {
+	Method   string   `json:"method"`
+	Service  string   `json:"service"`
+	MergeKey string   `json:"merge_key"`
+	Priority string   `json:"priority"`
+	Count    int      `json:"count"`
+	Claimed  bool     `json:"claimed"`
+	Ontime   int64    `json:"ontime"`
+	FireAt   string   `json:"fire_at"`
+	Preview  string   `json:"preview"`
+	Data     []string `json:"data,omitempty"`
+}
+
+const previewSize = 200
+
+func newQueueEntry(lane int, key broker.QueueKey) (QueueEntry, bool) {
+	method, service, mergeKey, ok := splitKey(key.Key)
+	if !ok {
+		return QueueEntry{}, false
+	}
+	preview := string(key.First)
+	if len(preview) > previewSize {
+		preview = preview[:previewSize] + "..."
+	}
+	ret := QueueEntry{
+		Method:   method,
+		Service:  service,
+		MergeKey: mergeKey,
+		Priority: model.Priorities[lane],
+		Count:    key.Count,
+		Claimed:  key.Claimed,
+		Ontime:   key.Ontime,
+		Preview:  preview,
+	}
+	if key.Ontime > 0 {
+		ret.FireAt = time.Unix(key.Ontime, 0).UTC().Format(time.RFC3339)
+	}
+	return ret, true
+}
+
+type QueueStats struct {
+	Depth   int            `json:"depth"`
+	Due     int            `json:"due"`
+	Lanes   []LaneStats    `json:"lanes"`
+	Running int            `json:"running"`
+	Workers int            `json:"workers"`
+	Hosts   map[string]int `json:"hosts"`
+}
+
+type LaneStats struct {
+	Priority string `json:"priority"`
+	Depth    int    `json:"depth"`
+	Due      int    `json:"due"`
+}
+
 // example:
-// POST to bus://exfe_service/message with merge_key 123, always send on 1366615888, data is {"abc":123}
-// > curl -v "http://127.0.0.1:23334/v3/queue/123/POST/exfe_service/message?update=always&ontime=1366615888" -d '{"abc":123}'
+// show how many keys are waiting in queue, how many of them are due, and requests in flight to each host
+// > curl -v "http://127.0.0.1:23334/v3/queue/_stats"
+func (q Queue) Stats(ctx rest.Context) {
+	ret := QueueStats{
+		Lanes:   make([]LaneStats, len(q.storages)),
+		Running: q.timer.Running(),
+		Workers: q.workers,
+		Hosts:   q.hosts.Running(),
+	}
+	now := time.Now().Unix()
+	for lane, storage := range q.storages {
+		depth, due, err := storage.Depth(now)
+		if err != nil {
+			ctx.Return(http.StatusInternalServerError, err)
+			return
+		}
+		ret.Lanes[lane] = LaneStats{
+			Priority: model.Priorities[lane],
+			Depth:    depth,
+			Due:      due,
+		}
+		ret.Depth += depth
+		ret.Due += due
+	}
+	renderJSON(ctx, ret)
+}
+
+// example:
+// list the first 20 keys which will be sent to http://127.0.0.1:23333/v3/notifier and merge key starts with "123", ordered by ontime
+// > curl -v "http://127.0.0.1:23334/v3/queue?service=http://127.0.0.1:23333/v3/notifier&merge_key=123&offset=0&limit=20"
 //
-// if no merge(send one by one), set merge_key to "-"
-func (q Queue) Push(ctx rest.Context, data string) {
-	var method, service, mergeKey, updateType string
-	var ontime int64
-	ctx.Bind("method", &method)
+// service and merge_key are prefix filters, both optional. Keys are listed
+// by priority, then by ontime in the same priority. Set priority to list only
+// one of "instant", "normal" and "bulk".
+func (q Queue) List(ctx rest.Context) {
+	var offset, limit int
+	var service, mergeKey, priority string
+	ctx.Bind("offset", &offset)
+	ctx.Bind("limit", &limit)
 	ctx.Bind("service", &service)
 	ctx.Bind("merge_key", &mergeKey)
-	ctx.Bind("update", &updateType)
-	ctx.Bind("ontime", &ontime)
+	ctx.Bind("priority", &priority)
 	if err := ctx.BindError(); err != nil {
 		ctx.Return(http.StatusBadRequest, err)
 		return
 	}
-	if method == "" {
-		ctx.Return(http.StatusBadRequest, "need method")
+	lanes := make([]int, 0, len(q.storages))
+	if priority == "" {
+		for lane := range q.storages {
+			lanes = append(lanes, lane)
+		}
+	} else {
+		lane, err := model.PriorityLane(priority)
+		if err != nil {
+			ctx.Return(http.StatusBadRequest, err)
+			return
+		}
+		lanes = append(lanes, lane)
+	}
+	if offset < 0 {
+		ctx.Return(http.StatusBadRequest, "invalid offset: %d", offset)
 		return
 	}
-	if service == "" {
-		ctx.Return(http.StatusBadRequest, "need service")
+	if limit <= 0 {
+		limit = 20
+	}
+
+	const batch = 100
+	ret := make([]QueueEntry, 0, limit)
+	skipped := 0
+	for _, lane := range lanes {
+		for start := 0; len(ret) < limit; start += batch {
+			keys, err := q.storages[lane].Range(start, start+batch-1)
+			if err != nil {
+				ctx.Return(http.StatusInternalServerError, err)
+				return
+			}
+			for _, key := range keys {
+				entry, ok := newQueueEntry(lane, key)
+				if !ok {
+					continue
+				}
+				if !strings.HasPrefix(entry.Service, service) || !strings.HasPrefix(entry.MergeKey, mergeKey) {
+					continue
+				}
+				if skipped < offset {
+					skipped++
+					continue
+				}
+				ret = append(ret, entry)
+				if len(ret) == limit {
+					break
+				}
+			}
+			if len(keys) < batch {
+				break
+			}
+		}
+	}
+	renderJSON(ctx, ret)
+}
+
+// example:
+// show all data which will be POST to bus://exfe_service/message with merge_key 123
+// > curl -v "http://127.0.0.1:23334/v3/queue/123/POST/exfe_service/message"
+func (q Queue) Inspect(ctx rest.Context) {
+	method, service, mergeKey, ok := bindKey(ctx)
+	if !ok {
 		return
 	}
-	if mergeKey == "" {
-		ctx.Return(http.StatusBadRequest, "invalid mergeKey: (empty)")
+	for lane, storage := range q.storages {
+		key, datas, err := storage.Peek(fmt.Sprintf("%s,%s,%s", method, service, mergeKey))
+		if err != nil {
+			ctx.Return(http.StatusInternalServerError, err)
+			return
+		}
+		if key.Ontime == 0 && key.Count == 0 {
+			continue
+		}
+		entry, _ := newQueueEntry(lane, key)
+		entry.Data = make([]string, len(datas))
+		for i, data := range datas {
+			entry.Data[i] = string(data)
+		}
+		renderJSON(ctx, entry)
 		return
 	}
-	b, err := base64.URLEncoding.DecodeString(mergeKey)
-	if err == nil {
-		mergeKey = string(b)
+	ctx.Return(http.StatusNotFound, "%s %s with %s not found", method, service, mergeKey)
+}
+
+// example:
+// POST to bus://exfe_service/message with merge_key 123, always send on 1366615888, data is {"abc":123}
+// > curl -v "http://127.0.0.1:23334/v3/queue/123/POST/exfe_service/message?update=always&ontime=1366615888" -d '{"abc":123}'
+//
+// if no merge(send one by one), set merge_key to "-"
+//
+// set priority to "instant", "normal"(default) or "bulk". Items due at the same
+// time are dispatched from instant to bulk.
+//
+// recurring job: POST to http://127.0.0.1:23333/v3/clear/tokens with merge_key clear_tokens at 01:00 every day
+// > curl -v "http://127.0.0.1:23334/v3/queue/clear_tokens/POST/aHR0cDovLzEyNy4wLjAuMToyMzMzMy92My9jbGVhci90b2tlbnM=?cron=0+1+*+*+*" -d '{}'
+//
+// or every 600 seconds with every=600. The job is pushed again after each
+// dispatch, even if it's moved to dead letters, and pushing the same key
+// again replaces it.
+func (q Queue) Push(ctx rest.Context, data string) {
+	method, service, mergeKey, ok := bindKey(ctx)
+	if !ok {
+		return
 	}
-	b, err = base64.URLEncoding.DecodeString(service)
-	if err != nil {
-		ctx.Return(http.StatusBadRequest, "service(%s) invalid: %s", service, err)
+	var updateType, cron, priority string
+	var ontime, every int64
+	ctx.Bind("update", &updateType)
+	ctx.Bind("priority", &priority)
+	ctx.Bind("ontime", &ontime)
+	ctx.Bind("cron", &cron)
+	ctx.Bind("every", &every)
+	if err := ctx.BindError(); err != nil {
+		ctx.Return(http.StatusBadRequest, err)
 		return
 	}
-	service = string(b)
 	if updateType == "" {
 		updateType = "once"
 	}
+	lane, err := model.PriorityLane(priority)
+	if err != nil {
+		ctx.Return(http.StatusBadRequest, err)
+		return
+	}
+	key := fmt.Sprintf("%s,%s,%s", method, service, mergeKey)
+
+	if cron != "" || every != 0 {
+		schedule, err := scheduleOf(cron, every)
+		if err != nil {
+			ctx.Return(http.StatusBadRequest, err)
+			return
+		}
+		if ontime == 0 {
+			next := schedule.Next(time.Now())
+			if next.IsZero() {
+				ctx.Return(http.StatusBadRequest, "cron %s never runs", cron)
+				return
+			}
+			ontime = next.Unix()
+		}
+		job := broker.RecurringJob{
+			Key:       key,
+			Priority:  model.Priorities[lane],
+			Cron:      cron,
+			Every:     every,
+			Data:      data,
+			CreatedAt: time.Now().Unix(),
+		}
+		if err := q.recurring.Save(job); err != nil {
+			ctx.Return(http.StatusInternalServerError, err)
+			return
+		}
+		if _, err := q.timer.Delete(key); err != nil {
+			ctx.Return(http.StatusInternalServerError, err)
+			return
+		}
+		updateType = string(delayrepo.Always)
+	}
 
 	if ontime == 0 {
 		ontime = time.Now().Unix()
 	}
 
-	fl := logger.FUNC(method, service, mergeKey, updateType, ontime)
+	fl := logger.FUNC(method, service, mergeKey, updateType, ontime, model.Priorities[lane])
 	defer fl.Quit()
 
-	err = q.timer.Push(delayrepo.UpdateType(updateType), ontime, fmt.Sprintf("%s,%s,%s", method, service, mergeKey), []byte(data))
+	err = q.timer.PushLane(lane, delayrepo.UpdateType(updateType), ontime, key, []byte(data))
 	if err != nil {
 		ctx.Return(http.StatusInternalServerError, err)
 		return
@@ -158,7 +601,278 @@ func (q Queue) Push(ctx rest.Context, data string) {
 }
 
 func (q Queue) Delete(ctx rest.Context) {
-	var method, service, mergeKey string
+	method, service, mergeKey, ok := bindKey(ctx)
+	if !ok {
+		return
+	}
+	fl := logger.FUNC(method, service, mergeKey)
+	defer fl.Quit()
+
+	key := fmt.Sprintf("%s,%s,%s", method, service, mergeKey)
+	recurring, err := q.recurring.Remove(key)
+	if err != nil {
+		ctx.Return(http.StatusInternalServerError, err)
+		return
+	}
+	existed, err := q.timer.Delete(key)
+	if err != nil {
+		ctx.Return(http.StatusInternalServerError, err)
+		return
+	}
+	if !existed && !recurring {
+		ctx.Return(http.StatusNotFound, "%s %s with %s not found", method, service, mergeKey)
+		return
+	}
+	logger.INFO("queue", "delete", method, service, mergeKey)
+	ctx.Return(http.StatusNoContent)
+}
+
+// example:
+// list the newest 20 dead letters
+// > curl -v "http://127.0.0.1:23334/v3/queue/_dead?offset=0&limit=20"
+func (q Queue) ListDead(ctx rest.Context) {
+	var offset, limit int
+	ctx.Bind("offset", &offset)
+	ctx.Bind("limit", &limit)
+	if err := ctx.BindError(); err != nil {
+		ctx.Return(http.StatusBadRequest, err)
+		return
+	}
+	if offset < 0 {
+		ctx.Return(http.StatusBadRequest, "invalid offset: %d", offset)
+		return
+	}
+	if limit <= 0 {
+		limit = 20
+	}
+	letters, err := q.deadLetter.List(offset, limit)
+	if err != nil {
+		ctx.Return(http.StatusInternalServerError, err)
+		return
+	}
+	if letters == nil {
+		letters = []broker.DeadLetter{}
+	}
+	renderJSON(ctx, letters)
+}
+
+func (q Queue) GetDead(ctx rest.Context) {
+	var id string
+	ctx.Bind("id", &id)
+	if err := ctx.BindError(); err != nil {
+		ctx.Return(http.StatusBadRequest, err)
+		return
+	}
+	letter, ok, err := q.deadLetter.Load(id)
+	if err != nil {
+		ctx.Return(http.StatusInternalServerError, err)
+		return
+	}
+	if !ok {
+		ctx.Return(http.StatusNotFound, "dead letter %s not found", id)
+		return
+	}
+	renderJSON(ctx, letter)
+}
+
+// example:
+// push dead letter 12 back to the queue, send it now
+// > curl -v -X POST "http://127.0.0.1:23334/v3/queue/_dead/12"
+func (q Queue) ReplayDead(ctx rest.Context) {
+	var id string
+	ctx.Bind("id", &id)
+	if err := ctx.BindError(); err != nil {
+		ctx.Return(http.StatusBadRequest, err)
+		return
+	}
+	fl := logger.FUNC(id)
+	defer fl.Quit()
+
+	letter, ok, err := q.deadLetter.Load(id)
+	if err != nil {
+		ctx.Return(http.StatusInternalServerError, err)
+		return
+	}
+	if !ok {
+		ctx.Return(http.StatusNotFound, "dead letter %s not found", id)
+		return
+	}
+	lane, err := model.PriorityLane(letter.Priority)
+	if err != nil {
+		ctx.Return(http.StatusInternalServerError, err)
+		return
+	}
+	ontime := time.Now().Unix()
+	for _, data := range letter.Data {
+		err := q.timer.PushLane(lane, delayrepo.Always, ontime, letter.Key, []byte(data))
+		if err != nil {
+			ctx.Return(http.StatusInternalServerError, err)
+			return
+		}
+	}
+	if _, err := q.deadLetter.Remove(id); err != nil {
+		ctx.Return(http.StatusInternalServerError, err)
+		return
+	}
+	logger.INFO("queue", "replay", letter.Key, id)
+}
+
+func (q Queue) RemoveDead(ctx rest.Context) {
+	var id string
+	ctx.Bind("id", &id)
+	if err := ctx.BindError(); err != nil {
+		ctx.Return(http.StatusBadRequest, err)
+		return
+	}
+	ok, err := q.deadLetter.Remove(id)
+	if err != nil {
+		ctx.Return(http.StatusInternalServerError, err)
+		return
+	}
+	if !ok {
+		ctx.Return(http.StatusNotFound, "dead letter %s not found", id)
+		return
+	}
+	logger.INFO("queue", "remove dead", id)
+	ctx.Return(http.StatusNoContent)
+}
+
+func (q Queue) PurgeDead(ctx rest.Context) {
+	n, err := q.deadLetter.Purge()
+	if err != nil {
+		ctx.Return(http.StatusInternalServerError, err)
+		return
+	}
+	logger.INFO("queue", "purge dead", n)
+	ctx.Return(http.StatusNoContent)
+}
+
+type RecurringEntry struct {
+	Id       string `json:"id"`
+	Method   string `json:"method"`
+	Service  string `json:"service"`
+	MergeKey string `json:"merge_key"`
+	Priority string `json:"priority"`
+	Cron     string `json:"cron,omitempty"`
+	Every    int64  `json:"every,omitempty"`
+	Data     string `json:"data"`
+	Ontime   int64  `json:"ontime"`
+	FireAt   string `json:"fire_at"`
+}
+
+// example:
+// list all recurring jobs
+// > curl -v "http://127.0.0.1:23334/v3/queue/_recurring"
+func (q Queue) ListRecurring(ctx rest.Context) {
+	jobs, err := q.recurring.List()
+	if err != nil {
+		ctx.Return(http.StatusInternalServerError, err)
+		return
+	}
+	ret := make([]RecurringEntry, 0, len(jobs))
+	for _, job := range jobs {
+		method, service, mergeKey, ok := splitKey(job.Key)
+		if !ok {
+			continue
+		}
+		lane, err := model.PriorityLane(job.Priority)
+		if err != nil {
+			logger.ERROR("recurring job %s invalid: %s", job.Key, err)
+			continue
+		}
+		ontime, err := q.storages[lane].Ontime(job.Key)
+		if err != nil {
+			ctx.Return(http.StatusInternalServerError, err)
+			return
+		}
+		entry := RecurringEntry{
+			Id:       base64.URLEncoding.EncodeToString([]byte(job.Key)),
+			Method:   method,
+			Service:  service,
+			MergeKey: mergeKey,
+			Priority: model.Priorities[lane],
+			Cron:     job.Cron,
+			Every:    job.Every,
+			Data:     job.Data,
+			Ontime:   ontime,
+		}
+		if ontime > 0 {
+			entry.FireAt = time.Unix(ontime, 0).UTC().Format(time.RFC3339)
+		}
+		ret = append(ret, entry)
+	}
+	renderJSON(ctx, ret)
+}
+
+// example:
+// cancel recurring job with id from list, and drop its pending data
+// > curl -v -XDELETE "http://127.0.0.1:23334/v3/queue/_recurring/UE9TVCxodHRwOi8vMTI3LjAuMC4xOjIzMzMzL3YzL2NsZWFyL3Rva2VucyxjbGVhcl90b2tlbnM="
+func (q Queue) CancelRecurring(ctx rest.Context) {
+	var id string
+	ctx.Bind("id", &id)
+	if err := ctx.BindError(); err != nil {
+		ctx.Return(http.StatusBadRequest, err)
+		return
+	}
+	b, err := base64.URLEncoding.DecodeString(id)
+	if err != nil {
+		ctx.Return(http.StatusBadRequest, "invalid id %s: %s", id, err)
+		return
+	}
+	key := string(b)
+	ok, err := q.recurring.Remove(key)
+	if err != nil {
+		ctx.Return(http.StatusInternalServerError, err)
+		return
+	}
+	if !ok {
+		ctx.Return(http.StatusNotFound, "recurring job %s not found", key)
+		return
+	}
+	if _, err := q.timer.Delete(key); err != nil {
+		ctx.Return(http.StatusInternalServerError, err)
+		return
+	}
+	logger.INFO("queue", "cancel", key)
+	ctx.Return(http.StatusNoContent)
+}
+
+// scheduleOf parses a cron expression, or every in seconds.
+func scheduleOf(cron string, every int64) (delayrepo.Schedule, error) {
+	if cron != "" && every != 0 {
+		return nil, fmt.Errorf("set only one of cron and every")
+	}
+	if cron != "" {
+		return delayrepo.ParseCron(cron)
+	}
+	if every <= 0 {
+		return nil, fmt.Errorf("invalid every: %d", every)
+	}
+	return delayrepo.Every(time.Duration(every) * time.Second), nil
+}
+
+func renderJSON(ctx rest.Context, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		ctx.Return(http.StatusInternalServerError, err)
+		return
+	}
+	ctx.Response().Header().Set("Content-Type", "application/json")
+	ctx.Render(string(b))
+}
+
+// splitKey decodes timer key "method,service,mergeKey".
+func splitKey(key string) (method, service, mergeKey string, ok bool) {
+	splits := strings.Split(key, ",")
+	if len(splits) != 3 {
+		return "", "", "", false
+	}
+	return splits[0], splits[1], splits[2], true
+}
+
+// bindKey binds method, service and merge_key in url. If failed, it returns
+// bad request to ctx and ok is false.
+func bindKey(ctx rest.Context) (method, service, mergeKey string, ok bool) {
 	ctx.Bind("method", &method)
 	ctx.Bind("service", &service)
 	ctx.Bind("merge_key", &mergeKey)
@@ -188,13 +902,6 @@ func (q Queue) Delete(ctx rest.Context) {
 		return
 	}
 	service = string(b)
-	fl := logger.FUNC(method, service, mergeKey)
-	defer fl.Quit()
-
-	err = q.timer.Delete(fmt.Sprintf("%s,%s,%s", method, service, mergeKey))
-	if err != nil {
-		ctx.Return(http.StatusInternalServerError, err)
-		return
-	}
-	logger.INFO("queue", "delete", method, service, mergeKey)
+	ok = true
+	return
 }
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"broker"
+	"delayrepo"
+	"github.com/stretchrcom/testify/assert"
+	"io/ioutil"
+	"model"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecurringDead(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "failed", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	var config model.Config
+	config.ExfeQueue.Retry.MaxAttempts = 1
+	storages := make([]Storage, len(model.Priorities))
+	for lane := range storages {
+		storages[lane] = delayrepo.NewMemoryStorage()
+	}
+	deadLetter, recurring := delayrepo.NewMemoryDeadLetter(), delayrepo.NewMemoryRecurring()
+	q, err := NewQueue(&config, storages, deadLetter, recurring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Quit()
+
+	key := "POST," + server.URL + ",job"
+	assert.Equal(t, recurring.Save(broker.RecurringJob{Key: key, Priority: "normal", Every: 600, Data: "{}"}), nil)
+	lane, _ := model.PriorityLane("normal")
+
+	before := time.Now().Unix()
+	assert.Equal(t, q.Do(lane, key, [][]byte{[]byte("{}")}), nil)
+
+	letters, err := deadLetter.List(0, 10)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(letters), 1)
+	assert.Equal(t, letters[0].Key, key)
+
+	// the job runs again at next schedule, though this one is dead.
+	ontime, err := storages[lane].Ontime(key)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ontime >= before+600, true)
+}
+
+func TestRetryPerItem(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if strings.Contains(string(body), "bad") {
+			http.Error(w, "failed", http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	var config model.Config
+	config.ExfeQueue.Retry.MaxAttempts = 2
+	storages := make([]Storage, len(model.Priorities))
+	for lane := range storages {
+		storages[lane] = delayrepo.NewMemoryStorage()
+	}
+	deadLetter := delayrepo.NewMemoryDeadLetter()
+	q, err := NewQueue(&config, storages, deadLetter, delayrepo.NewMemoryRecurring())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Quit()
+
+	key := "POST," + server.URL + ",-"
+	lane, _ := model.PriorityLane("normal")
+	datas := [][]byte{[]byte(`"bad1"`), []byte(`"bad2"`), []byte(`"bad3"`), []byte(`"good"`)}
+
+	// each bad item failed once, none is dead yet.
+	assert.Equal(t, q.Do(lane, key, datas), nil)
+	letters, err := deadLetter.List(0, 10)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(letters), 0)
+
+	assert.Equal(t, q.Do(lane, key, datas), nil)
+	letters, err = deadLetter.List(0, 10)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(letters), 3)
+	for _, letter := range letters {
+		assert.Equal(t, letter.Key, key)
+		assert.Equal(t, len(letter.Data), 1)
+		assert.Equal(t, strings.HasPrefix(letter.Data[0], `"bad`), true)
+	}
+}
+
+func TestPostponeBusyHost(t *testing.T) {
+	hits := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+	}))
+	defer server.Close()
+
+	var config model.Config
+	config.ExfeQueue.Dispatch.HostConcurrency = 1
+	storages := make([]Storage, len(model.Priorities))
+	for lane := range storages {
+		storages[lane] = delayrepo.NewMemoryStorage()
+	}
+	q, err := NewQueue(&config, storages, delayrepo.NewMemoryDeadLetter(), delayrepo.NewMemoryRecurring())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Quit()
+	q.visibility = 200 * time.Millisecond
+
+	release, ok := q.hosts.Acquire(server.URL, time.Now())
+	assert.Equal(t, ok, true)
+	defer release()
+	lane, _ := model.PriorityLane("normal")
+
+	key := "POST," + server.URL + ",-"
+	before := time.Now().Unix()
+	assert.Equal(t, q.Do(lane, key, [][]byte{[]byte("{}")}), nil)
+	ontime, err := storages[lane].Ontime(key)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ontime >= before+int64(q.timeout/time.Second), true)
+
+	assert.NotEqual(t, q.Do(lane, "POST,"+server.URL+",merged", [][]byte{[]byte("{}")}), nil)
+	assert.Equal(t, hits, 0)
+}
@@ -26,6 +26,7 @@ type LiveService struct {
 	rand      *rand.Rand
 	tokens    map[string]bool
 	broadcast map[string]*broadcast.Broadcast
+	quit      chan struct{}
 }
 
 func NewLive(config *model.Config, platform *broker.Platform) (*LiveService, error) {
@@ -35,6 +36,7 @@ func NewLive(config *model.Config, platform *broker.Platform) (*LiveService, err
 		rand:      rand.New(rand.NewSource(time.Now().Unix())),
 		platform:  platform,
 		broadcast: make(map[string]*broadcast.Broadcast),
+		quit:      make(chan struct{}),
 	}
 
 	go service.here.Serve()
@@ -163,6 +165,17 @@ func (h LiveService) Streaming(ctx rest.StreamContext) {
 			if err != nil {
 				return
 			}
+		case <-h.quit:
+			return
 		}
 	}
 }
+
+// StopStreaming ends all streaming requests.
+func (h *LiveService) StopStreaming() {
+	close(h.quit)
+}
+
+func (h *LiveService) Quit() {
+	h.here.Quit()
+}
@@ -12,7 +12,6 @@ import (
 	"iom"
 	"logger"
 	"model"
-	"net/http"
 	"notifier"
 	"os"
 	"routex"
@@ -24,7 +23,7 @@ import (
 
 func main() {
 	var config model.Config
-	quit := daemon.Init("exfe.json", &config)
+	shutdown := daemon.Init("exfe.json", &config)
 
 	if config.Proxy != "" {
 		broker.SetProxy(config.Proxy)
@@ -83,12 +82,30 @@ func main() {
 		os.Exit(-1)
 		return
 	}
+	for name, weights := range config.Notifier.Experiments {
+		if err := localTemplate.SetExperiment(name, weights); err != nil {
+			logger.ERROR("invalid experiment: %s", err)
+			os.Exit(-1)
+			return
+		}
+	}
 	platform, err := broker.NewPlatform(&config)
 	if err != nil {
 		logger.ERROR("can't create platform: %s", err)
 		os.Exit(-1)
 		return
 	}
+	switch config.PlatformCache.Backend {
+	case "":
+	case "memory":
+		platform.SetCache(broker.NewMemoryCache())
+	case "redis":
+		platform.SetCache(broker.NewRedisCache("exfe:v3:platform", cachePool))
+	default:
+		logger.ERROR("invalid platform cache: %s", config.PlatformCache.Backend)
+		os.Exit(-1)
+		return
+	}
 
 	addr := fmt.Sprintf("%s:%d", config.ExfeService.Addr, config.ExfeService.Port)
 	logger.NOTICE("start at %s", addr)
@@ -112,11 +129,6 @@ func main() {
 	status := NewStatus()
 	reg("status", status, nil)
 
-	if config.ExfeService.Services.Live {
-		live, err := NewLive(&config, platform)
-		reg("live", live, err)
-	}
-
 	if config.ExfeService.Services.Token {
 		repo, err := NewTokenRepo(&config, database)
 		if err != nil {
@@ -136,6 +148,17 @@ func main() {
 	if config.ExfeService.Services.Thirdpart {
 		poster, err := registerThirdpart(&config, platform)
 		reg("poster", poster, err)
+		poster.SetStream(broker.NewStream("exfe:v3:poster:response", 10000, redisPool))
+		shutdown.OnDrain("poster watch", poster.StopWatch)
+		shutdown.OnQuit("poster", poster.Quit)
+	}
+
+	// live(Here) quits after poster(Valve).
+	if config.ExfeService.Services.Live {
+		live, err := NewLive(&config, platform)
+		reg("live", live, err)
+		shutdown.OnDrain("live streaming", live.StopStreaming)
+		shutdown.OnQuit("live", live.Quit)
 	}
 
 	if config.ExfeService.Services.Notifier {
@@ -144,12 +167,28 @@ func main() {
 			logger.ERROR("can't setup response")
 			return
 		}
+		deliveryLog := broker.NewDeliveryLog("exfe:v3:notifier:delivery", redisPool)
+		notifier.SetupDelivery(deliveryLog)
+		reg("notifier/deliveries", notifier.NewDelivery(deliveryLog), nil)
+		preferences := broker.NewPreferenceSaver("exfe:v3:notifier", redisPool)
+		notifier.SetupPreference(preferences)
+		reg("notifier/preferences", notifier.NewPreference(preferences), nil)
+		tokenRepo, err := NewTokenRepo(&config, database)
+		if err != nil {
+			logger.ERROR("can't create token repo: %s", err)
+			os.Exit(-1)
+			return
+		}
+		tokens := token.New(tokenRepo)
+		notifier.SetupUnsubscribe(&config, localTemplate, tokens)
+		reg("notifier/unsubscribe", notifier.NewUnsubscribe(tokens, preferences), nil)
 		user := notifier.NewUser(localTemplate, &config, platform)
 		reg("notifier/user", user, nil)
 		cross := notifier.NewCross(localTemplate, &config, platform)
 		reg("notifier/cross", cross, nil)
 		routex := notifier.NewRoutex(localTemplate, &config, platform)
 		reg("notifier/routex", routex, nil)
+		shutdown.OnDrain("notifier", notifier.Drain)
 	}
 
 	if config.ExfeService.Services.Iom {
@@ -173,17 +212,12 @@ func main() {
 		reg("routex", rx, err)
 	}
 
-	go func() {
-		<-quit
-		logger.NOTICE("quit")
-		os.Exit(-1)
-		return
-	}()
 	defer func() {
-		re := recover()
-		logger.ERROR("crashed: %s", re)
+		if re := recover(); re != nil {
+			logger.ERROR("crashed: %s", re)
+		}
 	}()
-	err = http.ListenAndServe(addr, r)
+	err = shutdown.ListenAndServe(addr, r)
 	if err != nil {
 		logger.ERROR("gobus launch failed: %s", err)
 		os.Exit(-1)
@@ -16,6 +16,7 @@ import (
 	"thirdpart/dropbox"
 	"thirdpart/email"
 	"thirdpart/facebook"
+	"thirdpart/fcm"
 	"thirdpart/gcm"
 	// "thirdpart/imessage"
 	"thirdpart/phone"
@@ -25,7 +26,7 @@ import (
 )
 
 func registerThirdpart(config *model.Config, platform *broker.Platform) (*thirdpart.Poster, error) {
-	poster, err := thirdpart.NewPoster()
+	poster, err := thirdpart.NewPoster(config)
 	if err != nil {
 		return nil, err
 	}
@@ -34,6 +35,16 @@ func registerThirdpart(config *model.Config, platform *broker.Platform) (*thirdp
 		return nil, fmt.Errorf("config.Thirdpart.MaxStateCache should be bigger than 0")
 	}
 
+	// stop pushing to uninstalled apps, with the identities of dead tokens
+	// revoked or rewritten.
+	poster.SetDeviceTokenHandler(func(event thirdpart.DeviceToken) {
+		go func() {
+			if err := platform.UpdateDeviceToken(event.Provider, event.Token, event.NewToken); err != nil {
+				logger.ERROR("update device token %s@%s to %q failed: %s", event.Token, event.Provider, event.NewToken, err)
+			}
+		}()
+	})
+
 	gcms_ := gcms.New(config.Thirdpart.Gcm.Key)
 	helper := thirdpart.NewHelper(config)
 
@@ -55,8 +66,16 @@ func registerThirdpart(config *model.Config, platform *broker.Platform) (*thirdp
 	}
 	poster.Add(apn_)
 
-	gcm_ := gcm.New(gcms_)
-	poster.Add(gcm_)
+	if config.Thirdpart.Fcm.ServiceAccount != "" {
+		fcm_, err := fcm.New(config)
+		if err != nil {
+			return nil, fmt.Errorf("can't create fcm: %s", err)
+		}
+		poster.Add(fcm_)
+	} else {
+		gcm_ := gcm.New(gcms_)
+		poster.Add(gcm_)
+	}
 
 	// imsg_, err := imessage.New(config)
 	// if err != nil {
@@ -19,6 +19,7 @@ type BigPack struct {
 	Method     string                 `json:"method"`
 	Service    string                 `json:"service"`
 	Update     string                 `json:"update"`
+	Priority   string                 `json:"priority"`
 	Ontime     int64                  `json:"ontime"`
 	Data       map[string]interface{} `json:"data"`
 }
@@ -51,9 +51,16 @@ func (s Splitter) Split(ctx rest.Context, pack BigPack) {
 		return
 	}
 
-	fl := logger.FUNC(pack.Method, string(b), pack.MergeKey, pack.Update, pack.Ontime, pack.Recipients)
+	fl := logger.FUNC(pack.Method, string(b), pack.MergeKey, pack.Update, pack.Ontime, pack.Priority, pack.Recipients)
 	defer fl.Quit()
 
+	if pack.Priority == "" {
+		pack.Priority = model.PriorityNormal
+	}
+	if _, err := model.PriorityLane(pack.Priority); err != nil {
+		ctx.Return(http.StatusBadRequest, err)
+		return
+	}
 	pack.Ontime = s.speedon(pack.Ontime)
 
 	for _, to := range pack.Recipients {
@@ -61,7 +68,7 @@ func (s Splitter) Split(ctx rest.Context, pack BigPack) {
 		mergeKey = base64.URLEncoding.EncodeToString([]byte(mergeKey))
 		pack.Data["to"] = to
 
-		url := fmt.Sprintf("http://%s:%d/v3/queue/%s/%s/%s?ontime=%d&update=%s", s.queueSite, s.config.ExfeQueue.Port, mergeKey, pack.Method, pack.Service, pack.Ontime, pack.Update)
+		url := fmt.Sprintf("http://%s:%d/v3/queue/%s/%s/%s?ontime=%d&update=%s&priority=%s", s.queueSite, s.config.ExfeQueue.Port, mergeKey, pack.Method, pack.Service, pack.Ontime, pack.Update, pack.Priority)
 		b, err := json.Marshal(pack.Data)
 		if err != nil {
 			ctx.Return(http.StatusBadRequest, err)
@@ -101,7 +108,9 @@ func (s Splitter) Delete(ctx rest.Context, pack BigPack) {
 		logger.INFO("splitter", to, "delete", url)
 		go func(url string) {
 			resp, err := broker.HttpResponse(broker.Http("DELETE", url, "plain/text", nil))
-			if err != nil {
+			if e, ok := err.(broker.HttpError); ok && e.Code == http.StatusNotFound {
+				logger.DEBUG("delete %s: not in queue", url)
+			} else if err != nil {
 				logger.ERROR("delete %s error: %s", url, err)
 			} else {
 				resp.Close()
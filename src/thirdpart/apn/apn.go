@@ -3,11 +3,9 @@ package apn
 import (
 	"apns"
 	"broker"
-	"encoding/json"
 	"fmt"
 	"logger"
 	"model"
-	"regexp"
 	"strings"
 	"sync"
 	"thirdpart"
@@ -19,39 +17,83 @@ type sendArg struct {
 	content string
 }
 
+// sender sends notifications with the legacy binary protocol(apns.Apn), or
+// the HTTP/2 provider API(apns.HTTP2).
+type sender interface {
+	Send(notification *apns.Notification) error
+}
+
+type app struct {
+	sender sender
+	topic  string
+}
+
+// recentSize is how many sent device tokens are kept, to find the token of
+// an error response of binary protocol, which has the identifier only.
+const recentSize = 1024
+
+type recentToken struct {
+	identifier uint32
+	token      string
+}
+
 type Apn struct {
 	id         uint32
-	apps       map[string]*apns.Apn
+	apps       map[string]app
 	defaultApp string
 	callback   thirdpart.Callback
+	tokens     thirdpart.DeviceTokenHandler
+	recent     [recentSize]recentToken
 	locker     sync.RWMutex
 }
 
 func New(config *model.Config) (*Apn, error) {
 	ret := &Apn{
 		id:         0,
-		apps:       make(map[string]*apns.Apn),
+		apps:       make(map[string]app),
 		defaultApp: config.Thirdpart.Apn.Default,
 	}
-	for k, app := range config.Thirdpart.Apn.Apps {
-		apn, err := apns.New(app.Server, app.Cert, app.Key, broker.NetworkTimeout)
+	for k, conf := range config.Thirdpart.Apn.Apps {
+		switch conf.Protocol {
+		case "", "binary":
+		case "http2":
+			apn, err := apns.NewHTTP2(conf.Server, conf.RootCA, conf.AuthKey, conf.KeyId, conf.TeamId, broker.NetworkTimeout)
+			if err != nil {
+				return nil, fmt.Errorf("apn %s error: %s", k, err)
+			}
+			ret.apps[k] = app{
+				sender: apn,
+				topic:  conf.Topic,
+			}
+			continue
+		default:
+			return nil, fmt.Errorf("apn %s invalid protocol: %s", k, conf.Protocol)
+		}
+		apn, err := apns.New(conf.Server, conf.Cert, conf.Key, broker.NetworkTimeout)
 		if err != nil {
 			return nil, fmt.Errorf("apn %s error: %s", k, err)
 		}
-		ret.apps[k] = apn
-		go func(name string) {
+		ret.apps[k] = app{
+			sender: apn,
+			topic:  conf.Topic,
+		}
+		go func(name string, apn *apns.Apn) {
 			for {
 				err := apn.Serve()
 				if notificationError, ok := err.(apns.NotificationError); ok && notificationError.Status == apns.ErrorInvalidToken {
 					ret.locker.RLock()
 					ret.callback(ret.postId(name, notificationError.Identifier), notificationError)
+					token, ok := ret.recentToken(notificationError.Identifier)
 					ret.locker.RUnlock()
+					if ok {
+						ret.invalidToken(token, "InvalidToken")
+					}
 				} else {
 					logger.ERROR("app %s push error: %s", name, err)
 					time.Sleep(time.Minute)
 				}
 			}
-		}(k)
+		}(k, apn)
 	}
 
 	return ret, nil
@@ -61,6 +103,36 @@ func (a *Apn) postId(app string, id uint32) string {
 	return fmt.Sprintf("%s-%d", app, id)
 }
 
+func (a *Apn) SetDeviceTokenHandler(f thirdpart.DeviceTokenHandler) {
+	a.locker.Lock()
+	defer a.locker.Unlock()
+	a.tokens = f
+}
+
+// recentToken returns the device token(with @app) sent with identifier, if it's
+// still kept.
+func (a *Apn) recentToken(identifier uint32) (string, bool) {
+	recent := a.recent[identifier%recentSize]
+	if recent.token == "" || recent.identifier != identifier {
+		return "", false
+	}
+	return recent.token, true
+}
+
+func (a *Apn) invalidToken(token, reason string) {
+	a.locker.RLock()
+	f := a.tokens
+	a.locker.RUnlock()
+	if f == nil {
+		return
+	}
+	f(thirdpart.DeviceToken{
+		Provider: a.Provider(),
+		Token:    token,
+		Reason:   reason,
+	})
+}
+
 func (a *Apn) Provider() string {
 	return "iOS"
 }
@@ -73,40 +145,34 @@ func (a *Apn) SetPosterCallback(callback thirdpart.Callback) (time.Duration, boo
 }
 
 func (a *Apn) Post(from, id, text string) (string, error) {
-	text = strings.Trim(text, " \r\n")
-	last := strings.LastIndex(text, "\n")
-	if last == -1 {
-		return "", fmt.Errorf("no payload")
-	}
-	dataStr := text[last+1:]
-	var data map[string]interface{}
-	err := json.Unmarshal([]byte(dataStr), &data)
+	push, err := thirdpart.ParsePush(text)
 	if err != nil {
-		return "", fmt.Errorf("last line of text(%s) can't unmarshal: %s", dataStr, err)
+		return "", err
 	}
-	text = strings.Trim(text[:last], " \r\n")
-	text = tailUrlRegex.ReplaceAllString(text, "")
 
 	a.locker.Lock()
 	ret := a.id
 	a.id++
+	a.recent[ret%recentSize] = recentToken{ret, id}
 	a.locker.Unlock()
 
 	payload := apns.Payload{}
-	payload.Aps.Alert.Body = text
-	payload.Aps.Badge = 1
-	payload.Aps.Sound = "default"
-	if data != nil {
-		for k, v := range data {
-			payload.SetCustom(k, v)
-		}
+	payload.Aps.Alert.Title = push.Title
+	payload.Aps.Alert.Subtitle = push.Subtitle
+	payload.Aps.Alert.Body = push.Text
+	payload.Aps.Alert.LockKey = push.LocKey
+	payload.Aps.Alert.LockArgs = push.LocArgs
+	payload.Aps.Badge = push.Badge
+	payload.Aps.Sound = push.Sound
+	payload.Aps.Category = push.Category
+	payload.Aps.ThreadId = push.ThreadId
+	if push.MutableContent {
+		payload.Aps.MutableContent = 1
 	}
-	notification := apns.Notification{
-		DeviceToken: id,
-		Identifier:  ret,
-		Payload:     &payload,
+	for k, v := range push.Data {
+		payload.SetCustom(k, v)
 	}
-
+	token := id
 	spliter := strings.LastIndex(id, "@")
 	appName := a.defaultApp
 	if spliter >= 0 {
@@ -114,13 +180,29 @@ func (a *Apn) Post(from, id, text string) (string, error) {
 		id = id[:spliter]
 	}
 
-	retId := a.postId(appName, notification.Identifier)
+	retId := a.postId(appName, ret)
 	app, ok := a.apps[appName]
 	if !ok {
 		return retId, fmt.Errorf("invalid app name: %s", appName)
 	}
-	err = app.Send(&notification)
+	notification := apns.Notification{
+		DeviceToken: id,
+		Identifier:  ret,
+		Topic:       app.topic,
+		Priority:    10,
+		Payload:     &payload,
+	}
+	// notifications of a cross replace the former one on device.
+	if id := push.CrossId(); id != "" {
+		notification.CollapseId = fmt.Sprintf("cross-%s", id)
+	}
+	err = app.sender.Send(&notification)
+	if e, ok := err.(apns.HTTP2Error); ok {
+		if e.InvalidToken() {
+			a.invalidToken(token, e.Reason)
+		} else if e.WrongTopic() {
+			logger.ERROR("app %s push to %s failed, check its topic %s: %s", appName, id, app.topic, e)
+		}
+	}
 	return retId, err
 }
-
-var tailUrlRegex = regexp.MustCompile(` *(http|https):\/\/exfe.com(\/[\w#!:.?+=&%@!\-\/]*)?$`)
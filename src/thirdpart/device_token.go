@@ -0,0 +1,19 @@
+package thirdpart
+
+// DeviceToken is the event that a push provider tells a device token can't be
+// used any more. NewToken is the token replacing it, or "" if the token is
+// invalid, like the app is uninstalled.
+type DeviceToken struct {
+	Provider string `json:"provider"`
+	Token    string `json:"token"`
+	NewToken string `json:"new_token,omitempty"`
+	Reason   string `json:"reason"`
+}
+
+type DeviceTokenHandler func(event DeviceToken)
+
+// DeviceTokenReporter is the poster of push provider which reports device
+// token events.
+type DeviceTokenReporter interface {
+	SetDeviceTokenHandler(f DeviceTokenHandler)
+}
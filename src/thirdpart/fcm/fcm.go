@@ -0,0 +1,352 @@
+package fcm
+
+import (
+	"broker"
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"logger"
+	"model"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"thirdpart"
+	"time"
+)
+
+const (
+	defaultEndpoint = "https://fcm.googleapis.com"
+	messagingScope  = "https://www.googleapis.com/auth/firebase.messaging"
+	defaultTTL      = 24 * time.Hour
+)
+
+type serviceAccount struct {
+	ProjectId   string `json:"project_id"`
+	PrivateKey  string `json:"private_key"`
+	ClientEmail string `json:"client_email"`
+	TokenUri    string `json:"token_uri"`
+}
+
+// Error is the error of FCM v1 API, Code is the FcmError code like
+// "UNREGISTERED", or the status like "INVALID_ARGUMENT" if no detail.
+type Error struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e Error) Error() string {
+	return fmt.Sprintf("(%d %s)%s", e.Status, e.Code, e.Message)
+}
+
+// RecipientError returns true if the error is of the registration token or
+// the message, not of FCM.
+func (e Error) RecipientError() bool {
+	switch e.Code {
+	case "UNREGISTERED", "INVALID_ARGUMENT", "SENDER_ID_MISMATCH":
+		return true
+	}
+	return false
+}
+
+// An FCM posts to Android with FCM HTTP v1 API, authorized by the service
+// account. Post returns after FCM accepts or rejects the message, like GCM.
+type FCM struct {
+	endpoint string
+	account  serviceAccount
+	key      *rsa.PrivateKey
+	ttl      time.Duration
+	client   *http.Client
+
+	tokens thirdpart.DeviceTokenHandler
+	locker sync.RWMutex
+
+	accessToken string
+	expiredAt   time.Time
+	tokenLocker sync.Mutex
+}
+
+func New(config *model.Config) (*FCM, error) {
+	b, err := ioutil.ReadFile(config.Thirdpart.Fcm.ServiceAccount)
+	if err != nil {
+		return nil, err
+	}
+	var account serviceAccount
+	if err := json.Unmarshal(b, &account); err != nil {
+		return nil, fmt.Errorf("invalid service account %s: %s", config.Thirdpart.Fcm.ServiceAccount, err)
+	}
+	key, err := parsePrivateKey([]byte(account.PrivateKey))
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key of %s: %s", account.ClientEmail, err)
+	}
+	endpoint := config.Thirdpart.Fcm.Endpoint
+	if endpoint == "" {
+		endpoint = defaultEndpoint
+	}
+	ttl := time.Duration(config.Thirdpart.Fcm.TTLInSecond) * time.Second
+	if ttl <= 0 {
+		ttl = defaultTTL
+	}
+	return &FCM{
+		endpoint: strings.TrimRight(endpoint, "/"),
+		account:  account,
+		key:      key,
+		ttl:      ttl,
+		client:   &http.Client{Timeout: broker.NetworkTimeout},
+	}, nil
+}
+
+func parsePrivateKey(b []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no pem block")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ret, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("not a rsa key")
+	}
+	return ret, nil
+}
+
+func (f *FCM) Provider() string {
+	return "Android"
+}
+
+func (f *FCM) SetPosterCallback(callback thirdpart.Callback) (time.Duration, bool) {
+	return 0, true
+}
+
+func (f *FCM) SetDeviceTokenHandler(handler thirdpart.DeviceTokenHandler) {
+	f.locker.Lock()
+	defer f.locker.Unlock()
+	f.tokens = handler
+}
+
+// Post sends push text to registration token id, and returns the message
+// name. The data of push can have "ttl" in seconds. Push without text is sent
+// as data message.
+func (f *FCM) Post(from, id, text string) (string, error) {
+	push, err := thirdpart.ParsePush(text)
+	if err != nil {
+		return "", err
+	}
+
+	name, err := f.send(f.message(id, push))
+	if err != nil {
+		logger.ERROR("send to %s@Android failed: %s", id, err)
+		f.fail(id, err)
+		return "", err
+	}
+	logger.DEBUG("send to %s@Android: %s", id, name)
+	return name, nil
+}
+
+type notification struct {
+	Title string `json:"title,omitempty"`
+	Body  string `json:"body,omitempty"`
+}
+
+type androidConfig struct {
+	CollapseKey string `json:"collapse_key,omitempty"`
+	Priority    string `json:"priority,omitempty"`
+	TTL         string `json:"ttl,omitempty"`
+}
+
+type message struct {
+	Token        string            `json:"token"`
+	Data         map[string]string `json:"data,omitempty"`
+	Notification *notification     `json:"notification,omitempty"`
+	Android      androidConfig     `json:"android"`
+}
+
+func (f *FCM) message(token string, push thirdpart.Push) message {
+	ttl := f.ttl
+	if t, ok := push.Data["ttl"].(float64); ok && t > 0 {
+		ttl = time.Duration(t) * time.Second
+		delete(push.Data, "ttl")
+	}
+	ret := message{
+		Token: token,
+		Data:  make(map[string]string),
+		Android: androidConfig{
+			CollapseKey: "exfe",
+			Priority:    "high",
+			TTL:         fmt.Sprintf("%ds", int64(ttl/time.Second)),
+		},
+	}
+	for k, v := range push.Data {
+		ret.Data[k] = fmt.Sprintf("%v", v)
+	}
+	if push.Category != "" {
+		ret.Data["category"] = push.Category
+	}
+	// messages of a cross collapse into one when the device is offline.
+	if id := push.CrossId(); id != "" {
+		ret.Android.CollapseKey = fmt.Sprintf("cross-%s", id)
+	}
+	if push.Text != "" {
+		ret.Notification = &notification{
+			Title: push.Title,
+			Body:  push.Text,
+		}
+		ret.Data["text"] = push.Text
+	}
+	return ret
+}
+
+// send posts msg and returns its message name.
+func (f *FCM) send(msg message) (string, error) {
+	b, err := json.Marshal(map[string]interface{}{"message": msg})
+	if err != nil {
+		return "", err
+	}
+	token, err := f.token()
+	if err != nil {
+		return "", err
+	}
+	u := fmt.Sprintf("%s/v1/projects/%s/messages:send", f.endpoint, f.account.ProjectId)
+	req, err := http.NewRequest("POST", u, bytes.NewReader(b))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		var ret struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&ret); err != nil {
+			return "", err
+		}
+		return ret.Name, nil
+	}
+	var ret struct {
+		Error struct {
+			Message string `json:"message"`
+			Status  string `json:"status"`
+			Details []struct {
+				ErrorCode string `json:"errorCode"`
+			} `json:"details"`
+		} `json:"error"`
+	}
+	e := Error{Status: resp.StatusCode}
+	if err := json.NewDecoder(resp.Body).Decode(&ret); err != nil {
+		e.Message = http.StatusText(resp.StatusCode)
+		return "", e
+	}
+	e.Code, e.Message = ret.Error.Status, ret.Error.Message
+	for _, detail := range ret.Error.Details {
+		if detail.ErrorCode != "" {
+			e.Code = detail.ErrorCode
+		}
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		f.tokenLocker.Lock()
+		f.accessToken = ""
+		f.tokenLocker.Unlock()
+	}
+	return "", e
+}
+
+// fail reports the device token event if token is unregistered.
+func (f *FCM) fail(token string, err error) {
+	f.locker.RLock()
+	tokens := f.tokens
+	f.locker.RUnlock()
+	if e, ok := err.(Error); ok && e.Code == "UNREGISTERED" && tokens != nil {
+		tokens(thirdpart.DeviceToken{
+			Provider: f.Provider(),
+			Token:    token,
+			Reason:   e.Code,
+		})
+	}
+}
+
+// token returns the oauth2 access token of service account, and requests a
+// new one before it expires.
+func (f *FCM) token() (string, error) {
+	f.tokenLocker.Lock()
+	defer f.tokenLocker.Unlock()
+
+	now := time.Now()
+	if f.accessToken != "" && now.Before(f.expiredAt) {
+		return f.accessToken, nil
+	}
+	assertion, err := f.assertion(now)
+	if err != nil {
+		return "", err
+	}
+	form := make(url.Values)
+	form.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+	form.Set("assertion", assertion)
+	resp, err := f.client.PostForm(f.account.TokenUri, form)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return "", fmt.Errorf("get access token failed: (%d)%s", resp.StatusCode, string(b))
+	}
+	var ret struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&ret); err != nil {
+		return "", err
+	}
+	f.accessToken = ret.AccessToken
+	f.expiredAt = now.Add(time.Duration(ret.ExpiresIn)*time.Second - time.Minute)
+	return f.accessToken, nil
+}
+
+// assertion is the JWT of service account signed with RS256.
+func (f *FCM) assertion(now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{
+		"alg": "RS256",
+		"typ": "JWT",
+	})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   f.account.ClientEmail,
+		"scope": messagingScope,
+		"aud":   f.account.TokenUri,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	encoding := base64.RawURLEncoding
+	unsigned := encoding.EncodeToString(header) + "." + encoding.EncodeToString(claims)
+	hash := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, f.key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + encoding.EncodeToString(sig), nil
+}
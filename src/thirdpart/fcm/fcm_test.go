@@ -0,0 +1,148 @@
+package fcm
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/stretchrcom/testify/assert"
+	"io/ioutil"
+	"model"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"thirdpart"
+	"time"
+)
+
+type fakeServer struct {
+	key      *rsa.PrivateKey
+	messages chan map[string]interface{}
+	tokens   int
+}
+
+func (s *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/token":
+		parts := strings.Split(r.FormValue("assertion"), ".")
+		if len(parts) != 3 {
+			http.Error(w, "invalid assertion", http.StatusBadRequest)
+			return
+		}
+		sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if rsa.VerifyPKCS1v15(&s.key.PublicKey, crypto.SHA256, hash[:], sig) != nil {
+			http.Error(w, "invalid assertion", http.StatusBadRequest)
+			return
+		}
+		s.tokens++
+		fmt.Fprintf(w, `{"access_token":"access%d","expires_in":3600}`, s.tokens)
+	case "/v1/projects/exfe/messages:send":
+		if r.Header.Get("Authorization") != "Bearer access1" {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		var body struct {
+			Message map[string]interface{} `json:"message"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		s.messages <- body.Message
+		if body.Message["token"] == "dead" {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":{"code":404,"message":"Requested entity was not found.","status":"NOT_FOUND","details":[{"@type":"type.googleapis.com/google.firebase.fcm.v1.FcmError","errorCode":"UNREGISTERED"}]}}`)
+			return
+		}
+		fmt.Fprint(w, `{"name":"projects/exfe/messages/1"}`)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func testFCM(t *testing.T) (*FCM, *fakeServer, func()) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("generate key failed: %s", err)
+	}
+	fake := &fakeServer{
+		key:      key,
+		messages: make(chan map[string]interface{}, 10),
+	}
+	server := httptest.NewServer(fake)
+
+	b, _ := x509.MarshalPKCS8PrivateKey(key)
+	account, _ := json.Marshal(serviceAccount{
+		ProjectId:   "exfe",
+		PrivateKey:  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: b})),
+		ClientEmail: "bus@exfe.iam.gserviceaccount.com",
+		TokenUri:    server.URL + "/token",
+	})
+	file, _ := ioutil.TempFile("", "fcm")
+	file.Write(account)
+	file.Close()
+
+	var config model.Config
+	config.Thirdpart.Fcm.ServiceAccount = file.Name()
+	config.Thirdpart.Fcm.Endpoint = server.URL
+	config.Thirdpart.Fcm.TTLInSecond = 3600
+	f, err := New(&config)
+	if err != nil {
+		t.Fatalf("new fcm failed: %s", err)
+	}
+	return f, fake, func() {
+		server.Close()
+		os.Remove(file.Name())
+	}
+}
+
+func TestPost(t *testing.T) {
+	f, fake, done := testFCM(t)
+	defer done()
+	waiting, defaultOK := f.SetPosterCallback(func(id string, err error) {
+		t.Errorf("should not call back: %s %s", id, err)
+	})
+	assert.Equal(t, waiting, time.Duration(0))
+	assert.Equal(t, defaultOK, true)
+
+	id, err := f.Post("", "token", "Dinner updated. http://exfe.com/#!token=abc\n{\"path\":\"/!123/cross\"}")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, id, "projects/exfe/messages/1")
+	msg := <-fake.messages
+	assert.Equal(t, msg["token"], "token")
+	assert.Equal(t, msg["notification"], map[string]interface{}{"body": "Dinner updated."})
+	assert.Equal(t, msg["data"], map[string]interface{}{"path": "/!123/cross", "text": "Dinner updated."})
+	assert.Equal(t, msg["android"], map[string]interface{}{"collapse_key": "cross-123", "priority": "high", "ttl": "3600s"})
+
+	// data message without text, with its own ttl
+	_, err = f.Post("", "token", "http://exfe.com/#!token=abc\n{\"ttl\":60,\"badge\":1}")
+	assert.Equal(t, err, nil)
+	msg = <-fake.messages
+	_, ok := msg["notification"]
+	assert.Equal(t, ok, false)
+	assert.Equal(t, msg["data"], map[string]interface{}{"badge": "1"})
+	assert.Equal(t, msg["android"], map[string]interface{}{"collapse_key": "exfe", "priority": "high", "ttl": "60s"})
+
+	// access token is reused
+	assert.Equal(t, fake.tokens, 1)
+}
+
+func TestPostUnregistered(t *testing.T) {
+	f, fake, done := testFCM(t)
+	defer done()
+	events := make(chan thirdpart.DeviceToken, 10)
+	f.SetDeviceTokenHandler(func(event thirdpart.DeviceToken) {
+		events <- event
+	})
+
+	_, err := f.Post("", "dead", "hi\n{}")
+	assert.Equal(t, err, Error{Status: 404, Code: "UNREGISTERED", Message: "Requested entity was not found."})
+	assert.Equal(t, thirdpart.IsRecipientError(err), true)
+	<-fake.messages
+	assert.Equal(t, <-events, thirdpart.DeviceToken{Provider: "Android", Token: "dead", Reason: "UNREGISTERED"})
+}
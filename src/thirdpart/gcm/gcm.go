@@ -1,11 +1,8 @@
 package gcm
 
 import (
-	"encoding/json"
 	"fmt"
 	"github.com/googollee/go-gcm"
-	"regexp"
-	"strings"
 	"thirdpart"
 	"time"
 )
@@ -17,6 +14,7 @@ type Broker interface {
 type GCM struct {
 	broker Broker
 	f      thirdpart.Callback
+	tokens thirdpart.DeviceTokenHandler
 }
 
 func New(broker Broker) *GCM {
@@ -33,47 +31,67 @@ func (g *GCM) SetPosterCallback(callback thirdpart.Callback) (time.Duration, boo
 	return 0, true
 }
 
+func (g *GCM) SetDeviceTokenHandler(f thirdpart.DeviceTokenHandler) {
+	g.tokens = f
+}
+
 func (g *GCM) Post(from, id, text string) (string, error) {
-	text = strings.Trim(text, " \r\n")
-	last := strings.LastIndex(text, "\n")
-	if last != -1 {
-		return "", nil
-	}
-	dataStr := text[last+1:]
-	var data map[string]string
-	err := json.Unmarshal([]byte(dataStr), &data)
+	push, err := thirdpart.ParsePush(text)
 	if err != nil {
-		return "", fmt.Errorf("last line of text(%s) can't unmarshal: %s", dataStr, err)
+		return "", err
 	}
-	text = strings.Trim(text[:last], " \r\n")
-	text = tailUrlRegex.ReplaceAllString(text, "")
 
 	message := gcm.NewMessage(id)
-	message.SetPayload("badge", "1")
-	message.SetPayload("sound", "")
-	if len(data) > 0 {
-		for k, v := range data {
-			message.SetPayload(k, fmt.Sprintf("%v", v))
-		}
+	message.SetPayload("badge", fmt.Sprintf("%d", push.Badge))
+	message.SetPayload("sound", push.Sound)
+	for k, v := range push.Data {
+		message.SetPayload(k, fmt.Sprintf("%v", v))
+	}
+	if push.Title != "" {
+		message.SetPayload("title", push.Title)
+	}
+	if push.Category != "" {
+		message.SetPayload("category", push.Category)
 	}
 	message.DelayWhileIdle = true
 	message.CollapseKey = "exfe"
-	message.SetPayload("text", text)
+	message.SetPayload("text", push.Text)
 	resp, err := g.broker.Send(message)
 	if err != nil {
 		return "", fmt.Errorf("send to %s@Android error: %s", id, err)
 	}
 
-	for i := range resp.Results {
-		if resp.Results[i].RegistrationID != id {
-			continue
-		}
-		if err := resp.Results[i].Error; err != "" {
-			return "", fmt.Errorf("send to %s@Android error: (%s)%s", id, resp.Results[i].MessageID, err)
-		}
-		return resp.Results[i].MessageID, nil
+	if len(resp.Results) == 0 {
+		return "", fmt.Errorf("parse result failed: no result")
 	}
-	return "", fmt.Errorf("parse result failed: no result")
+	// message has one registration id, so only one result.
+	result := resp.Results[0]
+	err = fmt.Errorf("send to %s@Android error: (%s)%s", id, result.MessageID, result.Error)
+	switch result.Error {
+	case "":
+	case "NotRegistered", "InvalidRegistration":
+		g.deviceToken(id, "", result.Error)
+		return "", thirdpart.RecipientError{err}
+	case "MismatchSenderId", "MessageTooBig":
+		return "", thirdpart.RecipientError{err}
+	default:
+		return "", err
+	}
+	// the registration id is replaced by the canonical one.
+	if result.RegistrationID != "" && result.RegistrationID != id {
+		g.deviceToken(id, result.RegistrationID, "CanonicalID")
+	}
+	return result.MessageID, nil
 }
 
-var tailUrlRegex = regexp.MustCompile(` *(http|https):\/\/exfe.com(\/[\w#!:.?+=&%@!\-\/]*)?$`)
+func (g *GCM) deviceToken(token, newToken, reason string) {
+	if g.tokens == nil {
+		return
+	}
+	g.tokens(thirdpart.DeviceToken{
+		Provider: g.Provider(),
+		Token:    token,
+		NewToken: newToken,
+		Reason:   reason,
+	})
+}
@@ -0,0 +1,56 @@
+package gcm
+
+import (
+	"github.com/googollee/go-gcm"
+	"github.com/stretchrcom/testify/assert"
+	"testing"
+	"thirdpart"
+)
+
+type fakeBroker struct {
+	result gcm.Result
+}
+
+func (b *fakeBroker) Send(message *gcm.Message) (*gcm.Response, error) {
+	return &gcm.Response{
+		Results: []gcm.Result{b.result},
+	}, nil
+}
+
+func TestDeviceToken(t *testing.T) {
+	broker := new(fakeBroker)
+	g := New(broker)
+	var events []thirdpart.DeviceToken
+	g.SetDeviceTokenHandler(func(event thirdpart.DeviceToken) {
+		events = append(events, event)
+	})
+	text := "hello\n{\"cid\":\"1\"}"
+
+	broker.result = gcm.Result{MessageID: "1"}
+	id, err := g.Post("", "token", text)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, id, "1")
+	assert.Equal(t, len(events), 0)
+
+	broker.result = gcm.Result{MessageID: "2", RegistrationID: "canonical"}
+	id, err = g.Post("", "token", text)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, id, "2")
+	assert.Equal(t, events, []thirdpart.DeviceToken{
+		{Provider: "Android", Token: "token", NewToken: "canonical", Reason: "CanonicalID"},
+	})
+
+	events = nil
+	broker.result = gcm.Result{Error: "NotRegistered"}
+	_, err = g.Post("", "token", text)
+	assert.NotEqual(t, err, nil)
+	assert.Equal(t, events, []thirdpart.DeviceToken{
+		{Provider: "Android", Token: "token", Reason: "NotRegistered"},
+	})
+
+	events = nil
+	broker.result = gcm.Result{Error: "Unavailable"}
+	_, err = g.Post("", "token", text)
+	assert.NotEqual(t, err, nil)
+	assert.Equal(t, len(events), 0)
+}
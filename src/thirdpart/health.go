@@ -0,0 +1,197 @@
+package thirdpart
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// RecipientError is an error caused by the recipient or the message, like an
+// unregistered device token, rather than by the provider. It doesn't count
+// toward tripping the provider.
+type RecipientError struct {
+	Err error
+}
+
+func (e RecipientError) Error() string {
+	return e.Err.Error()
+}
+
+// IsRecipientError returns true if err is RecipientError, or an error of
+// provider package which says so, like apns.HTTP2Error of a bad token.
+func IsRecipientError(err error) bool {
+	switch e := err.(type) {
+	case RecipientError:
+		return true
+	case interface {
+		RecipientError() bool
+	}:
+		return e.RecipientError()
+	}
+	return false
+}
+
+type CircuitState string
+
+const (
+	CircuitClosed   CircuitState = "closed"
+	CircuitOpen     CircuitState = "open"
+	CircuitHalfOpen CircuitState = "half_open"
+)
+
+// ProviderHealth is the stats of latest results of a provider.
+type ProviderHealth struct {
+	Provider    string       `json:"provider"`
+	State       CircuitState `json:"state"`
+	Requests    int          `json:"requests"`
+	Failures    int          `json:"failures"`
+	LastError   string       `json:"last_error,omitempty"`
+	OpenedAt    int64        `json:"opened_at,omitempty"`
+	TotalOk     int64        `json:"total_ok"`
+	TotalFailed int64        `json:"total_failed"`
+}
+
+// Health keeps the latest window results of each provider. A provider trips
+// open if it has at least minRequests results and the failure rate reaches
+// failureRate. After cooldown it turns half open and the next result decides
+// to close or open again.
+type Health struct {
+	window      int
+	minRequests int
+	failureRate float64
+	cooldown    time.Duration
+	providers   map[string]*providerStats
+	locker      sync.Mutex
+}
+
+type providerStats struct {
+	results  []bool
+	next     int
+	health   ProviderHealth
+	openedAt time.Time
+}
+
+func NewHealth(window, minRequests int, failureRate float64, cooldown time.Duration) *Health {
+	return &Health{
+		window:      window,
+		minRequests: minRequests,
+		failureRate: failureRate,
+		cooldown:    cooldown,
+		providers:   make(map[string]*providerStats),
+	}
+}
+
+// Record adds a result of provider.
+func (h *Health) Record(provider string, ok bool, reason string) {
+	h.locker.Lock()
+	defer h.locker.Unlock()
+
+	s := h.stats(provider)
+	h.update(s, time.Now())
+	if len(s.results) < h.window {
+		s.results = append(s.results, ok)
+	} else {
+		s.results[s.next] = ok
+		s.next = (s.next + 1) % h.window
+	}
+	if ok {
+		s.health.TotalOk++
+	} else {
+		s.health.TotalFailed++
+		s.health.LastError = reason
+	}
+
+	switch s.health.State {
+	case CircuitHalfOpen:
+		if ok {
+			s.health.State = CircuitClosed
+			s.results, s.next = []bool{ok}, 0
+		} else {
+			h.open(s, time.Now())
+		}
+	case CircuitClosed:
+		failures := 0
+		for _, r := range s.results {
+			if !r {
+				failures++
+			}
+		}
+		if len(s.results) >= h.minRequests && float64(failures) >= h.failureRate*float64(len(s.results)) {
+			h.open(s, time.Now())
+		}
+	}
+}
+
+// RecordResponse adds a result from a PostResponse, whose id is
+// "provider-messageid". Failures of the recipient are ignored.
+func (h *Health) RecordResponse(resp PostResponse) {
+	if resp.recipient {
+		return
+	}
+	i := strings.Index(resp.Id, "-")
+	if i <= 0 {
+		return
+	}
+	h.Record(resp.Id[:i], resp.Ok, resp.Error)
+}
+
+// State returns the circuit state of provider.
+func (h *Health) State(provider string) CircuitState {
+	h.locker.Lock()
+	defer h.locker.Unlock()
+
+	s, ok := h.providers[provider]
+	if !ok {
+		return CircuitClosed
+	}
+	h.update(s, time.Now())
+	return s.health.State
+}
+
+// Stats returns the health of all providers which have results.
+func (h *Health) Stats() []ProviderHealth {
+	h.locker.Lock()
+	defer h.locker.Unlock()
+
+	now := time.Now()
+	ret := make([]ProviderHealth, 0, len(h.providers))
+	for _, s := range h.providers {
+		h.update(s, now)
+		health := s.health
+		health.Requests = len(s.results)
+		for _, r := range s.results {
+			if !r {
+				health.Failures++
+			}
+		}
+		ret = append(ret, health)
+	}
+	return ret
+}
+
+func (h *Health) stats(provider string) *providerStats {
+	s, ok := h.providers[provider]
+	if !ok {
+		s = &providerStats{
+			results: make([]bool, 0, h.window),
+			health: ProviderHealth{
+				Provider: provider,
+				State:    CircuitClosed,
+			},
+		}
+		h.providers[provider] = s
+	}
+	return s
+}
+
+func (h *Health) open(s *providerStats, now time.Time) {
+	s.health.State = CircuitOpen
+	s.health.OpenedAt = now.Unix()
+	s.openedAt = now
+}
+
+func (h *Health) update(s *providerStats, now time.Time) {
+	if s.health.State == CircuitOpen && now.Sub(s.openedAt) >= h.cooldown {
+		s.health.State = CircuitHalfOpen
+	}
+}
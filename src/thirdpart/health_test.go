@@ -0,0 +1,93 @@
+package thirdpart
+
+import (
+	"fmt"
+	"github.com/stretchrcom/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestHealthTrip(t *testing.T) {
+	h := NewHealth(10, 4, 0.5, time.Second/2)
+
+	for i := 0; i < 3; i++ {
+		h.Record("twilio", false, "timeout")
+	}
+	// less than min requests
+	assert.Equal(t, h.State("twilio"), CircuitClosed)
+	h.Record("twilio", true, "")
+	assert.Equal(t, h.State("twilio"), CircuitOpen)
+	assert.Equal(t, h.State("email"), CircuitClosed)
+
+	stats := h.Stats()
+	assert.Equal(t, len(stats), 1)
+	assert.Equal(t, stats[0].Provider, "twilio")
+	assert.Equal(t, stats[0].Requests, 4)
+	assert.Equal(t, stats[0].Failures, 3)
+	assert.Equal(t, stats[0].LastError, "timeout")
+
+	time.Sleep(time.Second / 2)
+	assert.Equal(t, h.State("twilio"), CircuitHalfOpen)
+	h.Record("twilio", false, "timeout")
+	assert.Equal(t, h.State("twilio"), CircuitOpen)
+
+	time.Sleep(time.Second / 2)
+	assert.Equal(t, h.State("twilio"), CircuitHalfOpen)
+	h.Record("twilio", true, "")
+	assert.Equal(t, h.State("twilio"), CircuitClosed)
+	h.Record("twilio", false, "timeout")
+	assert.Equal(t, h.State("twilio"), CircuitClosed)
+}
+
+func TestHealthWindow(t *testing.T) {
+	h := NewHealth(4, 4, 0.75, time.Minute)
+
+	h.Record("iOS", false, "bad token")
+	h.Record("iOS", false, "bad token")
+	for i := 0; i < 4; i++ {
+		h.Record("iOS", true, "")
+	}
+	// failures rolled out of window
+	h.Record("iOS", false, "bad token")
+	h.Record("iOS", false, "bad token")
+	assert.Equal(t, h.State("iOS"), CircuitClosed)
+	h.Record("iOS", false, "bad token")
+	assert.Equal(t, h.State("iOS"), CircuitOpen)
+
+	stats := h.Stats()
+	assert.Equal(t, stats[0].TotalOk, int64(4))
+	assert.Equal(t, stats[0].TotalFailed, int64(5))
+}
+
+func TestHealthResponse(t *testing.T) {
+	h := NewHealth(2, 2, 1, time.Minute)
+
+	h.RecordResponse(PostResponse{Id: "iOS-abc-123", Ok: false, Error: "invalid"})
+	h.RecordResponse(PostResponse{Id: "iOS-def", Ok: false, Error: "invalid"})
+	h.RecordResponse(PostResponse{Id: "noprovider", Ok: false})
+	assert.Equal(t, h.State("iOS"), CircuitOpen)
+	assert.Equal(t, len(h.Stats()), 1)
+}
+
+type testTokenError bool
+
+func (e testTokenError) Error() string {
+	return "token error"
+}
+
+func (e testTokenError) RecipientError() bool {
+	return bool(e)
+}
+
+func TestRecipientError(t *testing.T) {
+	assert.Equal(t, IsRecipientError(RecipientError{fmt.Errorf("bad token")}), true)
+	assert.Equal(t, IsRecipientError(testTokenError(true)), true)
+	assert.Equal(t, IsRecipientError(testTokenError(false)), false)
+	assert.Equal(t, IsRecipientError(fmt.Errorf("timeout")), false)
+
+	h := NewHealth(2, 2, 1, time.Minute)
+	h.RecordResponse(PostResponse{Id: "iOS-1", Ok: false, Error: "bad token", recipient: true})
+	h.RecordResponse(PostResponse{Id: "iOS-2", Ok: false, Error: "bad token", recipient: true})
+	assert.Equal(t, h.State("iOS"), CircuitClosed)
+	assert.Equal(t, len(h.Stats()), 0)
+}
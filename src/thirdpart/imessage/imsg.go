@@ -71,6 +71,13 @@ func New(config *model.Config) (*IMessage, error) {
 	return ret, nil
 }
 
+// Quit quits valves of all channels, after their queued messages sent.
+func (im *IMessage) Quit() {
+	for _, v := range im.valves {
+		v.Quit()
+	}
+}
+
 func (im *IMessage) Provider() string {
 	return "imessage"
 }
@@ -1,6 +1,8 @@
 package thirdpart
 
 import (
+	"broker"
+	"encoding/json"
 	"fmt"
 	"github.com/googollee/go-broadcast"
 	"github.com/googollee/go-rest"
@@ -9,6 +11,7 @@ import (
 	"logger"
 	"model"
 	"net/http"
+	"sync"
 	"time"
 )
 
@@ -32,9 +35,13 @@ type IPoster interface {
 }
 
 type PostResponse struct {
+	Seq   uint64 `json:"seq,omitempty"`
 	Id    string `json:"id"`
 	Ok    bool   `json:"ok"`
 	Error string `json:"error"`
+
+	// recipient is true if Error is a RecipientError.
+	recipient bool
 }
 
 type Poster struct {
@@ -43,20 +50,123 @@ type Poster struct {
 	post     rest.SimpleNode `route:"/message/:provider/*id" method:"POST"`
 	response rest.SimpleNode `route:"/response/:provider/*id" method:"POST"`
 	watch    rest.Streaming  `route:"" method:"WATCH"`
+	ack      rest.SimpleNode `route:"/ack/:group/:seq" method:"POST"`
+	health   rest.SimpleNode `route:"/_health" method:"GET"`
 
 	config    *model.Config
 	posters   map[string]posterHandler
 	watchChan *broadcast.Broadcast
+	stats     *Health
+	pending   *pendingPosts
+	stream    *broker.Stream
+	tokens    DeviceTokenHandler
+	quit      chan struct{}
 }
 
-func NewPoster() (*Poster, error) {
+// claimTimeout is how long a response claimed by a group watcher waits for
+// ack, before claimed by others.
+const claimTimeout = time.Minute
+
+// watchBatch is the max count of responses read from stream at once.
+const watchBatch = 100
+
+func NewPoster(config *model.Config) (*Poster, error) {
+	breaker := config.Thirdpart.CircuitBreaker
+	if breaker.Window <= 0 {
+		breaker.Window = 20
+	}
+	if breaker.MinRequests <= 0 {
+		breaker.MinRequests = 10
+	}
+	if breaker.FailureRate <= 0 {
+		breaker.FailureRate = 0.5
+	}
+	if breaker.CooldownInSecond <= 0 {
+		breaker.CooldownInSecond = 60
+	}
 	ret := &Poster{
+		config:    config,
 		posters:   make(map[string]posterHandler),
 		watchChan: broadcast.NewBroadcast(10),
+		stats:     NewHealth(breaker.Window, breaker.MinRequests, breaker.FailureRate, time.Duration(breaker.CooldownInSecond)*time.Second),
+		pending:   newPendingPosts(),
+		quit:      make(chan struct{}),
 	}
+	go ret.watchHealth()
 	return ret, nil
 }
 
+// watchHealth records all responses to health stats.
+func (m *Poster) watchHealth() {
+	c := make(chan interface{})
+	if err := m.watchChan.Register(c); err != nil {
+		logger.ERROR("can't watch responses for health: %s", err)
+		return
+	}
+	defer m.watchChan.Unregister(c)
+
+	for {
+		select {
+		case i := <-c:
+			if resp, ok := i.(PostResponse); ok {
+				m.stats.RecordResponse(resp)
+			}
+		case <-m.quit:
+			return
+		}
+	}
+}
+
+// SetStream saves responses in stream, so WATCH can resume after reconnecting,
+// and watchers of all instances share responses.
+func (m *Poster) SetStream(stream *broker.Stream) {
+	m.stream = stream
+}
+
+// SetDeviceTokenHandler handles device token events of all push posters.
+func (m *Poster) SetDeviceTokenHandler(f DeviceTokenHandler) {
+	m.tokens = f
+}
+
+func (m *Poster) deviceToken(event DeviceToken) {
+	logger.INFO("poster", event.Provider, "device_token", event.Token, event.NewToken, event.Reason)
+	if m.tokens != nil {
+		m.tokens(event)
+	}
+}
+
+// respond saves resp to stream if there is one, and notifies watchers.
+func (m *Poster) respond(resp PostResponse) {
+	if m.stream != nil {
+		b, err := json.Marshal(resp)
+		if err != nil {
+			logger.ERROR("can't marshal response %+v: %s", resp, err)
+		} else if seq, err := m.stream.Append(b); err != nil {
+			logger.ERROR("save response %s to stream failed: %s", resp.Id, err)
+		} else {
+			resp.Seq = seq
+		}
+	}
+	m.watchChan.Send(resp)
+}
+
+// StopWatch ends all WATCH streams.
+func (m *Poster) StopWatch() {
+	close(m.quit)
+}
+
+// Quit quits posters which need, like the valves of imessage.
+func (m *Poster) Quit() {
+	for provider, handler := range m.posters {
+		if q, ok := handler.poster.(interface {
+			Quit()
+		}); ok {
+			logger.NOTICE("quit poster %s", provider)
+			q.Quit()
+		}
+	}
+}
+
 func (m *Poster) Add(poster IPoster) {
 	provider := poster.Provider()
 	waiting, defaultOK := poster.SetPosterCallback(func(id string, err error) {
@@ -66,10 +176,15 @@ func (m *Poster) Add(poster IPoster) {
 		}
 		if !resp.Ok {
 			resp.Error = err.Error()
+			resp.recipient = IsRecipientError(err)
 		}
+		m.pending.done(resp.Id)
 		logger.INFO("poster", provider, "response", id, resp.Ok, resp.Error)
-		m.watchChan.Send(resp)
+		m.respond(resp)
 	})
+	if reporter, ok := poster.(DeviceTokenReporter); ok {
+		reporter.SetDeviceTokenHandler(m.deviceToken)
+	}
 	m.posters[provider] = posterHandler{
 		poster:    poster,
 		waiting:   waiting,
@@ -98,6 +213,9 @@ func (m Poster) Post(ctx rest.Context, text string) {
 	ret, err := handler.poster.Post(ctx.Request().URL.Query().Get("from"), id, text)
 	if err != nil {
 		logger.INFO("poster", provider, "fail", id, err.Error())
+		if !IsRecipientError(err) {
+			m.stats.Record(provider, false, err.Error())
+		}
 		ctx.Return(http.StatusInternalServerError, err)
 		return
 	}
@@ -106,9 +224,16 @@ func (m Poster) Post(ctx rest.Context, text string) {
 		logger.INFO("poster", provider, "waiting", ret, id, "ontime", ontime, fmt.Sprintf("default %v", handler.defaultOK))
 		ctx.Response().Header().Set("Ontime", fmt.Sprintf("%d", ontime))
 		ctx.Response().Header().Set("Default", fmt.Sprintf("%v", handler.defaultOK))
+		if handler.defaultOK {
+			// posters like apn call back only on failures.
+			m.pending.wait(fmt.Sprintf("%s-%s", provider, ret), handler.waiting, func() {
+				m.stats.Record(provider, true, "")
+			})
+		}
 		ctx.Return(http.StatusAccepted)
 	} else {
 		logger.INFO("poster", provider, "ok", ret, id)
+		m.stats.Record(provider, true, "")
 		ctx.Return(http.StatusOK)
 	}
 	ctx.Render(fmt.Sprintf("%s-%s", provider, ret))
@@ -124,10 +249,105 @@ func (m Poster) Response(ctx rest.Context, resp PostResponse) {
 	}
 	logger.INFO("poster", provider, "response", id, resp.Ok, resp.Error)
 	resp.Id = fmt.Sprintf("%s-%s", provider, id)
-	m.watchChan.Send(resp)
+	m.respond(resp)
 }
 
+// Watch streams responses. With a stream set, responses have seq and:
+//
+// WATCH /v3/poster?after=123 resumes from responses after seq 123.
+//
+// WATCH /v3/poster?group=notifier shares responses with other watchers of
+// group notifier, each response is sent to one of them. Watcher should ack the
+// seq after handled, or it's sent again after claim timeout.
 func (m Poster) Watch(ctx rest.StreamContext) {
+	var group string
+	var after uint64
+	ctx.Bind("group", &group)
+	ctx.Bind("after", &after)
+	if err := ctx.BindError(); err != nil {
+		ctx.Return(http.StatusBadRequest, err)
+		return
+	}
+	if m.stream == nil {
+		m.watchLive(ctx)
+		return
+	}
+	if group == "" && ctx.Request().URL.Query().Get("after") == "" {
+		last, err := m.stream.Last()
+		if err != nil {
+			ctx.Return(http.StatusInternalServerError, err)
+			return
+		}
+		after = last
+	}
+
+	c := make(chan interface{})
+	err := m.watchChan.Register(c)
+	if err != nil {
+		ctx.Return(http.StatusBadRequest, err)
+		return
+	}
+	defer m.watchChan.Unregister(c)
+	ctx.Return(http.StatusOK)
+
+	for ctx.Ping() == nil {
+		var entries []broker.StreamEntry
+		if group != "" {
+			entries, err = m.stream.Claim(group, watchBatch, claimTimeout)
+		} else {
+			entries, err = m.stream.Range(after, watchBatch)
+		}
+		if err != nil {
+			logger.ERROR("read response stream failed: %s", err)
+		}
+		for _, entry := range entries {
+			var resp PostResponse
+			if err := json.Unmarshal(entry.Data, &resp); err != nil {
+				logger.ERROR("invalid response %d in stream: %s", entry.Seq, err)
+				continue
+			}
+			resp.Seq = entry.Seq
+			ctx.SetWriteDeadline(time.Now().Add(time.Second))
+			if err := ctx.Render(resp); err != nil {
+				return
+			}
+			after = entry.Seq
+		}
+		if len(entries) == watchBatch {
+			continue
+		}
+		// responses of other instances are only in stream, so poll it
+		// every second.
+		select {
+		case <-c:
+		case <-time.After(time.Second):
+		case <-m.quit:
+			return
+		}
+	}
+}
+
+// Ack marks the response seq handled by the watcher of group.
+func (m Poster) Ack(ctx rest.Context) {
+	var group string
+	var seq uint64
+	ctx.Bind("group", &group)
+	ctx.Bind("seq", &seq)
+	if err := ctx.BindError(); err != nil {
+		ctx.Return(http.StatusBadRequest, err)
+		return
+	}
+	if m.stream == nil {
+		return
+	}
+	if err := m.stream.Ack(group, seq); err != nil {
+		ctx.Return(http.StatusInternalServerError, err)
+		return
+	}
+}
+
+// watchLive streams responses of this instance as they come, without stream.
+func (m Poster) watchLive(ctx rest.StreamContext) {
 	c := make(chan interface{})
 	err := m.watchChan.Register(c)
 	if err != nil {
@@ -145,10 +365,22 @@ func (m Poster) Watch(ctx rest.StreamContext) {
 				return
 			}
 		case <-time.After(time.Second):
+		case <-m.quit:
+			return
 		}
 	}
 }
 
+// Health returns the health stats and circuit state of providers.
+func (m Poster) Health(ctx rest.Context) {
+	b, err := json.Marshal(m.stats.Stats())
+	if err != nil {
+		ctx.Return(http.StatusInternalServerError, err)
+		return
+	}
+	ctx.Render(string(b))
+}
+
 type PlainText struct{}
 
 func (p PlainText) Unmarshal(r io.Reader, v interface{}) error {
@@ -173,3 +405,41 @@ func (p PlainText) Marshal(w io.Writer, name string, v interface{}) error {
 func (p PlainText) Error(code int, message string) error {
 	return fmt.Errorf("(%d)%s", code, message)
 }
+
+// pendingPosts are posts waiting for their responses.
+type pendingPosts struct {
+	timers map[string]*time.Timer
+	locker sync.Mutex
+}
+
+func newPendingPosts() *pendingPosts {
+	return &pendingPosts{
+		timers: make(map[string]*time.Timer),
+	}
+}
+
+// wait calls ok after timeout, if no response of id comes before.
+func (p *pendingPosts) wait(id string, timeout time.Duration, ok func()) {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	p.timers[id] = time.AfterFunc(timeout, func() {
+		if p.done(id) {
+			ok()
+		}
+	})
+}
+
+// done removes id and returns true if it's still waiting.
+func (p *pendingPosts) done(id string) bool {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	t, ok := p.timers[id]
+	if !ok {
+		return false
+	}
+	t.Stop()
+	delete(p.timers, id)
+	return true
+}
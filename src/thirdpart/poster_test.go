@@ -0,0 +1,25 @@
+package thirdpart
+
+import (
+	"github.com/stretchrcom/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestPendingPosts(t *testing.T) {
+	p := newPendingPosts()
+	ok := make(chan string, 2)
+	p.wait("iOS-1", time.Second/10, func() { ok <- "iOS-1" })
+	p.wait("iOS-2", time.Second/10, func() { ok <- "iOS-2" })
+
+	// failure of iOS-2 came back before timeout.
+	assert.Equal(t, p.done("iOS-2"), true)
+	assert.Equal(t, p.done("iOS-2"), false)
+	assert.Equal(t, <-ok, "iOS-1")
+	select {
+	case id := <-ok:
+		t.Errorf("%s should not be ok", id)
+	case <-time.After(time.Second / 5):
+	}
+	assert.Equal(t, p.done("iOS-1"), false)
+}
@@ -0,0 +1,69 @@
+package thirdpart
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Push is the payload posted to push providers(iOS and Android), like:
+//
+//	{"text":"Dinner updated.","badge":1,"sound":"default","category":"cross","data":{"path":"/!123/cross"}}
+//
+// LocKey and LocArgs let iOS localize the text on device, ThreadId groups
+// notifications, like those of a cross.
+type Push struct {
+	Text           string                 `json:"text"`
+	Title          string                 `json:"title,omitempty"`
+	Subtitle       string                 `json:"subtitle,omitempty"`
+	LocKey         string                 `json:"loc_key,omitempty"`
+	LocArgs        []string               `json:"loc_args,omitempty"`
+	Badge          int                    `json:"badge,omitempty"`
+	Sound          string                 `json:"sound,omitempty"`
+	Category       string                 `json:"category,omitempty"`
+	ThreadId       string                 `json:"thread_id,omitempty"`
+	MutableContent bool                   `json:"mutable_content,omitempty"`
+	Data           map[string]interface{} `json:"data,omitempty"`
+}
+
+// ParsePush parses text of Push json. Text not starting with "{" is the old
+// format: text ends with a line of data json, with badge 1 and default sound.
+// The tail exfe.com url of text is removed.
+func ParsePush(text string) (Push, error) {
+	var ret Push
+	text = strings.Trim(text, " \r\n")
+	if strings.HasPrefix(text, "{") {
+		if err := json.Unmarshal([]byte(text), &ret); err != nil {
+			return ret, RecipientError{fmt.Errorf("invalid push(%s): %s", text, err)}
+		}
+	} else {
+		ret.Text = text
+		ret.Badge = 1
+		ret.Sound = "default"
+		if last := strings.LastIndex(text, "\n"); last >= 0 {
+			var data map[string]interface{}
+			if err := json.Unmarshal([]byte(text[last+1:]), &data); err == nil {
+				ret.Text = text[:last]
+				ret.Data = data
+			}
+		}
+	}
+	ret.Text = strings.Trim(ret.Text, " \r\n")
+	ret.Text = tailUrlRegex.ReplaceAllString(ret.Text, "")
+	return ret, nil
+}
+
+// CrossId returns the id of cross which push is about, from its data path like
+// "/!123/cross", or "" if it isn't about a cross.
+func (p Push) CrossId() string {
+	path, _ := p.Data["path"].(string)
+	if m := crossPathRegex.FindStringSubmatch(path); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+var crossPathRegex = regexp.MustCompile(`^/!(\d+)/`)
+
+var tailUrlRegex = regexp.MustCompile(` *(http|https):\/\/exfe.com(\/[\w#!:.?+=&%@!\-\/]*)?$`)
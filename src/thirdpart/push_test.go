@@ -0,0 +1,46 @@
+package thirdpart
+
+import (
+	"github.com/stretchrcom/testify/assert"
+	"testing"
+)
+
+func TestParsePush(t *testing.T) {
+	type Test struct {
+		text string
+		push Push
+		ok   bool
+	}
+	var tests = []Test{
+		{`{"text":"Dinner updated. http://exfe.com/#!token=abc","title":"Dinner","badge":1,"sound":"default","category":"cross","data":{"path":"/!123/cross"}}`,
+			Push{Text: "Dinner updated.", Title: "Dinner", Badge: 1, Sound: "default", Category: "cross", Data: map[string]interface{}{"path": "/!123/cross"}}, true},
+		{`{"text":"silent","data":{"path":"/!123/cross"}}`,
+			Push{Text: "silent", Data: map[string]interface{}{"path": "/!123/cross"}}, true},
+		{`{"text":"","loc_key":"CROSS_UPDATE","loc_args":["Bob","Dinner"],"subtitle":"Updated","thread_id":"123","mutable_content":true}`,
+			Push{LocKey: "CROSS_UPDATE", LocArgs: []string{"Bob", "Dinner"}, Subtitle: "Updated", ThreadId: "123", MutableContent: true}, true},
+		{`{"text":`, Push{}, false},
+
+		// old format
+		{"Dinner updated. http://exfe.com/#!token=abc\n\n{\"path\":\"/!123/cross\"}\n",
+			Push{Text: "Dinner updated.", Badge: 1, Sound: "default", Data: map[string]interface{}{"path": "/!123/cross"}}, true},
+		{"Dinner updated.\nat 7pm.",
+			Push{Text: "Dinner updated.\nat 7pm.", Badge: 1, Sound: "default"}, true},
+		{"Dinner updated.",
+			Push{Text: "Dinner updated.", Badge: 1, Sound: "default"}, true},
+	}
+	for i, test := range tests {
+		push, err := ParsePush(test.text)
+		assert.Equal(t, err == nil, test.ok, "test %d", i)
+		if err != nil {
+			continue
+		}
+		assert.Equal(t, push, test.push, "test %d", i)
+	}
+}
+
+func TestPushCrossId(t *testing.T) {
+	assert.Equal(t, Push{Data: map[string]interface{}{"path": "/!123/cross"}}.CrossId(), "123")
+	assert.Equal(t, Push{Data: map[string]interface{}{"path": "/!abc/cross"}}.CrossId(), "")
+	assert.Equal(t, Push{Data: map[string]interface{}{"path": 123}}.CrossId(), "")
+	assert.Equal(t, Push{}.CrossId(), "")
+}
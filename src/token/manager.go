@@ -1,6 +1,7 @@
 package token
 
 import (
+	"errors"
 	"github.com/googollee/go-rest"
 	"net/http"
 	"time"
@@ -74,29 +75,78 @@ func (t Manager) Create(ctx rest.Context, arg CreateArg) {
 		ctx.Return(http.StatusBadRequest, "invalid type %s", gentype)
 		return
 	}
+	err := t.store(&token, generator)
+	if err == errCollided {
+		ctx.Return(http.StatusConflict, "%s", err)
+		return
+	}
+	if err != nil {
+		ctx.Return(http.StatusInternalServerError, "%s", err)
+		return
+	}
+	token.compatible()
+	ctx.Render(token)
+}
+
+var errCollided = errors.New("key collided")
+
+// store generates a key not used by others, and saves token with it.
+func (t Manager) store(token *Token, generator func(*Token)) error {
 	for i := 0; i < 3; i++ {
-		generator(&token)
+		generator(token)
 		tokens, err := t.repo.FindByKey(token.Key)
 		if err != nil {
-			ctx.Return(http.StatusInternalServerError, "%s", err)
-			return
+			return err
 		}
 		if len(tokens) == 0 {
-			goto NEXIST
+			return t.repo.Store(*token)
 		}
 	}
-	ctx.Return(http.StatusConflict, "key collided")
-	return
-
-NEXIST:
+	return errCollided
+}
 
-	err := t.repo.Store(token)
+// Mint returns the long token of resource, and creates one if not exists. So
+// the same resource gets the same key until it expires, like links in
+// notifications.
+func (t Manager) Mint(resource, scope, data string, expireAfter time.Duration) (Token, error) {
+	hash := hashResource(resource)
+	tokens, err := t.repo.FindByHash(hash)
 	if err != nil {
-		ctx.Return(http.StatusInternalServerError, "%s", err)
-		return
+		return Token{}, err
+	}
+	for _, token := range tokens {
+		if token.Scope == scope {
+			token.compatible()
+			return token, nil
+		}
+	}
+	now := time.Now()
+	token := Token{
+		Hash:      hash,
+		Scope:     scope,
+		Data:      data,
+		CreatedAt: now.Unix(),
+		TouchedAt: now.Unix(),
+		ExpiresAt: now.Add(expireAfter).Unix(),
+	}
+	if err := t.store(&token, GenerateLongToken); err != nil {
+		return Token{}, err
 	}
 	token.compatible()
-	ctx.Render(token)
+	return token, nil
+}
+
+// Find returns the token with key, or false if not exists or expired.
+func (t Manager) Find(key string) (Token, bool, error) {
+	tokens, err := t.repo.FindByKey(key)
+	if err != nil {
+		return Token{}, false, err
+	}
+	if len(tokens) == 0 {
+		return Token{}, false, nil
+	}
+	tokens[0].compatible()
+	return tokens[0], true, nil
 }
 
 // 根据key获得一个token，如果token不存在，返回错误
@@ -241,3 +241,32 @@ func TestShortToken(t *testing.T) {
 		assert.Equal(t, ctx.Recorder.Code, http.StatusNotFound)
 	}
 }
+
+func TestMint(t *testing.T) {
+	repo := &TestTokenRepo{
+		store: make(map[string]Token),
+	}
+	mgr := New(repo)
+
+	token, err := mgr.Mint("unsubscribe/1/conversation", "unsubscribe", "data", time.Hour)
+	assert.Equal(t, err, nil)
+	assert.NotEqual(t, token.Key, "")
+	assert.Equal(t, token.Data, "data")
+
+	again, err := mgr.Mint("unsubscribe/1/conversation", "unsubscribe", "data", time.Hour)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, again.Key, token.Key)
+
+	other, err := mgr.Mint("unsubscribe/1/conversation", "other", "data", time.Hour)
+	assert.Equal(t, err, nil)
+	assert.NotEqual(t, other.Key, token.Key)
+
+	found, ok, err := mgr.Find(token.Key)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, found.Scope, "unsubscribe")
+
+	_, ok, err = mgr.Find("nonexist")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ok, false)
+}
@@ -7,6 +7,7 @@ import (
 )
 
 var QueueFull = errors.New("queue full")
+var Quitting = errors.New("valve quitting")
 
 type Worker interface {
 	Do() (interface{}, error)
@@ -41,27 +42,45 @@ func (v *Valve) Serve() {
 	for {
 		select {
 		case request := <-v.push:
-			begin := time.Now()
-
-			ret, err := request.worker.Do()
-			request.ret <- response{ret, err}
-
-			end := time.Now()
-			if d := end.Sub(begin); d < v.period {
-				time.Sleep(v.period - d)
-			}
+			v.do(request)
 		case <-v.tomb.Dying():
-			return
+			// drain the queued requests, callers are waiting for them.
+			for {
+				select {
+				case request := <-v.push:
+					v.do(request)
+				default:
+					return
+				}
+			}
 		}
 	}
 }
 
+func (v *Valve) do(request request) {
+	begin := time.Now()
+
+	ret, err := request.worker.Do()
+	request.ret <- response{ret, err}
+
+	end := time.Now()
+	if d := end.Sub(begin); d < v.period {
+		time.Sleep(v.period - d)
+	}
+}
+
+// Quit stops accepting workers, and returns after queued workers done.
 func (v *Valve) Quit() {
 	v.tomb.Kill(nil)
 	v.tomb.Wait()
 }
 
 func (v *Valve) Do(worker Worker) (interface{}, error) {
+	select {
+	case <-v.tomb.Dying():
+		return nil, Quitting
+	default:
+	}
 	req := request{worker, make(chan response)}
 	select {
 	case v.push <- req:
@@ -62,3 +62,27 @@ func TestValve(t *testing.T) {
 		<-c
 	}
 }
+
+func TestValveQuitDrain(t *testing.T) {
+	valve := New(3, time.Second/10)
+	go valve.Serve()
+
+	c := make(chan interface{}, 3)
+	for i := 0; i < 3; i++ {
+		go func(i int) {
+			ret, err := valve.Do(testWorker{i})
+			if err != nil {
+				t.Errorf("not expect error: %s", err)
+			}
+			c <- ret
+		}(i)
+	}
+	time.Sleep(time.Second / 20)
+	valve.Quit()
+	if len(c) != 3 {
+		t.Errorf("should drain 3 workers, but %d", len(c))
+	}
+	if _, err := valve.Do(testWorker{0}); err != Quitting {
+		t.Errorf("expect Quitting, got: %v", err)
+	}
+}
@@ -14,7 +14,7 @@ import (
 
 func main() {
 	var config model.Config
-	quit := daemon.Init("exfe.json", &config)
+	shutdown := daemon.Init("exfe.json", &config)
 
 	workType := os.Args[len(os.Args)-1]
 	work, ok := config.Wechat[workType]
@@ -72,7 +72,7 @@ func main() {
 	bot.init()
 
 	go func() {
-		<-quit
+		<-shutdown.Done()
 		logger.NOTICE("quit")
 		os.Exit(-1)
 		return